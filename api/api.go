@@ -9,6 +9,24 @@ import (
 	"google.golang.org/protobuf/proto"
 )
 
+// ParseEnvelope decodes a serialized Envelope and the Message it carries,
+// without any signature verification or payload decryption.
+func ParseEnvelope(buf []byte) (env *Envelope, msg *Message, err error) {
+	env = &Envelope{}
+
+	if err = proto.Unmarshal(buf, env); err != nil {
+		return nil, nil, err
+	}
+
+	msg = &Message{}
+
+	if err = proto.Unmarshal(env.Message, msg); err != nil {
+		return nil, nil, err
+	}
+
+	return
+}
+
 func (msg *Message) Bytes() (buf []byte) {
 	buf, _ = proto.Marshal(msg)
 	return
@@ -33,3 +51,33 @@ func (status *Status) Bytes() (buf []byte) {
 	buf, _ = proto.Marshal(status)
 	return
 }
+
+func (s *InvalidSession) Bytes() (buf []byte) {
+	buf, _ = proto.Marshal(s)
+	return
+}
+
+func (caps *Capabilities) Bytes() (buf []byte) {
+	buf, _ = proto.Marshal(caps)
+	return
+}
+
+func (bench *Benchmark) Bytes() (buf []byte) {
+	buf, _ = proto.Marshal(bench)
+	return
+}
+
+func (log *Log) Bytes() (buf []byte) {
+	buf, _ = proto.Marshal(log)
+	return
+}
+
+func (entry *LogEntry) Bytes() (buf []byte) {
+	buf, _ = proto.Marshal(entry)
+	return
+}
+
+func (res *ConfigurationResult) Bytes() (buf []byte) {
+	buf, _ = proto.Marshal(res)
+	return
+}
@@ -0,0 +1,53 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package api
+
+import (
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func FuzzParseEnvelope(f *testing.F) {
+	msg := &Message{
+		Timestamp: 1,
+		OpCode:    OpCode_STATUS,
+		Sequence:  1,
+		Payload:   []byte{0x0a, 0x00},
+	}
+
+	env := &Envelope{
+		Message: msg.Bytes(),
+		Signature: &Signature{
+			Data: make([]byte, 32),
+			R:    make([]byte, 32),
+			S:    make([]byte, 32),
+		},
+	}
+
+	f.Add(env.Bytes())
+	f.Add((&Envelope{}).Bytes())
+	f.Add([]byte{0x0a, 0x02, 0x08})
+
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		env, msg, err := ParseEnvelope(buf)
+
+		if err != nil {
+			return
+		}
+
+		// parsed envelopes must parse identically once re-encoded
+		_, res, err := ParseEnvelope(env.Bytes())
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !proto.Equal(msg, res) {
+			t.Fatalf("message mismatch")
+		}
+	})
+}
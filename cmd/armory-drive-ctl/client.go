@@ -0,0 +1,731 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"slices"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/usbarmory/armory-drive/api"
+)
+
+// session protocol versions
+const (
+	sessionV1 = 1
+	sessionV2 = 2
+
+	// highest supported version
+	sessionVersion = sessionV2
+
+	// HKDF info prefix for v2 session keys
+	sessionV2Info = "armory-drive session v2"
+	// HKDF info for session keys rotation
+	rekeyInfo = "armory-drive rekey"
+)
+
+// Client implements the mobile device (MD) side of the Armory Drive API.
+type Client struct {
+	transport Transport
+	keys      *Keystore
+
+	// noise selects Noise pairing and session handshakes
+	noise bool
+
+	// ephemeral session keys
+	mobileEphemeral *ecdsa.PrivateKey
+	armoryEphemeral *ecdsa.PublicKey
+	sessionKey      []byte
+
+	// negotiated session protocol version
+	version uint32
+	// v2 session keys and ciphers, MD to UA (tx, sealer) and UA to MD (rx,
+	// opener)
+	txKey  []byte
+	rxKey  []byte
+	sealer cipher.AEAD
+	opener cipher.AEAD
+	// v2 session message sequence numbers
+	txSequence uint64
+	rxSequence uint64
+
+	// in-session requests since negotiation or last re-keying
+	messages uint32
+	// session message limit, as last reported by the UA
+	messageLimit uint32
+
+	// last request timestamp
+	last int64
+}
+
+// timestamp returns the request timestamp in milliseconds, the UA requires
+// it to be strictly increasing within a session.
+func (c *Client) timestamp() int64 {
+	c.last = max(time.Now().UnixMilli(), c.last+1)
+	return c.last
+}
+
+func (c *Client) active() bool {
+	return len(c.sessionKey) > 0 || c.sealer != nil
+}
+
+func sign(key *ecdsa.PrivateKey, data []byte, digest bool) (sig *api.Signature, err error) {
+	sum := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+
+	if err != nil {
+		return
+	}
+
+	sig = &api.Signature{
+		R: r.Bytes(),
+		S: s.Bytes(),
+	}
+
+	if digest {
+		sig.Data = sum[:]
+	}
+
+	return
+}
+
+func verify(key *ecdsa.PublicKey, data []byte, sig *api.Signature) (err error) {
+	sum := sha256.Sum256(data)
+
+	if sig == nil || len(sig.Data) != 0 && !bytes.Equal(sig.Data, sum[:]) {
+		return errors.New("signature error, data mismatch")
+	}
+
+	r := new(big.Int).SetBytes(sig.R)
+	s := new(big.Int).SetBytes(sig.S)
+
+	if !ecdsa.Verify(key, sum[:], r, s) {
+		return errors.New("signature error, invalid")
+	}
+
+	return
+}
+
+// additionalData returns the message fields authenticated, along with the
+// encrypted payload, by v2 sessions.
+func additionalData(msg *api.Message) (buf []byte) {
+	buf = binary.BigEndian.AppendUint64(buf, uint64(msg.Timestamp))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(msg.OpCode))
+
+	if msg.Response {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+
+	buf = binary.BigEndian.AppendUint32(buf, uint32(msg.Error))
+
+	return binary.BigEndian.AppendUint64(buf, msg.Sequence)
+}
+
+func gcmNonce(sequence uint64) (nonce []byte) {
+	nonce = make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], sequence)
+	return
+}
+
+func (c *Client) seal(msg *api.Message) {
+	c.txSequence += 1
+
+	msg.Sequence = c.txSequence
+	msg.Payload = c.sealer.Seal(nil, gcmNonce(msg.Sequence), msg.Payload, additionalData(msg))
+}
+
+func (c *Client) open(msg *api.Message) (plaintext []byte, err error) {
+	if msg.Sequence <= c.rxSequence {
+		return nil, errors.New("stale response")
+	}
+
+	if plaintext, err = c.opener.Open(nil, gcmNonce(msg.Sequence), msg.Payload, additionalData(msg)); err != nil {
+		return
+	}
+
+	c.rxSequence = msg.Sequence
+
+	return
+}
+
+func (c *Client) encrypt(plaintext []byte) (ciphertext []byte, err error) {
+	block, err := aes.NewCipher(c.sessionKey)
+
+	if err != nil {
+		return
+	}
+
+	iv := make([]byte, aes.BlockSize)
+
+	if _, err = rand.Read(iv); err != nil {
+		return
+	}
+
+	ciphertext = make([]byte, len(plaintext))
+	cipher.NewOFB(block, iv).XORKeyStream(ciphertext, plaintext)
+
+	return append(iv, ciphertext...), nil
+}
+
+func (c *Client) decrypt(ciphertext []byte) (plaintext []byte, err error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errors.New("invalid message")
+	}
+
+	block, err := aes.NewCipher(c.sessionKey)
+
+	if err != nil {
+		return
+	}
+
+	plaintext = make([]byte, len(ciphertext)-aes.BlockSize)
+	cipher.NewOFB(block, ciphertext[0:aes.BlockSize]).XORKeyStream(plaintext, ciphertext[aes.BlockSize:])
+
+	return
+}
+
+// plaintext returns whether an operation payload is not encrypted, such
+// messages are always signed with long-term keys.
+func plaintext(op api.OpCode) bool {
+	switch op {
+	case api.OpCode_PAIR, api.OpCode_SESSION, api.OpCode_CAPABILITIES:
+		return true
+	default:
+		return false
+	}
+}
+
+// handshake returns whether an operation is a Noise handshake, whose
+// envelopes are not signed.
+func handshake(op api.OpCode) bool {
+	return op == api.OpCode_NOISE_PAIR || op == api.OpCode_NOISE_SESSION
+}
+
+// exchange sends a request message and returns the response payload, the
+// payload of messages other than plaintext and handshake ones is encrypted
+// with the session key.
+func (c *Client) exchange(op api.OpCode, payload proto.Message) (res []byte, err error) {
+	reqMsg := &api.Message{
+		Timestamp: c.timestamp(),
+		OpCode:    op,
+	}
+
+	if payload != nil {
+		if reqMsg.Payload, err = proto.Marshal(payload); err != nil {
+			return
+		}
+	}
+
+	return c.send(reqMsg)
+}
+
+// send sends a request message and returns the response payload.
+func (c *Client) send(reqMsg *api.Message) (res []byte, err error) {
+	op := reqMsg.OpCode
+	encrypted := !plaintext(op) && !handshake(op)
+
+	if encrypted && !c.active() {
+		return nil, errors.New("no active session")
+	}
+
+	v2 := encrypted && c.version >= sessionV2
+
+	// re-key before reaching the session message limit, the REKEY
+	// request itself being the last one allowed, v1 sessions are
+	// renegotiated instead
+	if encrypted && op != api.OpCode_REKEY && c.messageLimit > 0 && c.messages+1 >= c.messageLimit {
+		switch {
+		case c.version < sessionV2:
+			if err = c.Session(); err != nil {
+				return nil, fmt.Errorf("could not renegotiate session, %v", err)
+			}
+
+			v2 = c.version >= sessionV2
+		default:
+			if err = c.Rekey(); err != nil {
+				return nil, fmt.Errorf("could not re-key session, %v", err)
+			}
+		}
+	}
+
+	if encrypted {
+		c.messages += 1
+	}
+
+	switch {
+	case v2:
+		c.seal(reqMsg)
+	case encrypted:
+		if reqMsg.Payload, err = c.encrypt(reqMsg.Payload); err != nil {
+			return
+		}
+	}
+
+	sigKey := c.keys.mobileLongterm
+
+	if encrypted {
+		sigKey = c.mobileEphemeral
+	}
+
+	reqEnv := &api.Envelope{
+		Message: reqMsg.Bytes(),
+	}
+
+	// v2 sessions omit the redundant digest
+	if !handshake(op) {
+		if reqEnv.Signature, err = sign(sigKey, reqEnv.Message, !v2); err != nil {
+			return
+		}
+	}
+
+	buf, err := c.transport.Exchange(reqEnv.Bytes())
+
+	if err != nil {
+		return
+	}
+
+	resEnv := &api.Envelope{}
+
+	if err = proto.Unmarshal(buf, resEnv); err != nil {
+		return
+	}
+
+	verKey := c.keys.armoryLongterm
+
+	if encrypted {
+		verKey = c.armoryEphemeral
+	}
+
+	if !handshake(op) {
+		// errors invalidating the session are signed with the long-term key
+		if err = verify(verKey, resEnv.Message, resEnv.Signature); err != nil && encrypted {
+			err = verify(c.keys.armoryLongterm, resEnv.Message, resEnv.Signature)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	resMsg := &api.Message{}
+
+	if err = proto.Unmarshal(resEnv.Message, resMsg); err != nil {
+		return
+	}
+
+	if !resMsg.Response {
+		return nil, errors.New("invalid response")
+	}
+
+	if resMsg.Error == api.ErrorCode_INVALID_SESSION {
+		s := &api.InvalidSession{}
+
+		if proto.Unmarshal(resMsg.Payload, s) == nil && s.Expiry != api.SessionExpiry_NO_EXPIRY {
+			return nil, fmt.Errorf("request failed, %v (session expiry: %v)", resMsg.Error, s.Expiry)
+		}
+	}
+
+	if resMsg.Error != api.ErrorCode_NO_ERROR {
+		return nil, fmt.Errorf("request failed, %v", resMsg.Error)
+	}
+
+	if resMsg.OpCode != op {
+		return nil, fmt.Errorf("invalid response opcode %v", resMsg.OpCode)
+	}
+
+	switch {
+	case v2:
+		return c.open(resMsg)
+	case encrypted:
+		return c.decrypt(resMsg.Payload)
+	}
+
+	return resMsg.Payload, nil
+}
+
+// Pair registers the host long-term key with a USB armory in pairing mode,
+// using the content of its pairing code.
+func (c *Client) Pair(code *api.PairingQRCode) (err error) {
+	pk, err := x509.ParsePKIXPublicKey(code.PubKey)
+
+	if err != nil {
+		return
+	}
+
+	armoryLongterm, ok := pk.(*ecdsa.PublicKey)
+
+	if !ok {
+		return errors.New("incompatible key type")
+	}
+
+	nonce := make([]byte, 8)
+	binary.BigEndian.PutUint64(nonce, code.Nonce)
+
+	var data []byte
+	data = append(data, []byte(code.BLEName)...)
+	data = append(data, nonce...)
+	data = append(data, code.PubKey...)
+
+	if err = verify(armoryLongterm, data, code.Signature); err != nil {
+		return fmt.Errorf("invalid pairing code, %v", err)
+	}
+
+	mobileLongterm, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return
+	}
+
+	der, err := x509.MarshalECPrivateKey(mobileLongterm)
+
+	if err != nil {
+		return
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&mobileLongterm.PublicKey)
+
+	if err != nil {
+		return
+	}
+
+	kek := make([]byte, 32)
+
+	if _, err = rand.Read(kek); err != nil {
+		return
+	}
+
+	c.keys = &Keystore{
+		Name:           code.BLEName,
+		MobileLongterm: der,
+		ArmoryLongterm: code.PubKey,
+		KEK:            kek,
+		mobileLongterm: mobileLongterm,
+		armoryLongterm: armoryLongterm,
+	}
+
+	if c.noise && c.supports(api.OpCode_NOISE_PAIR) {
+		return c.noisePair(code.Nonce)
+	}
+
+	kex := &api.KeyExchange{
+		Key:   pub,
+		Nonce: code.Nonce,
+	}
+
+	_, err = c.exchange(api.OpCode_PAIR, kex)
+
+	return
+}
+
+// Session negotiates ephemeral session keys, using the highest protocol
+// version supported by both parties.
+func (c *Client) Session() (err error) {
+	c.sessionKey = nil
+	c.messages = 0
+	c.sealer = nil
+	c.opener = nil
+	c.version = 0
+
+	if c.noise && c.supports(api.OpCode_NOISE_SESSION) {
+		return c.noiseSession()
+	}
+
+	if c.mobileEphemeral, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return
+	}
+
+	pub, err := x509.MarshalPKIXPublicKey(&c.mobileEphemeral.PublicKey)
+
+	if err != nil {
+		return
+	}
+
+	req := &api.KeyExchange{
+		Key:     pub,
+		Version: sessionVersion,
+	}
+
+	buf, err := c.exchange(api.OpCode_SESSION, req)
+
+	if err != nil {
+		return
+	}
+
+	kex := &api.KeyExchange{}
+
+	if err = proto.Unmarshal(buf, kex); err != nil {
+		return
+	}
+
+	pk, err := x509.ParsePKIXPublicKey(kex.Key)
+
+	if err != nil {
+		return
+	}
+
+	var ok bool
+
+	if c.armoryEphemeral, ok = pk.(*ecdsa.PublicKey); !ok {
+		return errors.New("incompatible key type")
+	}
+
+	priv, err := c.mobileEphemeral.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	peer, err := c.armoryEphemeral.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	preMaster, err := priv.ECDH(peer)
+
+	if err != nil {
+		return
+	}
+
+	nonce := make([]byte, 8)
+	binary.BigEndian.PutUint64(nonce, kex.Nonce)
+
+	switch kex.Version {
+	case 0, sessionV1:
+		c.version = sessionV1
+	case sessionV2:
+		c.version = sessionV2
+		return c.newSessionV2(preMaster, nonce, pub, kex.Key)
+	default:
+		return fmt.Errorf("unsupported session version %d", kex.Version)
+	}
+
+	sessionKey := make([]byte, 32)
+
+	if _, err = io.ReadFull(hkdf.New(sha256.New, preMaster, nonce, nil), sessionKey); err != nil {
+		return
+	}
+
+	c.sessionKey = sessionKey
+
+	return
+}
+
+// newSessionV2 derives per-direction v2 session keys, binding the handshake
+// transcript.
+func (c *Client) newSessionV2(preMaster []byte, nonce []byte, mobileEphemeral []byte, armoryEphemeral []byte) (err error) {
+	mobileLongterm, err := x509.MarshalPKIXPublicKey(&c.keys.mobileLongterm.PublicKey)
+
+	if err != nil {
+		return
+	}
+
+	h := sha256.New()
+	h.Write(mobileEphemeral)
+	h.Write(armoryEphemeral)
+	h.Write(mobileLongterm)
+	h.Write(c.keys.ArmoryLongterm)
+	h.Write(nonce)
+
+	info := append([]byte(sessionV2Info), h.Sum(nil)...)
+	keys := make([]byte, 64)
+
+	if _, err = io.ReadFull(hkdf.New(sha256.New, preMaster, nonce, info), keys); err != nil {
+		return
+	}
+
+	return c.setSessionKeys(keys[0:32], keys[32:64])
+}
+
+// setSessionKeys sets v2 session keys, respectively for MD to UA and UA to MD
+// messages.
+func (c *Client) setSessionKeys(tx []byte, rx []byte) (err error) {
+	if c.sealer, err = newGCM(tx); err != nil {
+		return
+	}
+
+	if c.opener, err = newGCM(rx); err != nil {
+		return
+	}
+
+	c.version = sessionV2
+	c.txKey = tx
+	c.rxKey = rx
+	c.txSequence = 0
+	c.rxSequence = 0
+	c.messages = 0
+
+	return
+}
+
+func rekey(key []byte, nonce []byte) (next []byte, err error) {
+	next = make([]byte, len(key))
+	_, err = io.ReadFull(hkdf.New(sha256.New, key, nonce, []byte(rekeyInfo)), next)
+	return
+}
+
+// Rekey rotates the session keys, without a new session negotiation, it
+// requires a v2 session. The current keys are retained if the response is not
+// received, as the UA accepts them until either generation is used.
+func (c *Client) Rekey() (err error) {
+	if c.version < sessionV2 {
+		return errors.New("re-keying requires a v2 session")
+	}
+
+	buf, err := c.exchange(api.OpCode_REKEY, nil)
+
+	if err != nil {
+		return
+	}
+
+	kex := &api.KeyExchange{}
+
+	if err = proto.Unmarshal(buf, kex); err != nil {
+		return
+	}
+
+	nonce := make([]byte, 8)
+	binary.BigEndian.PutUint64(nonce, kex.Nonce)
+
+	tx, err := rekey(c.txKey, nonce)
+
+	if err != nil {
+		return
+	}
+
+	rx, err := rekey(c.rxKey, nonce)
+
+	if err != nil {
+		return
+	}
+
+	// sequence numbers are not reset by re-keying
+	txSequence, rxSequence := c.txSequence, c.rxSequence
+
+	if err = c.setSessionKeys(tx, rx); err != nil {
+		return
+	}
+
+	c.txSequence = txSequence
+	c.rxSequence = rxSequence
+
+	return
+}
+
+func newGCM(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Capabilities returns the USB armory supported protocol versions,
+// operations and features, it does not require an active session.
+func (c *Client) Capabilities() (caps *api.Capabilities, err error) {
+	buf, err := c.exchange(api.OpCode_CAPABILITIES, nil)
+
+	if err != nil {
+		return
+	}
+
+	caps = &api.Capabilities{}
+	err = proto.Unmarshal(buf, caps)
+
+	return
+}
+
+// supports returns whether the USB armory advertises an operation, firmware
+// predating capability discovery is assumed to support none of the optional
+// ones.
+func (c *Client) supports(op api.OpCode) bool {
+	caps, err := c.Capabilities()
+
+	if err != nil {
+		return false
+	}
+
+	return slices.Contains(caps.OpCodes, op)
+}
+
+// Status returns the USB armory status.
+func (c *Client) Status() (s *api.Status, err error) {
+	buf, err := c.exchange(api.OpCode_STATUS, nil)
+
+	if err != nil {
+		return
+	}
+
+	s = &api.Status{}
+
+	if err = proto.Unmarshal(buf, s); err != nil {
+		return
+	}
+
+	c.messageLimit = s.Configuration.GetSessionMessageLimit()
+
+	return
+}
+
+// Unlock unlocks encrypted storage with the keystore KEK.
+func (c *Client) Unlock() (err error) {
+	_, err = c.exchange(api.OpCode_UNLOCK, &api.KeyExchange{Key: c.keys.KEK})
+	return
+}
+
+// Lock locks encrypted storage.
+func (c *Client) Lock() (err error) {
+	_, err = c.exchange(api.OpCode_LOCK, nil)
+	return
+}
+
+// Log returns the USB armory audit log entries starting from the given index.
+func (c *Client) Log(index uint64) (l *api.Log, err error) {
+	buf, err := c.exchange(api.OpCode_GET_LOG, &api.LogRequest{Index: index})
+
+	if err != nil {
+		return
+	}
+
+	l = &api.Log{}
+	err = proto.Unmarshal(buf, l)
+
+	return
+}
+
+// Configure updates the USB armory configuration, firmware predating
+// field-level results returns an empty result.
+func (c *Client) Configure(conf *api.Configuration) (res *api.ConfigurationResult, err error) {
+	buf, err := c.exchange(api.OpCode_CONFIGURATION, conf)
+
+	if err != nil {
+		return
+	}
+
+	res = &api.ConfigurationResult{}
+	err = proto.Unmarshal(buf, res)
+
+	return
+}
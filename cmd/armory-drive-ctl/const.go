@@ -0,0 +1,28 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+const usage = `Usage: armory-drive-ctl [OPTIONS] <command>
+  -h    show this help
+
+  -k string
+        keystore path
+  -n    use Noise pairing and session handshakes, when supported
+
+Commands:
+  pair <path>                 pair using the pairing disk PAIRING.BIN file
+  capabilities                show supported protocol versions and features
+  status                      show status information
+  unlock                      unlock encrypted storage
+  lock                        lock encrypted storage
+  config set <setting> <value>
+                              change a setting (e.g. cipher AES128_CBC_PLAIN,
+                              blename Drive, ledpolicy LED_STEALTH,
+                              readonly true)
+  logs                        show audit log
+
+The keystore passphrase is read from the ARMORY_DRIVE_PASSPHRASE environment
+variable, if set, otherwise it is prompted.`
@@ -0,0 +1,181 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// keystore encryption key derivation parameters
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+
+	saltSize = 32
+	keySize  = 32
+)
+
+// Keystore represents the host (mobile device role) pairing material.
+type Keystore struct {
+	// BLE name of the paired USB armory
+	Name string
+	// MD long-term EC private key (DER)
+	MobileLongterm []byte
+	// UA long-term EC public key (DER)
+	ArmoryLongterm []byte
+	// key encryption key for encrypted storage unlock
+	KEK []byte
+
+	mobileLongterm *ecdsa.PrivateKey
+	armoryLongterm *ecdsa.PublicKey
+}
+
+// encrypted keystore file format
+type keystoreFile struct {
+	Salt       []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+func defaultKeystorePath() string {
+	dir, err := os.UserConfigDir()
+
+	if err != nil {
+		return "armory-drive.keystore"
+	}
+
+	return filepath.Join(dir, "armory-drive", "keystore")
+}
+
+func (ks *Keystore) parse() (err error) {
+	if ks.mobileLongterm, err = x509.ParseECPrivateKey(ks.MobileLongterm); err != nil {
+		return
+	}
+
+	pk, err := x509.ParsePKIXPublicKey(ks.ArmoryLongterm)
+
+	if err != nil {
+		return
+	}
+
+	var ok bool
+
+	if ks.armoryLongterm, ok = pk.(*ecdsa.PublicKey); !ok {
+		return errors.New("incompatible key type")
+	}
+
+	return
+}
+
+func keystoreCipher(passphrase []byte, salt []byte) (aead cipher.AEAD, err error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, keySize)
+
+	if err != nil {
+		return
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// loadKeystore decrypts and parses a keystore file.
+func loadKeystore(path string, passphrase []byte) (ks *Keystore, err error) {
+	buf, err := os.ReadFile(path)
+
+	if err != nil {
+		return
+	}
+
+	f := &keystoreFile{}
+
+	if err = json.Unmarshal(buf, f); err != nil {
+		return
+	}
+
+	aead, err := keystoreCipher(passphrase, f.Salt)
+
+	if err != nil {
+		return
+	}
+
+	plaintext, err := aead.Open(nil, f.Nonce, f.Ciphertext, nil)
+
+	if err != nil {
+		return nil, errors.New("could not decrypt keystore, invalid passphrase?")
+	}
+
+	ks = &Keystore{}
+
+	if err = json.Unmarshal(plaintext, ks); err != nil {
+		return
+	}
+
+	if err = ks.parse(); err != nil {
+		return nil, fmt.Errorf("invalid keystore, %v", err)
+	}
+
+	return
+}
+
+// save encrypts and writes the keystore to a file.
+func (ks *Keystore) save(path string, passphrase []byte) (err error) {
+	plaintext, err := json.Marshal(ks)
+
+	if err != nil {
+		return
+	}
+
+	f := &keystoreFile{
+		Salt: make([]byte, saltSize),
+	}
+
+	if _, err = rand.Read(f.Salt); err != nil {
+		return
+	}
+
+	aead, err := keystoreCipher(passphrase, f.Salt)
+
+	if err != nil {
+		return
+	}
+
+	f.Nonce = make([]byte, aead.NonceSize())
+
+	if _, err = rand.Read(f.Nonce); err != nil {
+		return
+	}
+
+	f.Ciphertext = aead.Seal(nil, f.Nonce, plaintext, nil)
+
+	buf, err := json.Marshal(f)
+
+	if err != nil {
+		return
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return
+	}
+
+	return os.WriteFile(path, buf, 0600)
+}
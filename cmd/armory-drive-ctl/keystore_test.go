@@ -0,0 +1,178 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testPassphrase = []byte("armory")
+
+func testKeystore(t *testing.T) *Keystore {
+	mobileLongterm, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	armoryLongterm, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ks := &Keystore{
+		Name: "UA-DRIVE-0123",
+		KEK:  bytes.Repeat([]byte{0x4b}, 32),
+	}
+
+	if ks.MobileLongterm, err = x509.MarshalECPrivateKey(mobileLongterm); err != nil {
+		t.Fatal(err)
+	}
+
+	if ks.ArmoryLongterm, err = x509.MarshalPKIXPublicKey(&armoryLongterm.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+
+	return ks
+}
+
+func TestKeystore(t *testing.T) {
+	ks := testKeystore(t)
+	path := filepath.Join(t.TempDir(), "armory-drive", "keystore")
+
+	if err := ks.save(path, testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := loadKeystore(path, testPassphrase)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Name != ks.Name || !bytes.Equal(res.KEK, ks.KEK) ||
+		!bytes.Equal(res.MobileLongterm, ks.MobileLongterm) || !bytes.Equal(res.ArmoryLongterm, ks.ArmoryLongterm) {
+		t.Fatal("keystore mismatch")
+	}
+
+	if res.mobileLongterm == nil || res.armoryLongterm == nil {
+		t.Fatal("keystore keys not parsed")
+	}
+
+	// the keystore is only accessible by its owner
+	for p, mode := range map[string]os.FileMode{path: 0600, filepath.Dir(path): 0700} {
+		fi, err := os.Stat(p)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if fi.Mode().Perm() != mode {
+			t.Errorf("%s: mode %v, expected %v", p, fi.Mode().Perm(), mode)
+		}
+	}
+
+	buf, err := os.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(buf, ks.KEK) || bytes.Contains(buf, []byte(ks.Name)) {
+		t.Error("keystore content not encrypted")
+	}
+
+	// the salt and nonce are not reused
+	if err = ks.save(path, testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	next, err := os.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(buf, next) {
+		t.Error("keystore encryption not randomized")
+	}
+}
+
+func TestKeystoreErrors(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "keystore")
+
+	if err := testKeystore(t).save(path, testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadKeystore(path, []byte("invalid")); err == nil {
+		t.Error("keystore decrypted with invalid passphrase")
+	}
+
+	if _, err := loadKeystore(filepath.Join(dir, "missing"), testPassphrase); err == nil {
+		t.Error("missing keystore loaded")
+	}
+
+	buf, err := os.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := &keystoreFile{}
+
+	if err = json.Unmarshal(buf, f); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tamper := range []func(f *keystoreFile){
+		func(f *keystoreFile) { f.Ciphertext[0] ^= 0x01 },
+		func(f *keystoreFile) { f.Nonce[0] ^= 0x01 },
+		func(f *keystoreFile) { f.Salt[0] ^= 0x01 },
+	} {
+		tampered := &keystoreFile{
+			Salt:       bytes.Clone(f.Salt),
+			Nonce:      bytes.Clone(f.Nonce),
+			Ciphertext: bytes.Clone(f.Ciphertext),
+		}
+
+		tamper(tampered)
+
+		if buf, err = json.Marshal(tampered); err != nil {
+			t.Fatal(err)
+		}
+
+		if err = os.WriteFile(path, buf, 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = loadKeystore(path, testPassphrase); err == nil {
+			t.Error("tampered keystore loaded")
+		}
+	}
+
+	// invalid keys
+	ks := testKeystore(t)
+	ks.ArmoryLongterm = ks.MobileLongterm
+
+	if err = ks.save(path, testPassphrase); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = loadKeystore(path, testPassphrase); err == nil {
+		t.Error("keystore with invalid keys loaded")
+	}
+}
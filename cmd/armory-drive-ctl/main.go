@@ -0,0 +1,406 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+
+	"github.com/usbarmory/armory-drive/api"
+)
+
+// environment variable for non-interactive keystore decryption
+const passphraseEnv = "ARMORY_DRIVE_PASSPHRASE"
+
+type Config struct {
+	keystore string
+	noise    bool
+}
+
+var conf *Config
+
+func init() {
+	log.SetFlags(0)
+	log.SetOutput(os.Stdout)
+
+	conf = &Config{}
+
+	flag.Usage = func() {
+		fmt.Println(usage)
+	}
+
+	flag.StringVar(&conf.keystore, "k", defaultKeystorePath(), "keystore path")
+	flag.BoolVar(&conf.noise, "n", false, "use Noise pairing and session handshakes, when supported")
+}
+
+func passphrase() []byte {
+	if p := os.Getenv(passphraseEnv); p != "" {
+		return []byte(p)
+	}
+
+	var res string
+
+	fmt.Printf("Keystore passphrase: ")
+	fmt.Scanln(&res)
+
+	return []byte(res)
+}
+
+func main() {
+	flag.Parse()
+
+	args := flag.Args()
+
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	t, err := openUSB()
+
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer t.Close()
+
+	c := &Client{
+		transport: t,
+		noise:     conf.noise,
+	}
+
+	if args[0] == "pair" {
+		err = pair(c, args[1:])
+	} else {
+		err = command(c, args)
+	}
+
+	if err != nil {
+		t.Close()
+		log.Fatal(err)
+	}
+}
+
+func pair(c *Client, args []string) (err error) {
+	if len(args) != 1 {
+		return errors.New("usage: pair <PAIRING.BIN path>")
+	}
+
+	buf, err := os.ReadFile(args[0])
+
+	if err != nil {
+		return
+	}
+
+	code := &api.PairingQRCode{}
+
+	if err = proto.Unmarshal(buf, code); err != nil {
+		return
+	}
+
+	if err = c.Pair(code); err != nil {
+		return
+	}
+
+	if err = c.keys.save(conf.keystore, passphrase()); err != nil {
+		return
+	}
+
+	log.Printf("paired with %s, keys saved to %s", code.BLEName, conf.keystore)
+
+	return
+}
+
+func command(c *Client, args []string) (err error) {
+	if c.keys, err = loadKeystore(conf.keystore, passphrase()); err != nil {
+		return
+	}
+
+	if args[0] == "capabilities" {
+		var caps *api.Capabilities
+
+		if caps, err = c.Capabilities(); err != nil {
+			return
+		}
+
+		printCapabilities(caps)
+		return
+	}
+
+	if err = c.Session(); err != nil {
+		return fmt.Errorf("could not establish session, %v", err)
+	}
+
+	switch args[0] {
+	case "status":
+		var s *api.Status
+
+		if s, err = c.Status(); err != nil {
+			return
+		}
+
+		printStatus(s)
+	case "unlock":
+		err = c.Unlock()
+	case "lock":
+		err = c.Lock()
+	case "config":
+		err = config(c, args[1:])
+	case "logs":
+		err = logs(c)
+	default:
+		err = fmt.Errorf("invalid command %q", args[0])
+	}
+
+	return
+}
+
+func config(c *Client, args []string) (err error) {
+	if len(args) != 3 || args[0] != "set" {
+		return errors.New("usage: config set <setting> <value>")
+	}
+
+	s, err := c.Status()
+
+	if err != nil {
+		return
+	}
+
+	settings := s.Configuration
+
+	if settings == nil {
+		settings = &api.Configuration{}
+	}
+
+	if err = setConfig(settings, args[1], args[2]); err != nil {
+		return
+	}
+
+	res, err := c.Configure(settings)
+
+	if err != nil {
+		return
+	}
+
+	if len(res.Changed) > 0 {
+		log.Printf("Changed: %s", strings.Join(res.Changed, ", "))
+	}
+
+	if len(res.Pending) > 0 {
+		log.Printf("Applied at next boot: %s", strings.Join(res.Pending, ", "))
+	}
+
+	return
+}
+
+// setConfig sets a configuration field, matched by name regardless of case,
+// parsing its value according to its type.
+func setConfig(settings *api.Configuration, name string, value string) (err error) {
+	var fd protoreflect.FieldDescriptor
+	var v protoreflect.Value
+
+	m := settings.ProtoReflect()
+	fields := m.Descriptor().Fields()
+
+	for i := 0; i < fields.Len(); i++ {
+		if strings.EqualFold(string(fields.Get(i).Name()), name) {
+			fd = fields.Get(i)
+			break
+		}
+	}
+
+	if fd == nil {
+		return fmt.Errorf("invalid setting %q", name)
+	}
+
+	switch fd.Kind() {
+	case protoreflect.EnumKind:
+		ev := fd.Enum().Values().ByName(protoreflect.Name(strings.ToUpper(value)))
+
+		if ev == nil {
+			return fmt.Errorf("invalid %s %q", fd.Name(), value)
+		}
+
+		v = protoreflect.ValueOfEnum(ev.Number())
+	case protoreflect.BoolKind:
+		var b bool
+
+		if b, err = strconv.ParseBool(value); err != nil {
+			return
+		}
+
+		v = protoreflect.ValueOfBool(b)
+	case protoreflect.Uint32Kind:
+		var n uint64
+
+		if n, err = strconv.ParseUint(value, 10, 32); err != nil {
+			return
+		}
+
+		v = protoreflect.ValueOfUint32(uint32(n))
+	case protoreflect.StringKind:
+		v = protoreflect.ValueOfString(value)
+	default:
+		return fmt.Errorf("unsupported setting %q", name)
+	}
+
+	m.Set(fd, v)
+
+	return
+}
+
+// logs prints the USB armory audit log, verifying the chaining of its
+// entries.
+func logs(c *Client) (err error) {
+	if !c.supports(api.OpCode_GET_LOG) {
+		return errors.New("logs are not supported by this firmware version")
+	}
+
+	pubKey, err := x509.MarshalPKIXPublicKey(&c.keys.mobileLongterm.PublicKey)
+
+	if err != nil {
+		return
+	}
+
+	device := sha256.Sum256(pubKey)
+
+	var index uint64
+	var previous *api.LogEntry
+
+	for {
+		var l *api.Log
+
+		if l, err = c.Log(index); err != nil {
+			return
+		}
+
+		for _, entry := range l.Entries {
+			if err = verifyLogEntry(entry, previous); err != nil {
+				return
+			}
+
+			printLogEntry(entry, device[:])
+
+			previous = entry
+			index = entry.Index + 1
+		}
+
+		if len(l.Entries) == 0 || index >= l.Next {
+			return
+		}
+	}
+}
+
+// verifyLogEntry checks that an audit log entry is chained to the previous
+// one, if any.
+func verifyLogEntry(entry *api.LogEntry, previous *api.LogEntry) (err error) {
+	if previous == nil {
+		return
+	}
+
+	if entry.Index != previous.Index+1 {
+		return fmt.Errorf("log entry %d missing", previous.Index+1)
+	}
+
+	buf, err := proto.Marshal(previous)
+
+	if err != nil {
+		return
+	}
+
+	if digest := sha256.Sum256(buf); !bytes.Equal(entry.Previous, digest[:]) {
+		return fmt.Errorf("log entry %d is not chained to the previous one", entry.Index)
+	}
+
+	return
+}
+
+func printLogEntry(entry *api.LogEntry, device []byte) {
+	var by string
+
+	switch {
+	case len(entry.Device) == 0:
+		by = "-"
+	case bytes.Equal(entry.Device, device):
+		by = "this device"
+	default:
+		by = hex.EncodeToString(entry.Device[:8])
+	}
+
+	ts := time.UnixMilli(entry.Timestamp).UTC().Format(time.RFC3339)
+	log.Printf("%6d %s %-22v %-12s %s", entry.Index, ts, entry.Event, by, entry.Detail)
+}
+
+func printCapabilities(caps *api.Capabilities) {
+	log.Printf("Protocol versions: %v", caps.ProtocolVersions)
+	log.Printf("Ciphers:           %v", caps.Ciphers)
+	log.Printf("Operations:        %v", caps.OpCodes)
+	log.Printf("Max message size:  %d", caps.MaxMessageSize)
+
+	if caps.HardwareRevision != "" {
+		log.Printf("Hardware revision: %s", caps.HardwareRevision)
+	}
+
+	log.Printf("Secure boot:       %v", caps.SecureBoot)
+}
+
+func printStatus(s *api.Status) {
+	log.Printf("Version:  %s", s.Version)
+	log.Printf("Capacity: %d", s.Capacity)
+	log.Printf("Locked:   %v", s.Locked)
+
+	if s.Locked && s.LockTrigger != api.LockTrigger_NO_TRIGGER {
+		log.Printf("Lock trigger: %v", s.LockTrigger)
+	}
+
+	if s.Configuration != nil {
+		log.Printf("Cipher:   %v", s.Configuration.Cipher)
+	}
+
+	if s.IdleLockRemaining > 0 {
+		log.Printf("Idle lock in %ds", s.IdleLockRemaining)
+	}
+
+	if s.UnlockFailures > 0 {
+		log.Printf("Failed unlock attempts: %d", s.UnlockFailures)
+	}
+
+	if s.UnlockBackoff > 0 {
+		log.Printf("Next unlock attempt in %ds", s.UnlockBackoff)
+	}
+
+	if c := s.Card; c != nil {
+		log.Printf("Card:     %s %s (manufacturer %#02x), %s %d MB/s", c.OEM, c.Product, c.Manufacturer, c.BusMode, c.Rate)
+		log.Printf("Card CID: %x", c.CID)
+	}
+
+	if s.Uptime > 0 {
+		log.Printf("Uptime:   %v", time.Duration(s.Uptime)*time.Second)
+		log.Printf("Transfers since unlock: %d bytes read, %d bytes written", s.BytesRead, s.BytesWritten)
+		log.Printf("Card errors: %d read, %d write, %d cache commit", s.ReadErrors, s.WriteErrors, s.CacheErrors)
+		log.Printf("Secure boot: %v", s.SecureBoot)
+	}
+
+	if s.CheckpointSize > 0 {
+		log.Printf("Firmware transparency log size: %d", s.CheckpointSize)
+	}
+
+	if s.LastUnlock != 0 {
+		log.Printf("Last unlock: %s", time.UnixMilli(s.LastUnlock).UTC().Format(time.RFC3339))
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/binary"
+
+	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/internal/noise"
+)
+
+// noisePair performs a Noise IK pairing handshake, bound to the pairing
+// nonce, the UA long-term key is authenticated by the handshake response.
+func (c *Client) noisePair(nonce uint64) (err error) {
+	s, err := c.keys.mobileLongterm.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	rs, err := c.keys.armoryLongterm.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	hs, err := noise.NewHandshake(&noise.Config{
+		Pattern:    noise.IK,
+		Initiator:  true,
+		Prologue:   binary.BigEndian.AppendUint64([]byte(noise.PAIRING_PROLOGUE), nonce),
+		Static:     s,
+		PeerStatic: rs,
+	})
+
+	if err != nil {
+		return
+	}
+
+	reqMsg := &api.Message{
+		Timestamp: c.timestamp(),
+		OpCode:    api.OpCode_NOISE_PAIR,
+	}
+
+	if reqMsg.Payload, err = hs.WriteMessage(nil); err != nil {
+		return
+	}
+
+	res, err := c.send(reqMsg)
+
+	if err != nil {
+		return
+	}
+
+	_, err = hs.ReadMessage(res)
+
+	return
+}
+
+// noiseSession performs a Noise KK session handshake, bound to the request
+// timestamp.
+func (c *Client) noiseSession() (err error) {
+	s, err := c.keys.mobileLongterm.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	rs, err := c.keys.armoryLongterm.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	// the MD ephemeral key is also used to sign in-session messages
+	if c.mobileEphemeral, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return
+	}
+
+	e, err := c.mobileEphemeral.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	reqMsg := &api.Message{
+		Timestamp: c.timestamp(),
+		OpCode:    api.OpCode_NOISE_SESSION,
+	}
+
+	hs, err := noise.NewHandshake(&noise.Config{
+		Pattern:    noise.KK,
+		Initiator:  true,
+		Prologue:   binary.BigEndian.AppendUint64([]byte(noise.SESSION_PROLOGUE), uint64(reqMsg.Timestamp)),
+		Static:     s,
+		Ephemeral:  e,
+		PeerStatic: rs,
+	})
+
+	if err != nil {
+		return
+	}
+
+	if reqMsg.Payload, err = hs.WriteMessage(nil); err != nil {
+		return
+	}
+
+	res, err := c.send(reqMsg)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = hs.ReadMessage(res); err != nil {
+		return
+	}
+
+	if c.armoryEphemeral, err = ecdsa.ParseUncompressedPublicKey(elliptic.P256(), hs.PeerEphemeral().Bytes()); err != nil {
+		return
+	}
+
+	k1, k2, err := hs.Split()
+
+	if err != nil {
+		return
+	}
+
+	return c.setSessionKeys(k1, k2)
+}
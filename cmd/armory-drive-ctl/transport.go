@@ -0,0 +1,52 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// maximum frame size accepted by the management interface
+const frameMax = 16 * 1024
+
+// Transport represents a channel towards the Armory Drive management API,
+// carrying serialized api.Envelope messages.
+type Transport interface {
+	// Exchange sends a request envelope and returns the response one.
+	Exchange(req []byte) (res []byte, err error)
+	// Close terminates the transport.
+	Close() error
+}
+
+// writeFrame writes an envelope preceded by its length, as a 16-bit
+// big-endian value, as framed by the management interface.
+func writeFrame(w io.Writer, buf []byte) (err error) {
+	if len(buf) > frameMax {
+		return errors.New("frame too large")
+	}
+
+	frame := make([]byte, 2, 2+len(buf))
+	binary.BigEndian.PutUint16(frame, uint16(len(buf)))
+
+	_, err = w.Write(append(frame, buf...))
+
+	return
+}
+
+func readFrame(r io.Reader) (buf []byte, err error) {
+	hdr := make([]byte, 2)
+
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return
+	}
+
+	buf = make([]byte, binary.BigEndian.Uint16(hdr))
+	_, err = io.ReadFull(r, buf)
+
+	return
+}
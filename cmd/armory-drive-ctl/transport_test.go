@@ -0,0 +1,58 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestFrame(t *testing.T) {
+	for _, size := range []int{0, 1, 0x100, frameMax} {
+		buf := new(bytes.Buffer)
+		msg := bytes.Repeat([]byte{0xaa}, size)
+
+		if err := writeFrame(buf, msg); err != nil {
+			t.Fatal(err)
+		}
+
+		if buf.Len() != size+2 || int(buf.Bytes()[0])<<8|int(buf.Bytes()[1]) != size {
+			t.Fatalf("size %d: invalid frame header %x", size, buf.Bytes()[0:2])
+		}
+
+		res, err := readFrame(buf)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(res, msg) {
+			t.Fatalf("size %d: frame mismatch", size)
+		}
+	}
+
+	if err := writeFrame(io.Discard, make([]byte, frameMax+1)); err == nil {
+		t.Error("oversized frame written")
+	}
+}
+
+func TestFrameTruncated(t *testing.T) {
+	for _, tc := range []struct {
+		frame []byte
+		err   error
+	}{
+		{nil, io.EOF},
+		{[]byte{0x00}, io.ErrUnexpectedEOF},
+		{[]byte{0x00, 0x02, 0xaa}, io.ErrUnexpectedEOF},
+		{[]byte{0x00, 0x02}, io.EOF},
+	} {
+		if _, err := readFrame(bytes.NewReader(tc.frame)); !errors.Is(err, tc.err) {
+			t.Errorf("%x: unexpected error %v", tc.frame, err)
+		}
+	}
+}
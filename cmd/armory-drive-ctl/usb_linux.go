@@ -0,0 +1,188 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	vendorID  = "1209"
+	productID = "2702"
+
+	// management interface endpoints
+	mgmtInEndpoint  = 0x84
+	mgmtOutEndpoint = 0x04
+
+	vendorSpecificClass = "ff"
+
+	// bulk endpoint packet size
+	maxPacketSize = 512
+
+	// bulk transfer timeout (ms)
+	usbTimeout = 120 * 1000
+
+	// linux/usbdevice_fs.h
+	USBDEVFS_CLAIMINTERFACE   = 0x8004550f
+	USBDEVFS_RELEASEINTERFACE = 0x80045510
+)
+
+// linux/usbdevice_fs.h: struct usbdevfs_bulktransfer
+type bulkTransfer struct {
+	ep      uint32
+	len     uint32
+	timeout uint32
+	data    uintptr
+}
+
+// _IOWR('U', 2, struct usbdevfs_bulktransfer)
+var USBDEVFS_BULK = uintptr(3<<30 | unsafe.Sizeof(bulkTransfer{})<<16 | 'U'<<8 | 2)
+
+// usbTransport implements the management interface framing over Linux
+// usbfs bulk transfers.
+type usbTransport struct {
+	f     *os.File
+	iface uint32
+
+	// received data pending consumption
+	buf []byte
+}
+
+func readAttr(dir string, name string) string {
+	buf, _ := os.ReadFile(filepath.Join(dir, name))
+	return strings.TrimSpace(string(buf))
+}
+
+func openUSB() (t Transport, err error) {
+	devices, _ := filepath.Glob("/sys/bus/usb/devices/*")
+
+	for _, dev := range devices {
+		if readAttr(dev, "idVendor") != vendorID || readAttr(dev, "idProduct") != productID {
+			continue
+		}
+
+		ifaces, _ := filepath.Glob(dev + "/" + filepath.Base(dev) + ":*")
+
+		for _, iface := range ifaces {
+			if readAttr(iface, "bInterfaceClass") != vendorSpecificClass {
+				continue
+			}
+
+			bus, _ := strconv.Atoi(readAttr(dev, "busnum"))
+			num, _ := strconv.Atoi(readAttr(dev, "devnum"))
+			n, _ := strconv.ParseUint(readAttr(iface, "bInterfaceNumber"), 16, 8)
+
+			return newUSBTransport(fmt.Sprintf("/dev/bus/usb/%03d/%03d", bus, num), uint32(n))
+		}
+	}
+
+	return nil, errors.New("could not find Armory Drive management interface")
+}
+
+func newUSBTransport(path string, iface uint32) (t *usbTransport, err error) {
+	t = &usbTransport{
+		iface: iface,
+	}
+
+	if t.f, err = os.OpenFile(path, os.O_RDWR, 0); err != nil {
+		return
+	}
+
+	if err = t.ioctl(USBDEVFS_CLAIMINTERFACE, unsafe.Pointer(&t.iface)); err != nil {
+		t.f.Close()
+		return nil, fmt.Errorf("could not claim interface, %v", err)
+	}
+
+	return
+}
+
+func (t *usbTransport) ioctl(req uintptr, arg unsafe.Pointer) (err error) {
+	_, err = t.ioctlN(req, arg)
+	return
+}
+
+func (t *usbTransport) ioctlN(req uintptr, arg unsafe.Pointer) (n int, err error) {
+	r, _, errno := syscall.Syscall(syscall.SYS_IOCTL, t.f.Fd(), req, uintptr(arg))
+
+	if errno != 0 {
+		return 0, errno
+	}
+
+	return int(r), nil
+}
+
+func (t *usbTransport) bulk(ep uint8, buf []byte) (n int, err error) {
+	bt := &bulkTransfer{
+		ep:      uint32(ep),
+		len:     uint32(len(buf)),
+		timeout: usbTimeout,
+	}
+
+	if len(buf) > 0 {
+		bt.data = uintptr(unsafe.Pointer(&buf[0]))
+	}
+
+	n, err = t.ioctlN(USBDEVFS_BULK, unsafe.Pointer(bt))
+	runtime.KeepAlive(buf)
+
+	return
+}
+
+// Read implements io.Reader, buffering whole bulk transfers as reads shorter
+// than the transfer size would overflow.
+func (t *usbTransport) Read(p []byte) (n int, err error) {
+	if len(t.buf) == 0 {
+		buf := make([]byte, frameMax+2)
+
+		if n, err = t.bulk(mgmtInEndpoint, buf); err != nil {
+			return
+		}
+
+		t.buf = buf[0:n]
+	}
+
+	n = copy(p, t.buf)
+	t.buf = t.buf[n:]
+
+	return
+}
+
+// Write implements io.Writer, transfers are terminated with a zero-length
+// packet when required to signal their completion.
+func (t *usbTransport) Write(p []byte) (n int, err error) {
+	if n, err = t.bulk(mgmtOutEndpoint, p); err != nil {
+		return
+	}
+
+	if len(p)%maxPacketSize == 0 {
+		_, err = t.bulk(mgmtOutEndpoint, nil)
+	}
+
+	return
+}
+
+func (t *usbTransport) Exchange(req []byte) (res []byte, err error) {
+	if err = writeFrame(t, req); err != nil {
+		return
+	}
+
+	return readFrame(t)
+}
+
+func (t *usbTransport) Close() error {
+	t.ioctl(USBDEVFS_RELEASEINTERFACE, unsafe.Pointer(&t.iface))
+	return t.f.Close()
+}
@@ -0,0 +1,16 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+func openUSB() (t Transport, err error) {
+	return nil, errors.New("USB transport is only supported on Linux")
+}
@@ -0,0 +1,114 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build tamago
+
+package ble
+
+import (
+	"runtime"
+	"time"
+
+	"github.com/usbarmory/armory-drive/internal/edm"
+
+	usbarmory "github.com/usbarmory/tamago/board/usbarmory/mk2"
+)
+
+// annaTransport implements edm.Transport over the UART of the USB armory
+// Mk II u-blox ANNA-B112 module.
+type annaTransport struct {
+	anna     *usbarmory.ANNA
+	deadline time.Time
+}
+
+// newANNATransport initializes the BLE module and returns its transport.
+func newANNATransport() (edm.Transport, error) {
+	t := &annaTransport{
+		anna: usbarmory.BLE,
+	}
+
+	if err := t.anna.Init(); err != nil {
+		return nil, err
+	}
+
+	time.Sleep(usbarmory.RESET_GRACE_TIME)
+
+	return t, nil
+}
+
+func (t *annaTransport) rx(buf []byte) (n int) {
+	// detect USB armory Mk II β errata fix
+	if t.anna.UART.Flow {
+		n, _ = t.anna.UART.Read(buf)
+		return
+	}
+
+	t.anna.CTS(true)
+	c, ok := t.anna.UART.Rx()
+	t.anna.CTS(false)
+
+	if ok {
+		buf[0] = c
+		n = 1
+	}
+
+	return
+}
+
+func (t *annaTransport) Read(buf []byte) (n int, err error) {
+	if len(buf) == 0 {
+		return
+	}
+
+	for {
+		if n = t.rx(buf); n > 0 {
+			return
+		}
+
+		if !t.deadline.IsZero() && time.Now().After(t.deadline) {
+			return 0, edm.ErrTimeout
+		}
+
+		runtime.Gosched()
+	}
+}
+
+func (t *annaTransport) Write(buf []byte) (n int, err error) {
+	// detect USB armory Mk II β errata fix
+	if t.anna.UART.Flow {
+		return t.anna.UART.Write(buf)
+	}
+
+	for i := 0; i < len(buf); i++ {
+		for !t.anna.RTS() {
+		}
+
+		t.anna.UART.Tx(buf[i])
+	}
+
+	return len(buf), nil
+}
+
+func (t *annaTransport) SetReadDeadline(deadline time.Time) error {
+	t.deadline = deadline
+	return nil
+}
+
+// hardwareRevision returns the USB armory Mk II revision, detected through
+// its BLE module UART.
+func (b *BLE) hardwareRevision() string {
+	t, ok := b.Transport.(*annaTransport)
+
+	if !ok {
+		return ""
+	}
+
+	// detect USB armory Mk II β errata fix
+	if t.anna.UART.Flow {
+		return "UA-MKII-γ"
+	}
+
+	return "UA-MKII-β"
+}
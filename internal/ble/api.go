@@ -10,27 +10,38 @@ import (
 	"encoding/binary"
 	"errors"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/usbarmory/armory-drive/api"
 	"github.com/usbarmory/armory-drive/assets"
 	"github.com/usbarmory/armory-drive/internal/crypto"
-
-	usbarmory "github.com/usbarmory/tamago/board/usbarmory/mk2"
+	"github.com/usbarmory/armory-drive/internal/led"
 
 	"google.golang.org/protobuf/proto"
 )
 
+// plaintext returns whether an operation payload is not encrypted, such
+// messages are always signed with long-term keys.
+func plaintext(op api.OpCode) bool {
+	switch op {
+	case api.OpCode_PAIR, api.OpCode_SESSION, api.OpCode_CAPABILITIES:
+		return true
+	default:
+		return false
+	}
+}
+
 func (b *BLE) parseEnvelope(buf []byte) (msg *api.Message, err error) {
-	env := &api.Envelope{}
+	env, msg, err := api.ParseEnvelope(buf)
 
-	if err = proto.Unmarshal(buf, env); err != nil {
+	if err != nil {
 		return
 	}
 
-	msg = &api.Message{}
-
-	if err = proto.Unmarshal(env.Message, msg); err != nil {
+	// Noise handshakes are authenticated by their handlers, as failed ones
+	// must not affect the current session.
+	if handshake(msg.OpCode) {
 		return
 	}
 
@@ -39,28 +50,53 @@ func (b *BLE) parseEnvelope(buf []byte) (msg *api.Message, err error) {
 		b.session.Reset()
 	}
 
+	if !plaintext(msg.OpCode) && !b.pairingMode && !b.session.Active {
+		return msg, errNoSession
+	}
+
 	if !b.pairingMode && b.Keyring.MobileLongterm != nil {
-		if err = b.verifyEnvelope(env); err != nil {
+		if err = b.verifyEnvelope(env, msg.OpCode); err != nil {
 			return
 		}
 	}
 
-	if msg.OpCode != api.OpCode_PAIR && msg.OpCode != api.OpCode_SESSION {
-		if err = b.decryptPayload(msg); err != nil {
-			return
-		}
+	if plaintext(msg.OpCode) {
+		return
 	}
 
-	if msg.Timestamp <= b.session.Last {
-		return nil, errors.New("invalid timestamp")
+	if err = b.decryptPayload(msg); err != nil {
+		return
 	}
 
-	b.session.Last = msg.Timestamp
+	// v2 sessions are protected against replay by sequence numbers, v1
+	// ones rely on timestamps for compatibility.
+	if b.Keyring.SessionVersion() < crypto.SESSION_V2 {
+		if msg.Timestamp <= b.session.Last {
+			return nil, crypto.ErrStale
+		}
+
+		b.session.Last = msg.Timestamp
+	}
 
 	return
 }
 
-func (b *BLE) handleEnvelope(req []byte) (res []byte) {
+// HandleEnvelope processes a serialized api.Envelope received over a
+// transport other than BLE (e.g. the USB management interface), returning
+// the serialized response. The BLE session is shared across transports.
+func (b *BLE) HandleEnvelope(req []byte) (res []byte) {
+	return b.handleEnvelope(req, nil)
+}
+
+// handleEnvelope processes a serialized api.Envelope, the optional auth
+// function is invoked, with the envelope lock held, once the request has been
+// authenticated within an active session.
+func (b *BLE) handleEnvelope(req []byte, auth func()) (res []byte) {
+	var authenticated bool
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
 	resMsg := &api.Message{
 		Timestamp: b.session.Time(),
 		Response:  true,
@@ -70,22 +106,51 @@ func (b *BLE) handleEnvelope(req []byte) (res []byte) {
 	defer func() {
 		var err error
 
-		if resMsg.OpCode != api.OpCode_PAIR && resMsg.OpCode != api.OpCode_SESSION {
+		// session errors are not encrypted as session keys are
+		// either invalid or discarded
+		encrypted := !plaintext(resMsg.OpCode) && !handshake(resMsg.OpCode) &&
+			resMsg.Error != api.ErrorCode_INVALID_SESSION
+
+		if encrypted {
 			if err = b.encryptPayload(resMsg); err != nil {
 				return
 			}
 		}
 
+		if nonce := b.session.rekey; nonce != nil {
+			b.session.rekey = nil
+
+			if err = b.Keyring.Rekey(nonce); err != nil {
+				log.Printf("session re-keying error, %v", err)
+				b.Keyring.ClearSessionKeys()
+				b.session.Reset()
+			}
+		}
+
 		resEnv := &api.Envelope{
 			Message: resMsg.Bytes(),
 		}
 
-		if err = b.signEnvelope(resEnv); err != nil {
-			return
+		if !handshake(resMsg.OpCode) {
+			if err = b.signEnvelope(resEnv, resMsg.OpCode); err != nil {
+				return
+			}
+		}
+
+		if b.session.terminate {
+			b.Keyring.ClearSessionKeys()
+			b.session.Reset()
+		}
+
+		switch resMsg.OpCode {
+		case api.OpCode_SESSION, api.OpCode_NOISE_SESSION:
+			if resMsg.Error == 0 {
+				b.startSession()
+			}
 		}
 
-		if resMsg.OpCode == api.OpCode_SESSION && resMsg.Error == 0 {
-			b.session.Active = true
+		if auth != nil && authenticated && b.session.Active {
+			auth()
 		}
 
 		res = resEnv.Bytes()
@@ -93,12 +158,32 @@ func (b *BLE) handleEnvelope(req []byte) (res []byte) {
 
 	reqMsg, err := b.parseEnvelope(req)
 
-	if err != nil {
+	switch {
+	case errors.Is(err, errNoSession):
+		resMsg.OpCode = reqMsg.OpCode
+		b.invalidSession(resMsg)
+		return
+	case errors.Is(err, crypto.ErrStale):
+		resMsg.Error = api.ErrorCode_STALE_MESSAGE
+		return
+	case err != nil:
 		resMsg.Error = api.ErrorCode_INVALID_MESSAGE
 		return
 	}
 
 	resMsg.OpCode = reqMsg.OpCode
+
+	// Only in-session messages, unlike handshake or plaintext ones, are
+	// protected against replay and therefore indicate the MD presence.
+	if !b.pairingMode && !plaintext(reqMsg.OpCode) && !handshake(reqMsg.OpCode) {
+		if b.useSession() != api.SessionExpiry_NO_EXPIRY {
+			b.invalidSession(resMsg)
+			return
+		}
+
+		authenticated = true
+	}
+
 	b.handleMessage(reqMsg, resMsg)
 
 	return
@@ -106,13 +191,22 @@ func (b *BLE) handleEnvelope(req []byte) (res []byte) {
 
 func (b *BLE) handleMessage(reqMsg *api.Message, resMsg *api.Message) {
 	switch {
+	case handshake(reqMsg.OpCode) && !NOISE:
+		resMsg.Error = api.ErrorCode_INVALID_MESSAGE
+		return
+	case reqMsg.OpCode == api.OpCode_CAPABILITIES:
+		b.capabilities(reqMsg, resMsg)
+		return
 	case b.pairingMode:
-		if reqMsg.OpCode != api.OpCode_PAIR {
+		switch reqMsg.OpCode {
+		case api.OpCode_PAIR:
+			b.pair(reqMsg, resMsg)
+		case api.OpCode_NOISE_PAIR:
+			b.noisePair(reqMsg, resMsg)
+		default:
 			resMsg.Error = api.ErrorCode_INVALID_MESSAGE
-			return
 		}
 
-		b.pair(reqMsg, resMsg)
 		return
 	case b.Keyring.MobileLongterm == nil:
 		resMsg.Error = api.ErrorCode_INVALID_MESSAGE
@@ -120,6 +214,9 @@ func (b *BLE) handleMessage(reqMsg *api.Message, resMsg *api.Message) {
 	case reqMsg.OpCode == api.OpCode_SESSION:
 		b.newSession(reqMsg, resMsg)
 		return
+	case reqMsg.OpCode == api.OpCode_NOISE_SESSION:
+		b.noiseSession(reqMsg, resMsg)
+		return
 	case !b.session.Active:
 		resMsg.Error = api.ErrorCode_INVALID_SESSION
 		return
@@ -134,6 +231,12 @@ func (b *BLE) handleMessage(reqMsg *api.Message, resMsg *api.Message) {
 		b.status(reqMsg, resMsg)
 	case api.OpCode_CONFIGURATION:
 		b.configuration(reqMsg, resMsg)
+	case api.OpCode_BENCHMARK:
+		b.benchmark(reqMsg, resMsg)
+	case api.OpCode_REKEY:
+		b.rekey(reqMsg, resMsg)
+	case api.OpCode_GET_LOG:
+		b.getLog(reqMsg, resMsg)
 	default:
 		resMsg.Error = api.ErrorCode_INVALID_MESSAGE
 	}
@@ -160,20 +263,29 @@ func (b *BLE) pair(reqMsg *api.Message, resMsg *api.Message) {
 		return
 	}
 
+	err = b.paired(keyExchange.Key)
+}
+
+// paired completes a successful pairing with the MD long-term key (DER).
+func (b *BLE) paired(key []byte) (err error) {
 	// At this point pairing is considered successful, therefore overwrite
 	// previous keyring with the newly generated UA longterm key.
 	b.Keyring.Init(true)
 
 	// Import the MD longterm key.
-	if err = b.Keyring.Import(crypto.MD_LONGTERM_KEY, false, keyExchange.Key); err != nil {
+	if err = b.Keyring.Import(crypto.MD_LONGTERM_KEY, false, key); err != nil {
 		return
 	}
 
 	// Save the received MD longterm key in persistent storage.
-	b.Keyring.Conf.MobileLongterm = keyExchange.Key
+	b.Keyring.Conf.MobileLongterm = key
 	err = b.Keyring.Save()
 
+	b.Keyring.Audit(api.LogEvent_PAIRED, "")
+
 	b.Drive.PairingComplete <- true
+
+	return
 }
 
 func (b *BLE) newSession(reqMsg *api.Message, resMsg *api.Message) {
@@ -199,8 +311,9 @@ func (b *BLE) newSession(reqMsg *api.Message, resMsg *api.Message) {
 	}
 
 	nonce := crypto.Rand(8)
+	version := min(max(keyExchange.Version, crypto.SESSION_V1), crypto.SESSION_VERSION)
 
-	if err = b.Keyring.NewSessionKeys(nonce); err != nil {
+	if err = b.Keyring.NewSessionKeys(nonce, version); err != nil {
 		return
 	}
 
@@ -217,6 +330,11 @@ func (b *BLE) newSession(reqMsg *api.Message, resMsg *api.Message) {
 		Nonce: binary.BigEndian.Uint64(nonce),
 	}
 
+	// v1 responses are left unchanged for compatibility
+	if version > crypto.SESSION_V1 {
+		keyExchange.Version = version
+	}
+
 	resMsg.Timestamp = b.session.Time()
 	resMsg.Payload = keyExchange.Bytes()
 }
@@ -228,8 +346,9 @@ func (b *BLE) unlock(reqMsg *api.Message, resMsg *api.Message) {
 	b.session.Lock()
 
 	defer func() {
-		b.Drive.Ready = (err == nil)
-		usbarmory.LED("white", b.Drive.Ready)
+		b.Drive.SetReady(err == nil)
+		led.Set("white", b.Drive.Ready())
+		b.auditUnlock(err)
 
 		// rate limit unlock operation
 		time.Sleep(1 * time.Second)
@@ -241,6 +360,12 @@ func (b *BLE) unlock(reqMsg *api.Message, resMsg *api.Message) {
 		return
 	}
 
+	if b.unlockRemaining() > 0 {
+		err = errUnlockThrottled
+		resMsg.Error = api.ErrorCode_UNLOCK_THROTTLED
+		return
+	}
+
 	defer func() {
 		if err != nil {
 			resMsg.Error = api.ErrorCode_UNLOCK_FAILED
@@ -252,10 +377,24 @@ func (b *BLE) unlock(reqMsg *api.Message, resMsg *api.Message) {
 		return
 	}
 
-	err = b.Keyring.SetCipher(b.Keyring.Conf.Settings.Cipher, keyExchange.Key)
+	if err = b.verifyKEK(keyExchange.Key); err != nil {
+		return
+	}
+
+	if err = b.Keyring.SetCipher(b.Keyring.Conf.Settings.Cipher, keyExchange.Key); err != nil {
+		return
+	}
+
+	if err = b.Drive.Configure(); err != nil {
+		return
+	}
+
+	b.unlockSucceeded()
 }
 
 func (b *BLE) lock(reqMsg *api.Message, resMsg *api.Message) {
+	b.Drive.LockTrigger = api.LockTrigger_LOCK_REQUEST
+
 	if err := b.Drive.Lock(); err != nil {
 		resMsg.Error = api.ErrorCode_GENERIC_ERROR
 	}
@@ -263,12 +402,28 @@ func (b *BLE) lock(reqMsg *api.Message, resMsg *api.Message) {
 
 func (b *BLE) status(reqMsg *api.Message, resMsg *api.Message) {
 	s := &api.Status{
-		Version:       assets.Revision,
-		Capacity:      b.Drive.Capacity(),
-		Locked:        !b.Drive.Ready,
-		Configuration: b.Keyring.Conf.Settings,
+		Version:           assets.Revision,
+		Capacity:          b.Drive.Capacity(),
+		Locked:            !b.Drive.Ready(),
+		Configuration:     b.Keyring.Conf.Settings,
+		IdleLockRemaining: uint32(b.Drive.IdleLockRemaining().Seconds()),
+		LockTrigger:       b.Drive.LockTrigger,
+		UnlockFailures:    uint32(b.Keyring.Conf.UnlockFailures),
+		UnlockBackoff:     uint32(b.unlockRemaining().Seconds()),
+		Card:              b.cardInfo(),
+		Uptime:            uint64(time.Since(boot).Seconds()),
+		CheckpointSize:    checkpointSize(b.Keyring.Conf.ProofBundle),
+		SecureBoot:        secureBoot(),
+		LastUnlock:        b.lastUnlock,
 	}
 
+	stats := b.Drive.Stats()
+	s.BytesRead = stats.BytesRead
+	s.BytesWritten = stats.BytesWritten
+	s.ReadErrors = stats.ReadErrors
+	s.WriteErrors = stats.WriteErrors
+	s.CacheErrors = stats.CacheErrors
+
 	resMsg.Payload = s.Bytes()
 }
 
@@ -276,11 +431,55 @@ func (b *BLE) configuration(reqMsg *api.Message, resMsg *api.Message) {
 	settings := &api.Configuration{}
 	err := proto.Unmarshal(reqMsg.Payload, settings)
 
-	if err != nil || b.Drive.Ready {
+	if err != nil || b.Drive.Ready() {
 		resMsg.Error = api.ErrorCode_INVALID_MESSAGE
 		return
 	}
 
+	if err = b.validate(settings); err != nil {
+		log.Printf("invalid configuration, %v", err)
+		resMsg.Error = api.ErrorCode_INVALID_CONFIGURATION
+		return
+	}
+
+	res := &api.ConfigurationResult{
+		Configuration: settings,
+	}
+
+	res.Changed, res.Pending = changes(b.Keyring.Conf.Settings, settings)
+
 	b.Keyring.Conf.Settings = settings
 	b.Keyring.Save()
+
+	b.applySettings(settings, res.Changed)
+	b.Keyring.Audit(api.LogEvent_CONFIGURED, strings.Join(res.Changed, ","))
+
+	resMsg.Payload = res.Bytes()
+}
+
+func (b *BLE) benchmark(reqMsg *api.Message, resMsg *api.Message) {
+	bench := &api.Benchmark{}
+	err := proto.Unmarshal(reqMsg.Payload, bench)
+
+	if err != nil || b.Drive.Ready() {
+		resMsg.Error = api.ErrorCode_INVALID_MESSAGE
+		return
+	}
+
+	b.session.Lock()
+	defer b.session.Unlock()
+
+	results, err := b.Drive.Benchmark(bench.Ciphers)
+
+	if err != nil {
+		log.Printf("benchmark error, %v", err)
+		resMsg.Error = api.ErrorCode_GENERIC_ERROR
+		return
+	}
+
+	bench = &api.Benchmark{
+		Results: results,
+	}
+
+	resMsg.Payload = bench.Bytes()
 }
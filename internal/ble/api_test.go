@@ -0,0 +1,350 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ble
+
+import (
+	"bytes"
+	"crypto/x509"
+	"slices"
+	"testing"
+
+	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/internal/crypto"
+	"github.com/usbarmory/armory-drive/internal/edm"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// startTestSession returns an instance, paired with an MD which negotiated a
+// session with the given protocol version, 0 selecting a Noise handshake.
+func startTestSession(t *testing.T, version uint32) (b *BLE, md *testMD) {
+	b, m := startTestBLE(t)
+	key := testKey(t, 1)
+
+	pairTestBLE(t, b, key)
+	md = newTestMD(t, b, m, key)
+
+	var err error
+
+	if version == 0 {
+		err = md.noiseSession()
+	} else {
+		err = md.session(version)
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func TestPairing(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ik   bool
+	}{
+		{"PAIR", false},
+		{"NOISE_PAIR", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, m := startTestBLE(t)
+
+			_, data, err := b.PairingMode()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			code := &api.PairingQRCode{}
+
+			if err = proto.Unmarshal(data, code); err != nil {
+				t.Fatal(err)
+			}
+
+			if code.BLEName != b.Name() {
+				t.Errorf("pairing code name %q, expected %q", code.BLEName, b.Name())
+			}
+
+			key := testKey(t, 1)
+			md := newTestMD(t, b, m, key)
+
+			if err = md.pair(code.Nonce+1, tc.ik); err == nil {
+				t.Fatal("pairing with invalid nonce")
+			}
+
+			if err = md.pair(code.Nonce, tc.ik); err != nil {
+				t.Fatal(err)
+			}
+
+			der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(b.Keyring.Conf.MobileLongterm, der) {
+				t.Error("MD long-term key not saved")
+			}
+
+			// in-session operations are not available in pairing
+			// mode
+			msg := &api.Message{
+				Timestamp: md.timestamp(),
+				OpCode:    api.OpCode_STATUS,
+			}
+
+			md.noResponse(testEnvelope(t, key, msg))
+		})
+	}
+}
+
+func TestSession(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		version uint32
+	}{
+		{"SESSION_V1", crypto.SESSION_V1},
+		{"SESSION_V2", crypto.SESSION_V2},
+		{"NOISE_SESSION", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b, md := startTestSession(t, tc.version)
+
+			if !md.status().Locked {
+				t.Fatal("drive unlocked before UNLOCK")
+			}
+
+			kek := bytes.Repeat([]byte{0x4b}, 32)
+
+			if _, err := md.exchange(api.OpCode_UNLOCK, (&api.KeyExchange{Key: kek}).Bytes()); err != nil {
+				t.Fatal(err)
+			}
+
+			if md.status().Locked || !b.Drive.Ready() {
+				t.Fatal("drive locked after UNLOCK")
+			}
+
+			if _, err := md.exchange(api.OpCode_LOCK, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			if s := md.status(); !s.Locked || s.LockTrigger != api.LockTrigger_LOCK_REQUEST {
+				t.Fatalf("unexpected lock state (locked: %v, trigger: %v)", s.Locked, s.LockTrigger)
+			}
+
+			// the BLE link is authenticated by in-session messages
+			if !b.link.authenticated || b.link.channel != md.channel {
+				t.Error("MD link not authenticated")
+			}
+		})
+	}
+}
+
+// TestManagementInterface exercises a headless unlock, without BLE module,
+// over the USB management interface which is available while locked.
+func TestManagementInterface(t *testing.T) {
+	b := newTestBLE(t)
+	key := testKey(t, 1)
+
+	pairTestBLE(t, b, key)
+
+	b.Drive.Management = b.HandleEnvelope
+	md := newUSBTestMD(t, b, b.Drive.ConfigureUSB(), key)
+
+	if err := md.session(crypto.SESSION_V2); err != nil {
+		t.Fatal(err)
+	}
+
+	if !md.status().Locked || b.Drive.Ready() {
+		t.Fatal("drive unlocked before UNLOCK")
+	}
+
+	kek := bytes.Repeat([]byte{0x4b}, 32)
+
+	if _, err := md.exchange(api.OpCode_UNLOCK, (&api.KeyExchange{Key: kek}).Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if md.status().Locked || !b.Drive.Ready() {
+		t.Fatal("drive locked after UNLOCK")
+	}
+}
+
+func TestRekey(t *testing.T) {
+	_, md := startTestSession(t, crypto.SESSION_V2)
+
+	res, err := md.exchange(api.OpCode_REKEY, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kex := &api.KeyExchange{}
+
+	if err = proto.Unmarshal(res.Payload, kex); err != nil {
+		t.Fatal(err)
+	}
+
+	// a request with the current keys is still accepted
+	md.status()
+
+	res, err = md.exchange(api.OpCode_REKEY, nil)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = proto.Unmarshal(res.Payload, kex); err != nil {
+		t.Fatal(err)
+	}
+
+	prev := *md
+
+	if err = md.rekey(kex.Nonce); err != nil {
+		t.Fatal(err)
+	}
+
+	md.status()
+
+	// the previous keys are discarded once the next ones are used
+	prev.txSequence = md.txSequence
+
+	if _, res := prev.roundTrip(prev.envelope(&api.Message{Timestamp: md.timestamp(), OpCode: api.OpCode_STATUS})); res.Error != api.ErrorCode_INVALID_MESSAGE {
+		t.Fatalf("previous session keys not rejected (%v)", res.Error)
+	}
+
+	md.status()
+
+	_, md = startTestSession(t, crypto.SESSION_V1)
+
+	if _, err = md.exchange(api.OpCode_REKEY, nil); err == nil {
+		t.Fatal("v1 session re-keyed")
+	}
+}
+
+func TestNoSession(t *testing.T) {
+	b, m := startTestBLE(t)
+	key := testKey(t, 1)
+
+	pairTestBLE(t, b, key)
+	md := newTestMD(t, b, m, key)
+
+	msg := &api.Message{
+		Timestamp: md.timestamp(),
+		OpCode:    api.OpCode_STATUS,
+	}
+
+	if _, res := md.roundTrip(testEnvelope(t, key, msg)); res.Error != api.ErrorCode_INVALID_SESSION {
+		t.Fatalf("unexpected error %v", res.Error)
+	}
+}
+
+func TestInvalidSignature(t *testing.T) {
+	b, m := startTestBLE(t)
+
+	pairTestBLE(t, b, testKey(t, 1))
+
+	// unpaired MD
+	md := newTestMD(t, b, m, testKey(t, 2))
+
+	md.noResponse(md.envelope(&api.Message{
+		Timestamp: md.timestamp(),
+		OpCode:    api.OpCode_CAPABILITIES,
+	}))
+
+	// tampered message
+	md = newTestMD(t, b, m, testKey(t, 1))
+
+	if err := md.session(crypto.SESSION_V2); err != nil {
+		t.Fatal(err)
+	}
+
+	env := &api.Envelope{}
+
+	if err := proto.Unmarshal(md.envelope(&api.Message{Timestamp: md.timestamp(), OpCode: api.OpCode_STATUS}), env); err != nil {
+		t.Fatal(err)
+	}
+
+	env.Message = append(env.Message, 0x18, 0x01)
+
+	if _, res := md.roundTrip(env.Bytes()); res.Error != api.ErrorCode_INVALID_MESSAGE {
+		t.Fatalf("unexpected error %v", res.Error)
+	}
+
+	// the session remains usable
+	md.status()
+}
+
+func TestReplay(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		version uint32
+	}{
+		{"SESSION_V1", crypto.SESSION_V1},
+		{"SESSION_V2", crypto.SESSION_V2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, md := startTestSession(t, tc.version)
+
+			req := md.envelope(&api.Message{
+				Timestamp: md.timestamp(),
+				OpCode:    api.OpCode_STATUS,
+			})
+
+			if _, res := md.roundTrip(req); res.Error != api.ErrorCode_NO_ERROR {
+				t.Fatalf("unexpected error %v", res.Error)
+			}
+
+			if _, res := md.roundTrip(req); res.Error != api.ErrorCode_STALE_MESSAGE {
+				t.Fatalf("replay not detected (%v)", res.Error)
+			}
+
+			// the session remains usable
+			md.status()
+		})
+	}
+}
+
+func TestFragments(t *testing.T) {
+	b, m := startTestBLE(t)
+	key := testKey(t, 1)
+
+	pairTestBLE(t, b, key)
+	md := newTestMD(t, b, m, key)
+
+	// out of sequence fragment, without response
+	frg := &edm.Fragment{Total: 2, Seq: 2, Data: []byte{0x0a}}
+	m.Event(DATA_EVENT, append([]byte{md.channel}, frg.Bytes()...))
+
+	// partial message, dropped on disconnection
+	frg = &edm.Fragment{Total: 2, Seq: 1, Data: []byte{0x0a}}
+	m.Event(DATA_EVENT, append([]byte{md.channel}, frg.Bytes()...))
+	m.Disconnect(md.channel)
+
+	md = newTestMD(t, b, m, key)
+
+	// message spanning several fragments
+	payload := make([]byte, 4*edm.PROTOBUF_MAX_LENGTH)
+
+	res, err := md.exchange(api.OpCode_CAPABILITIES, payload)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caps := &api.Capabilities{}
+
+	if err = proto.Unmarshal(res.Payload, caps); err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Contains(caps.ProtocolVersions, crypto.SESSION_VERSION) {
+		t.Errorf("unexpected protocol versions %v", caps.ProtocolVersions)
+	}
+}
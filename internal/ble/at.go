@@ -0,0 +1,124 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ble
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/usbarmory/armory-drive/internal/edm"
+)
+
+func (b *BLE) handleATConfirmation(buf []byte) {
+	res := make([]byte, len(buf))
+	copy(res, buf)
+
+	select {
+	case b.atResponse <- res:
+	default:
+		// no pending request
+	}
+}
+
+// AT issues an AT command to the BLE module, encapsulated in an EDM AT
+// Request, returning the AT Confirmation content without its final result
+// code.
+//
+// As AT Confirmations are received by the same goroutine handling API
+// envelopes, AT must not be invoked within envelope handling.
+func (b *BLE) AT(cmd string) (res string, err error) {
+	b.at.Lock()
+	defer b.at.Unlock()
+
+	// discard any late confirmation of a timed out request
+	select {
+	case <-b.atResponse:
+	default:
+	}
+
+	buf := binary.BigEndian.AppendUint16(nil, AT_REQUEST)
+	buf = append(buf, cmd...)
+	buf = append(buf, '\r')
+
+	b.txPayload(buf)
+
+	var conf []byte
+
+	select {
+	case conf = <-b.atResponse:
+	case <-time.After(edm.AT_TIMEOUT):
+		return "", fmt.Errorf("%s, %w", cmd, edm.ErrTimeout)
+	}
+
+	info, err := edm.Result(conf)
+
+	if err != nil {
+		return "", fmt.Errorf("%s, %w", cmd, err)
+	}
+
+	return string(info), nil
+}
+
+// Name returns the BLE local name.
+func (b *BLE) Name() string {
+	return b.name
+}
+
+// SetName changes the BLE local name, the change is not persisted across
+// module restarts.
+func (b *BLE) SetName(name string) (err error) {
+	if !validName(name) {
+		return errors.New("invalid name")
+	}
+
+	if _, err = b.AT(fmt.Sprintf("AT+UBTLN=\"%s\"", name)); err != nil {
+		return
+	}
+
+	b.name = name
+
+	return
+}
+
+// SetDiscoverable enables or disables BLE advertising.
+func (b *BLE) SetDiscoverable(on bool) (err error) {
+	// 1: GAP non-discoverable mode, 3: GAP general discoverable mode
+	mode := 1
+
+	if on {
+		mode = 3
+	}
+
+	_, err = b.AT(fmt.Sprintf("AT+UBTDM=%d", mode))
+
+	return
+}
+
+// RSSI returns the received signal strength (dBm) of a BLE connection.
+func (b *BLE) RSSI(channel uint8) (rssi int, err error) {
+	c, ok := b.Connections()[channel]
+
+	if !ok {
+		return 0, fmt.Errorf("invalid channel %d", channel)
+	}
+
+	res, err := b.AT("AT+UBTRSS=" + c.AddressString())
+
+	if err != nil {
+		return
+	}
+
+	m := BLERSSIPattern.FindStringSubmatch(res)
+
+	if len(m) != 2 {
+		return 0, errors.New("invalid RSSI response")
+	}
+
+	return strconv.Atoi(m[1])
+}
@@ -0,0 +1,187 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ble
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/usbarmory/armory-drive/internal/edm"
+	"github.com/usbarmory/armory-drive/internal/emulator"
+)
+
+// eventually waits for a condition, evaluated on asynchronous processing.
+func eventually(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	for deadline := time.Now().Add(testTimeout); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met")
+		}
+	}
+}
+
+func TestInit(t *testing.T) {
+	b, m := startTestBLE(t)
+
+	if b.Name() != emulator.DefaultName {
+		t.Errorf("name %q, expected %q", b.Name(), emulator.DefaultName)
+	}
+
+	if !m.EDM() {
+		t.Error("Extended Data Mode not entered")
+	}
+
+	if cmds := m.Commands(); !slices.Equal(cmds, []string{"AT+UBTLN?", "ATO2"}) {
+		t.Errorf("unexpected commands %q", cmds)
+	}
+}
+
+func TestInitConfiguredName(t *testing.T) {
+	b := newTestBLE(t)
+	b.Keyring.Conf.Settings.BLEName = "armory"
+
+	m := emulator.NewANNA()
+	b.Transport = m
+	m.Start()
+
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(m.Close)
+
+	eventually(t, func() bool { return m.Name() == "armory" })
+}
+
+func TestInitError(t *testing.T) {
+	b := newTestBLE(t)
+	m := emulator.NewANNA()
+
+	m.Handler = func(cmd string) ([]byte, bool) {
+		if cmd == "AT+UBTLN?" {
+			return []byte("\r\nERROR\r\n"), true
+		}
+
+		return nil, false
+	}
+
+	b.Transport = m
+	m.Start()
+
+	if err := b.Init(); !errors.Is(err, edm.ErrAT) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestAT(t *testing.T) {
+	b, m := startTestBLE(t)
+
+	if err := b.SetName("armory"); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Name() != "armory" || m.Name() != "armory" {
+		t.Errorf("name %q (module %q), expected armory", b.Name(), m.Name())
+	}
+
+	if err := b.SetName("invalid\""); err == nil {
+		t.Error("invalid name accepted")
+	}
+
+	if err := b.SetDiscoverable(true); err != nil {
+		t.Fatal(err)
+	}
+
+	if cmds := m.Commands(); cmds[len(cmds)-1] != "AT+UBTDM=3" {
+		t.Errorf("unexpected command %q", cmds[len(cmds)-1])
+	}
+
+	if _, err := b.RSSI(1); err == nil {
+		t.Error("RSSI of invalid channel")
+	}
+
+	md := newTestMD(t, b, m, testKey(t, 1))
+	rssi, err := b.RSSI(md.channel)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rssi != -42 {
+		t.Errorf("RSSI %d, expected -42", rssi)
+	}
+}
+
+func TestATError(t *testing.T) {
+	b, m := startTestBLE(t)
+
+	m.Handler = func(cmd string) ([]byte, bool) {
+		if strings.HasPrefix(cmd, "AT+UBTDM=") {
+			return []byte("\r\nERROR\r\n"), true
+		}
+
+		return nil, false
+	}
+
+	if err := b.SetDiscoverable(false); !errors.Is(err, edm.ErrAT) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the module remains usable
+	if err := b.SetName("armory"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestATTimeout(t *testing.T) {
+	if testing.Short() {
+		t.Skip("AT timeout")
+	}
+
+	b, m := startTestBLE(t)
+
+	m.Handler = func(cmd string) ([]byte, bool) {
+		if strings.HasPrefix(cmd, "AT+UBTLN=") {
+			return nil, true
+		}
+
+		return nil, false
+	}
+
+	if err := b.SetName("armory"); !errors.Is(err, edm.ErrTimeout) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if b.Name() != emulator.DefaultName {
+		t.Errorf("name %q changed on timeout", b.Name())
+	}
+
+	m.Handler = nil
+
+	if err := b.SetDiscoverable(true); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	b, m := startTestBLE(t)
+	md := newTestMD(t, b, m, testKey(t, 1))
+
+	b.Keyring.Conf.Settings.BLEName = "armory"
+	m.Restart()
+
+	eventually(t, func() bool { return m.Name() == "armory" })
+
+	if _, ok := b.Connections()[md.channel]; ok {
+		t.Error("connection retained across module restart")
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ble
+
+import (
+	"log"
+
+	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/internal/crypto"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func (b *BLE) getLog(reqMsg *api.Message, resMsg *api.Message) {
+	req := &api.LogRequest{}
+
+	if err := proto.Unmarshal(reqMsg.Payload, req); err != nil {
+		resMsg.Error = api.ErrorCode_INVALID_MESSAGE
+		return
+	}
+
+	count := int(req.Count)
+
+	if count == 0 {
+		count = crypto.LOG_PAGE_MAX
+	}
+
+	res, err := b.Keyring.AuditLog(req.Index, count)
+
+	if err != nil {
+		log.Printf("could not read audit log, %v", err)
+		resMsg.Error = api.ErrorCode_GENERIC_ERROR
+		return
+	}
+
+	resMsg.Payload = res.Bytes()
+}
@@ -6,159 +6,133 @@
 package ble
 
 import (
-	"bytes"
-	"encoding/binary"
+	"fmt"
+	"log"
 	"regexp"
-	"runtime"
+	"sync"
 	"time"
 
 	"github.com/usbarmory/armory-drive/internal/crypto"
+	"github.com/usbarmory/armory-drive/internal/edm"
+	"github.com/usbarmory/armory-drive/internal/led"
 	"github.com/usbarmory/armory-drive/internal/ums"
-
-	usbarmory "github.com/usbarmory/tamago/board/usbarmory/mk2"
 )
 
 var BLEStartupPattern = regexp.MustCompile(`(\+STARTUP)`)
 var BLENamePattern = regexp.MustCompile(`\+UBTLN:"([^"]+)"`)
+var BLERSSIPattern = regexp.MustCompile(`\+UBTRSS:(-?\d+)`)
 
 type eventHandler func([]byte) []byte
 
+// STARTUP_TIMEOUT is the maximum time for BLE module startup.
+const STARTUP_TIMEOUT = 10 * time.Second
+
 type BLE struct {
 	Drive   *ums.Drive
 	Keyring *crypto.Keyring
 
+	// Transport is the BLE module interface, the USB armory Mk II
+	// module is initialized and used when not set.
+	Transport edm.Transport
+
 	name    string
 	session *Session
 
+	// BLE module default local name
+	defaultName string
+
 	pairingMode  bool
 	pairingNonce uint64
 
-	anna *usbarmory.ANNA
-	data []byte
-}
+	// earliest time for the next unlock attempt
+	unlockNotBefore time.Time
+	// last unlock time (ms), according to the session clock
+	lastUnlock int64
 
-func (b *BLE) txPacket(buf []byte) {
-	// detect USB armory Mk II β errata fix
-	if b.anna.UART.Flow {
-		b.anna.UART.Write(buf)
-		return
-	}
+	fragments *edm.Reassembler
+	link      link
 
-	for i := 0; i < len(buf); i++ {
-		for !b.anna.RTS() {
-		}
+	// serializes envelopes received over BLE and USB
+	mux sync.Mutex
+	// serializes packet transmission
+	tx sync.Mutex
 
-		b.anna.UART.Tx(buf[i])
-	}
+	// serializes AT requests over EDM
+	at sync.Mutex
+	// AT confirmation queue
+	atResponse chan []byte
 }
 
 func (b *BLE) rxPackets() {
-	var pkt []byte
-	var length uint16
-
-	next := true
+	dec := &edm.Decoder{}
+	buf := make([]byte, 1024)
 
 	for {
-		// detect USB armory Mk II β errata fix
-		if b.anna.UART.Flow {
-			buf := make([]byte, 1024)
-			n, _ := b.anna.UART.Read(buf)
-
-			if n != 0 {
-				pkt = append(pkt, buf[:n]...)
-			}
-		} else {
-			b.anna.CTS(true)
-			c, ok := b.anna.UART.Rx()
-			b.anna.CTS(false)
-
-			if ok {
-				pkt = append(pkt, c)
-			}
-		}
-
-		// look for the beginning of packet
-		if next {
-			i := bytes.IndexByte(pkt, EDM_START)
+		n, err := b.Transport.Read(buf)
 
-			if i < 0 {
-				pkt = []byte{}
-
-				runtime.Gosched()
-				continue
-			}
-
-			pkt = pkt[i:]
-			next = false
-			length = 0
+		if err != nil {
+			log.Printf("BLE receive error, %v", err)
+			return
 		}
 
-		if len(pkt) >= 3 && length == 0 {
-			length = binary.BigEndian.Uint16(pkt[1:3])
-
-			if length == 0 || length > PAYLOAD_MAX_LENGTH {
-				pkt = []byte{}
-				next = true
-			} else {
-				// from payload length to packet length
-				length += 4
-			}
-		} else if length != 0 && len(pkt) >= int(length) {
-			if pkt[length-1] == EDM_STOP {
-				b.handleEvent(pkt[3 : length-1])
-			}
-
-			pkt = pkt[length:]
-			next = true
+		dec.Write(buf[:n])
+
+		for payload, ok := dec.Next(); ok; payload, ok = dec.Next() {
+			b.handleEvent(payload)
 		}
 	}
 }
 
-func (b *BLE) rxATResponse(pattern *regexp.Regexp) (match [][]byte) {
-	var buf []byte
-
-	for len(match) == 0 {
-		b.anna.CTS(true)
+// init initializes the API state, independently from the BLE module.
+func (b *BLE) init() {
+	b.session = &Session{}
+	b.fragments = edm.NewReassembler()
+	b.link.connections = make(map[uint8]*Connection)
+	b.atResponse = make(chan []byte, 1)
 
-		c, ok := b.anna.UART.Rx()
+	// audit log entries follow the MD clock
+	b.Keyring.Clock = b.session.Time
 
-		if !ok {
-			continue
-		}
+	// failed unlock attempts are persistent, so is their backoff
+	b.unlockNotBefore = time.Now().Add(unlockBackoff(b.Keyring.Conf.UnlockFailures))
+}
 
-		b.anna.CTS(false)
+func (b *BLE) Init() (err error) {
+	b.init()
 
-		buf = append(buf, c)
-		match = pattern.FindSubmatch(buf)
+	if b.Transport == nil {
+		if b.Transport, err = newANNATransport(); err != nil {
+			return
+		}
 	}
 
-	return
-}
+	if _, err = edm.WaitFor(b.Transport, BLEStartupPattern, STARTUP_TIMEOUT); err != nil {
+		return fmt.Errorf("BLE module startup, %w", err)
+	}
 
-func (b *BLE) Init() (err error) {
-	b.anna = usbarmory.BLE
+	m, err := edm.Command(b.Transport, "AT+UBTLN?", BLENamePattern, edm.AT_TIMEOUT)
 
-	if err = b.anna.Init(); err != nil {
+	if err != nil {
 		return
 	}
 
-	time.Sleep(usbarmory.RESET_GRACE_TIME)
-	b.rxATResponse(BLEStartupPattern)
-
-	b.anna.UART.Write([]byte("AT+UBTLN?\r"))
-	m := b.rxATResponse(BLENamePattern)
-
 	b.name = string(m[1])
-	b.session = &Session{}
+	b.defaultName = b.name
 
-	// enter data mode
-	b.anna.UART.Write([]byte("ATO2\r"))
+	// enter Extended Data Mode
+	if _, err = b.Transport.Write([]byte("ATO2\r")); err != nil {
+		return
+	}
 
-	usbarmory.LED("blue", true)
+	led.Set("blue", true)
 
 	go func() {
 		b.rxPackets()
 	}()
 
+	if name := b.Keyring.Conf.Settings.GetBLEName(); len(name) > 0 {
+		b.applyName(name)
+	}
+
 	return
 }
@@ -0,0 +1,147 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ble
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/internal/crypto"
+	"github.com/usbarmory/armory-drive/internal/emulator"
+	"github.com/usbarmory/armory-drive/internal/pool"
+	"github.com/usbarmory/armory-drive/internal/ums"
+)
+
+const (
+	testBlockSize = 512
+	// internal card, covering the persistent configuration and audit log
+	testMMCBlocks = crypto.MMC_LOG_BLOCK + crypto.LOG_ENTRIES
+	// microSD card
+	testSDBlocks = 1 << 16
+	// DMA region, covering the buffer pool and write-back cache
+	testDMASize = 64 * 1024 * 1024
+)
+
+var (
+	testPoolOnce sync.Once
+	testPool     *pool.Pool
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestBLE returns an instance, without BLE module, backed by emulated
+// internal card, DCP and microSD card.
+func newTestBLE(t testing.TB) (b *BLE) {
+	crypto.SetPlatform(emulator.NewCard(testBlockSize, testMMCBlocks), emulator.NewDCP())
+
+	if err := emulator.InitDMA(testDMASize); err != nil {
+		t.Fatal(err)
+	}
+
+	// buffers are retained across instances, as never released
+	testPoolOnce.Do(func() {
+		testPool = pool.New(pool.DefaultClasses, 4096)
+	})
+
+	keyring := &crypto.Keyring{
+		Pool: testPool,
+	}
+
+	if err := keyring.Init(false); err != nil {
+		t.Fatal(err)
+	}
+
+	drive := &ums.Drive{
+		Cipher:  true,
+		Keyring: keyring,
+		Mult:    ums.BLOCK_SIZE_MULTIPLIER,
+		Pool:    testPool,
+	}
+
+	if err := drive.Init(emulator.NewCard(testBlockSize, testSDBlocks)); err != nil {
+		t.Fatal(err)
+	}
+
+	// pairing feedback
+	go func() {
+		for range drive.PairingComplete {
+		}
+	}()
+
+	b = &BLE{
+		Drive:   drive,
+		Keyring: keyring,
+	}
+
+	b.init()
+
+	return
+}
+
+// testKey returns a deterministic P-256 key, so that signed fuzzing corpus
+// entries remain valid across runs.
+func testKey(t testing.TB, seed byte) *ecdsa.PrivateKey {
+	key, err := ecdsa.ParseRawPrivateKey(elliptic.P256(), bytes.Repeat([]byte{seed}, 32))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// pairTestBLE pairs the instance with an MD long-term key.
+func pairTestBLE(t testing.TB, b *BLE, mobileLongterm *ecdsa.PrivateKey) {
+	der, err := x509.MarshalPKIXPublicKey(&mobileLongterm.PublicKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = b.paired(der); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testEnvelope returns a serialized envelope, its message is signed, with
+// digest, when a key is passed.
+func testEnvelope(t testing.TB, key *ecdsa.PrivateKey, msg *api.Message) []byte {
+	env := &api.Envelope{
+		Message: msg.Bytes(),
+	}
+
+	if key != nil {
+		sum := sha256.Sum256(env.Message)
+		r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		env.Signature = &api.Signature{
+			Data: sum[:],
+			R:    r.Bytes(),
+			S:    s.Bytes(),
+		}
+	}
+
+	return env.Bytes()
+}
@@ -0,0 +1,44 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ble
+
+import (
+	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/internal/crypto"
+	"github.com/usbarmory/armory-drive/internal/edm"
+	"github.com/usbarmory/armory-drive/internal/ums"
+)
+
+// supported operations, besides Noise handshakes
+var opCodes = []api.OpCode{
+	api.OpCode_PAIR,
+	api.OpCode_SESSION,
+	api.OpCode_UNLOCK,
+	api.OpCode_LOCK,
+	api.OpCode_STATUS,
+	api.OpCode_CONFIGURATION,
+	api.OpCode_BENCHMARK,
+	api.OpCode_CAPABILITIES,
+	api.OpCode_REKEY,
+	api.OpCode_GET_LOG,
+}
+
+func (b *BLE) capabilities(reqMsg *api.Message, resMsg *api.Message) {
+	caps := &api.Capabilities{
+		ProtocolVersions: []uint32{crypto.SESSION_V1, crypto.SESSION_V2},
+		Ciphers:          crypto.Ciphers,
+		OpCodes:          append([]api.OpCode{}, opCodes...),
+		MaxMessageSize:   min(edm.MESSAGE_MAX_LENGTH, ums.MANAGEMENT_FRAME_MAX),
+		HardwareRevision: b.hardwareRevision(),
+		SecureBoot:       secureBoot(),
+	}
+
+	if NOISE {
+		caps.OpCodes = append(caps.OpCodes, api.OpCode_NOISE_PAIR, api.OpCode_NOISE_SESSION)
+	}
+
+	resMsg.Payload = caps.Bytes()
+}
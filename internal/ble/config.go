@@ -0,0 +1,105 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ble
+
+import (
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+
+	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/internal/led"
+)
+
+// BLE_NAME_MAX represents the maximum BLE local name length.
+const BLE_NAME_MAX = 29
+
+// configuration fields which are applied at the next boot
+var bootFields = []string{
+	"USBVendor",
+	"USBProduct",
+}
+
+// validName returns whether a BLE local name can be set.
+func validName(name string) bool {
+	if len(name) == 0 || len(name) > BLE_NAME_MAX || strings.Contains(name, "\"") {
+		return false
+	}
+
+	for _, c := range []byte(name) {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validate checks configuration parameters, the BLE ones here and the
+// encrypted storage ones by the drive.
+func (b *BLE) validate(settings *api.Configuration) (err error) {
+	if name := settings.GetBLEName(); len(name) > 0 && !validName(name) {
+		return fmt.Errorf("invalid BLE name %q", name)
+	}
+
+	return b.Drive.Validate(settings)
+}
+
+// changes returns the names of fields which differ between two
+// configurations, as well as those among them which are applied at the next
+// boot.
+func changes(prev *api.Configuration, next *api.Configuration) (changed []string, pending []string) {
+	p := prev.ProtoReflect()
+	n := next.ProtoReflect()
+	fields := n.Descriptor().Fields()
+
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+
+		if p.Get(fd).Equal(n.Get(fd)) {
+			continue
+		}
+
+		name := string(fd.Name())
+		changed = append(changed, name)
+
+		if slices.Contains(bootFields, name) {
+			pending = append(pending, name)
+		}
+	}
+
+	return
+}
+
+// applySettings applies changed settings which are not otherwise evaluated on
+// use.
+func (b *BLE) applySettings(settings *api.Configuration, changed []string) {
+	if slices.Contains(changed, "LEDPolicy") {
+		led.SetPolicy(settings.GetLEDPolicy())
+	}
+
+	// AT commands cannot be issued within envelope handling
+	if slices.Contains(changed, "BLEName") {
+		go b.applyName(settings.GetBLEName())
+	}
+}
+
+// applyName sets the configured BLE local name, or restores the BLE module
+// default one.
+func (b *BLE) applyName(name string) {
+	if len(name) == 0 {
+		name = b.defaultName
+	}
+
+	if name == b.name {
+		return
+	}
+
+	if err := b.SetName(name); err != nil {
+		log.Printf("could not set BLE name, %v", err)
+	}
+}
@@ -7,23 +7,32 @@ package ble
 
 import (
 	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/internal/crypto"
 )
 
-func (b *BLE) verifyEnvelope(env *api.Envelope) (err error) {
-	return b.Keyring.VerifyECDSA(env.Message, env.Signature, b.session.Active)
+func (b *BLE) verifyEnvelope(env *api.Envelope, op api.OpCode) (err error) {
+	return b.Keyring.VerifyECDSA(env.Message, env.Signature, b.session.Active && !plaintext(op))
 }
 
-func (b *BLE) signEnvelope(env *api.Envelope) (err error) {
-	env.Signature, err = b.Keyring.SignECDSA(env.Message, b.session.Active)
+func (b *BLE) signEnvelope(env *api.Envelope, op api.OpCode) (err error) {
+	env.Signature, err = b.Keyring.SignECDSA(env.Message, b.session.Active && !plaintext(op))
 	return
 }
 
 func (b *BLE) encryptPayload(msg *api.Message) (err error) {
+	if b.Keyring.SessionVersion() >= crypto.SESSION_V2 {
+		return b.Keyring.Seal(msg)
+	}
+
 	msg.Payload, err = b.Keyring.EncryptOFB(msg.Payload)
 	return
 }
 
 func (b *BLE) decryptPayload(msg *api.Message) (err error) {
+	if b.Keyring.SessionVersion() >= crypto.SESSION_V2 {
+		return b.Keyring.Open(msg)
+	}
+
 	msg.Payload, err = b.Keyring.DecryptOFB(msg.Payload)
 	return
 }
@@ -8,53 +8,29 @@ package ble
 import (
 	"bytes"
 	"encoding/binary"
+	"log"
+
+	"github.com/usbarmory/armory-drive/internal/edm"
 )
 
 const (
-	// Packet                      (4 bytes + []byte) max: 251
-	//   Data Event | Data Command (3 bytes + []byte) max: 247
-	//      Fragment               (2 bytes + []byte) max: 244
-	//        protobuf                                max: 242
-
-	PAYLOAD_MAX_LENGTH  = 247
-	FRAGMENT_MAX_LENGTH = 244
-	PROTOBUF_MAX_LENGTH = 242
-
-	EDM_START = 0xAA
-	EDM_STOP  = 0x55
-
-	DATA_EVENT   = 0x31
-	DATA_COMMAND = 0x36
+	// u-connectXpress Extended Data Mode packet identifiers
+	CONNECT_EVENT                 = 0x11
+	DISCONNECT_EVENT              = 0x21
+	DATA_EVENT                    = 0x31
+	DATA_COMMAND                  = 0x36
+	AT_EVENT                      = 0x41
+	AT_REQUEST                    = 0x44
+	AT_CONFIRMATION               = 0x45
+	RESEND_CONNECT_EVENTS_COMMAND = 0x56
+	START_EVENT                   = 0x71
+
+	// Connect Event types
+	CONNECTION_BLUETOOTH = 0x01
+	CONNECTION_IPV4      = 0x02
+	CONNECTION_IPV6      = 0x03
 )
 
-type Packet struct {
-	Start   uint8
-	Length  uint16
-	Payload []byte
-	Stop    uint8
-}
-
-func (pkt *Packet) SetDefaults() {
-	pkt.Start = EDM_START
-	pkt.Stop = EDM_STOP
-}
-
-func (pkt *Packet) SetPayload(buf []byte) {
-	pkt.Length = uint16(len(buf))
-	pkt.Payload = buf
-}
-
-func (pkt *Packet) Bytes() []byte {
-	buf := new(bytes.Buffer)
-
-	binary.Write(buf, binary.BigEndian, pkt.Start)
-	binary.Write(buf, binary.BigEndian, pkt.Length)
-	buf.Write(pkt.Payload)
-	binary.Write(buf, binary.BigEndian, pkt.Stop)
-
-	return buf.Bytes()
-}
-
 type Data struct {
 	Kind      uint16
 	ChannelId uint8
@@ -75,105 +51,85 @@ func (cmd *Data) Bytes() []byte {
 	return buf.Bytes()
 }
 
-type Fragment struct {
-	Total uint8
-	Seq   uint8
-	Data  []byte
-}
-
-func (frg *Fragment) Parse(data []byte) {
-	frg.Total = uint8(data[0])
-	frg.Seq = uint8(data[1])
-	frg.Data = data[2:]
-}
-
-func (frg *Fragment) Bytes() []byte {
-	buf := new(bytes.Buffer)
-
-	buf.WriteByte(frg.Total)
-	buf.WriteByte(frg.Seq)
-	buf.Write(frg.Data)
-
-	return buf.Bytes()
-}
-
-func handleFragment(data []byte) (event []byte) {
-	fragment := &Fragment{}
-	fragment.Parse(data)
-
-	if fragment.Total == 1 {
-		return fragment.Data
-	}
-
-	if fragment.Seq > 1 && len(data) == 0 || fragment.Seq > fragment.Total {
-		data = nil
+func (b *BLE) handleEvent(buf []byte) {
+	if len(buf) < 2 {
 		return
 	}
 
-	if fragment.Seq == 1 {
-		data = make([]byte, fragment.Total*PROTOBUF_MAX_LENGTH)
+	kind := binary.BigEndian.Uint16(buf[0:2])
+	payload := buf[2:]
+
+	switch kind {
+	case CONNECT_EVENT:
+		b.connect(payload)
+	case DISCONNECT_EVENT:
+		if len(payload) >= 1 {
+			b.disconnect(payload[0])
+		}
+	case DATA_EVENT:
+		if len(payload) >= 1 {
+			b.handleData(payload[0], payload[1:])
+		}
+	case AT_CONFIRMATION:
+		b.handleATConfirmation(payload)
+	case AT_EVENT:
+		log.Printf("BLE module event: %s", bytes.TrimSpace(payload))
+	case START_EVENT:
+		b.restarted()
 	}
+}
 
-	data = append(data, fragment.Data...)
+// txPayload transmits an EDM packet with the given payload.
+func (b *BLE) txPayload(buf []byte) {
+	pkt := &edm.Packet{}
+	pkt.SetDefaults()
+	pkt.SetPayload(buf)
 
-	if fragment.Seq == fragment.Total {
-		event = data
-		data = nil
-	}
+	b.tx.Lock()
+	defer b.tx.Unlock()
 
-	return
+	if _, err := b.Transport.Write(pkt.Bytes()); err != nil {
+		log.Printf("BLE transmit error, %v", err)
+	}
 }
 
-func (b *BLE) handleEvent(buf []byte) {
-	var fragments [][]byte
+func (b *BLE) handleData(channel uint8, data []byte) {
+	frg := &edm.Fragment{}
 
-	if len(buf) < 3+2 {
+	if err := frg.Parse(data); err != nil {
+		log.Printf("BLE channel %d, %v", channel, err)
 		return
 	}
 
-	// decode Data Event
-	kind := binary.BigEndian.Uint16(buf[0:2])
-	channel := buf[2]
-	data := buf[3:]
+	event, err := b.fragments.Add(channel, frg)
 
-	if kind != DATA_EVENT {
+	if err != nil {
+		log.Printf("BLE channel %d, %v", channel, err)
 		return
 	}
 
-	event := handleFragment(data)
-
 	if len(event) == 0 {
 		return
 	}
 
-	res := b.handleEnvelope(event)
+	res := b.handleEnvelope(event, func() {
+		b.authenticate(channel)
+	})
 
-	for i := 0; i < len(res); i += PROTOBUF_MAX_LENGTH {
-		if i+PROTOBUF_MAX_LENGTH > len(res) {
-			fragments = append(fragments, res[i:])
-		} else {
-			fragments = append(fragments, res[i:PROTOBUF_MAX_LENGTH])
-		}
-	}
+	fragments, err := edm.Split(res)
 
-	for i := range fragments {
-		fragment := &Fragment{
-			Total: uint8(len(fragments)),
-			Seq:   uint8(i + 1),
-			Data:  fragments[i],
-		}
+	if err != nil {
+		log.Printf("BLE channel %d, %v", channel, err)
+		return
+	}
 
+	for _, frg := range fragments {
 		// prepare Data Command
 		payload := &Data{}
 		payload.SetDefaults()
 		payload.ChannelId = channel
-		payload.Data = fragment.Bytes()
-
-		// prepare response Packet
-		pkt := &Packet{}
-		pkt.SetDefaults()
-		pkt.SetPayload(payload.Bytes())
+		payload.Data = frg.Bytes()
 
-		b.txPacket(pkt.Bytes())
+		b.txPayload(payload.Bytes())
 	}
 }
@@ -0,0 +1,158 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ble
+
+import (
+	"encoding/binary"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/internal/crypto"
+)
+
+var errNoSession = errors.New("no active session")
+
+func (b *BLE) sessionLifetime() time.Duration {
+	return time.Duration(b.Keyring.Conf.Settings.GetSessionLifetime()) * time.Second
+}
+
+func (b *BLE) sessionIdleTimeout() time.Duration {
+	return time.Duration(b.Keyring.Conf.Settings.GetSessionIdleTimeout()) * time.Second
+}
+
+// sessionExpiry returns the reason for which the active session has expired,
+// if any.
+func (b *BLE) sessionExpiry(now time.Time) api.SessionExpiry {
+	lifetime := b.sessionLifetime()
+	idle := b.sessionIdleTimeout()
+	limit := b.Keyring.Conf.Settings.GetSessionMessageLimit()
+
+	switch {
+	case lifetime > 0 && now.Sub(b.session.Start) >= lifetime:
+		return api.SessionExpiry_LIFETIME
+	case idle > 0 && now.Sub(b.session.Used) >= idle:
+		return api.SessionExpiry_IDLE_TIMEOUT
+	case limit > 0 && b.session.Messages >= limit:
+		return api.SessionExpiry_MESSAGE_LIMIT
+	}
+
+	return api.SessionExpiry_NO_EXPIRY
+}
+
+// startSession marks a newly negotiated session as active and arms its
+// expiry timer.
+func (b *BLE) startSession() {
+	now := time.Now()
+
+	b.session.Active = true
+	b.session.Start = now
+	b.session.Used = now
+	b.session.Expiry = api.SessionExpiry_NO_EXPIRY
+
+	b.armSessionExpiry()
+}
+
+// useSession accounts an in-session request, expiring the session if any of
+// its limits has been reached.
+func (b *BLE) useSession() (expiry api.SessionExpiry) {
+	now := time.Now()
+
+	if expiry = b.sessionExpiry(now); expiry != api.SessionExpiry_NO_EXPIRY {
+		b.expireSession(expiry)
+		return
+	}
+
+	b.session.Messages += 1
+	b.session.Used = now
+	b.armSessionExpiry()
+
+	return
+}
+
+// armSessionExpiry schedules the expiry of the active session at the
+// earliest of its lifetime and idle timeout deadlines.
+func (b *BLE) armSessionExpiry() {
+	var deadline time.Time
+
+	if b.session.timer != nil {
+		b.session.timer.Stop()
+		b.session.timer = nil
+	}
+
+	if lifetime := b.sessionLifetime(); lifetime > 0 {
+		deadline = b.session.Start.Add(lifetime)
+	}
+
+	if idle := b.sessionIdleTimeout(); idle > 0 {
+		if d := b.session.Used.Add(idle); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+
+	if deadline.IsZero() {
+		return
+	}
+
+	b.session.timer = time.AfterFunc(time.Until(deadline), b.sessionTimeout)
+}
+
+func (b *BLE) sessionTimeout() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if !b.session.Active {
+		return
+	}
+
+	if expiry := b.sessionExpiry(time.Now()); expiry != api.SessionExpiry_NO_EXPIRY {
+		b.expireSession(expiry)
+		return
+	}
+
+	b.armSessionExpiry()
+}
+
+// expireSession zeroizes the active session keys.
+func (b *BLE) expireSession(expiry api.SessionExpiry) {
+	log.Printf("session expired (%v)", expiry)
+
+	b.Keyring.ClearSessionKeys()
+	b.session.Reset()
+	b.session.Expiry = expiry
+}
+
+func (b *BLE) invalidSession(resMsg *api.Message) {
+	s := &api.InvalidSession{
+		Expiry: b.session.Expiry,
+	}
+
+	resMsg.Error = api.ErrorCode_INVALID_SESSION
+	resMsg.Payload = s.Bytes()
+}
+
+func (b *BLE) rekey(reqMsg *api.Message, resMsg *api.Message) {
+	// v1 session payloads are not authenticated, preventing detection of
+	// the key generation used by the MD after a lost response.
+	if b.Keyring.SessionVersion() < crypto.SESSION_V2 {
+		resMsg.Error = api.ErrorCode_INVALID_MESSAGE
+		return
+	}
+
+	nonce := crypto.Rand(8)
+
+	keyExchange := &api.KeyExchange{
+		Nonce: binary.BigEndian.Uint64(nonce),
+	}
+
+	// next keys are derived once the response is encrypted, the current
+	// ones are retained until the MD uses either generation
+	b.session.rekey = nonce
+	b.session.Messages = 0
+
+	resMsg.Payload = keyExchange.Bytes()
+}
@@ -0,0 +1,200 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ble
+
+import (
+	"crypto/ecdh"
+	"crypto/x509"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/internal/crypto"
+	"github.com/usbarmory/armory-drive/internal/edm"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// fuzzing MD long-term key seed
+	fuzzKeySeed = 0x4d
+	// fuzzing pairing nonce
+	fuzzPairingNonce = 0x0123456789abcdef
+)
+
+// discard implements edm.Transport, discarding transmitted data.
+type discard struct{}
+
+func (discard) Read(buf []byte) (int, error) {
+	return 0, edm.ErrTimeout
+}
+
+func (discard) Write(buf []byte) (int, error) {
+	return len(buf), nil
+}
+
+func (discard) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+// newFuzzBLE returns an instance paired with the fuzzing MD long-term key.
+func newFuzzBLE(f *testing.F) (b *BLE) {
+	b = newTestBLE(f)
+	b.Transport = discard{}
+	b.pairingNonce = fuzzPairingNonce
+
+	pairTestBLE(f, b, testKey(f, fuzzKeySeed))
+
+	return
+}
+
+func FuzzHandleEnvelope(f *testing.F) {
+	b := newFuzzBLE(f)
+	key := testKey(f, fuzzKeySeed)
+
+	ephemeral, err := x509.MarshalPKIXPublicKey(&testKey(f, fuzzKeySeed+1).PublicKey)
+
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	noiseEphemeral, err := ecdh.P256().NewPrivateKey(testKey(f, fuzzKeySeed+2).D.FillBytes(make([]byte, 32)))
+
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	for _, msg := range []*api.Message{
+		{OpCode: api.OpCode_CAPABILITIES},
+		{OpCode: api.OpCode_STATUS},
+		{OpCode: api.OpCode_SESSION, Payload: (&api.KeyExchange{Key: ephemeral}).Bytes()},
+		{OpCode: api.OpCode_SESSION, Payload: (&api.KeyExchange{Key: ephemeral, Version: 2}).Bytes()},
+		{OpCode: api.OpCode_PAIR, Payload: (&api.KeyExchange{Key: ephemeral, Nonce: fuzzPairingNonce}).Bytes()},
+	} {
+		f.Add(false, testEnvelope(f, key, msg))
+		f.Add(true, testEnvelope(f, key, msg))
+	}
+
+	for _, op := range []api.OpCode{api.OpCode_NOISE_SESSION, api.OpCode_NOISE_PAIR} {
+		msg := &api.Message{
+			OpCode:  op,
+			Payload: noiseEphemeral.PublicKey().Bytes(),
+		}
+
+		f.Add(op == api.OpCode_NOISE_PAIR, testEnvelope(f, nil, msg))
+	}
+
+	f.Fuzz(func(t *testing.T, pairing bool, req []byte) {
+		b.pairingMode = pairing
+
+		res := b.handleEnvelope(req, nil)
+
+		if _, _, err := api.ParseEnvelope(res); err != nil {
+			t.Fatalf("invalid response, %v", err)
+		}
+	})
+}
+
+// dataEvent returns an EDM Data Event payload.
+func dataEvent(channel uint8, frg *edm.Fragment) []byte {
+	buf := binary.BigEndian.AppendUint16(nil, DATA_EVENT)
+	buf = append(buf, channel)
+
+	return append(buf, frg.Bytes()...)
+}
+
+func FuzzHandleEvent(f *testing.F) {
+	b := newFuzzBLE(f)
+	key := testKey(f, fuzzKeySeed)
+
+	connect := binary.BigEndian.AppendUint16(nil, CONNECT_EVENT)
+	connect = append(connect, 1, CONNECTION_BLUETOOTH, 0, 1, 2, 3, 4, 5, 6, 0, 0xf4)
+
+	f.Add(connect)
+	f.Add(binary.BigEndian.AppendUint16(nil, DISCONNECT_EVENT))
+	f.Add(append(binary.BigEndian.AppendUint16(nil, DISCONNECT_EVENT), 1))
+	f.Add(append(binary.BigEndian.AppendUint16(nil, AT_CONFIRMATION), "\r\n+UBTLN:\"UA\"\r\nOK\r\n"...))
+	f.Add(append(binary.BigEndian.AppendUint16(nil, AT_EVENT), "\r\n+UUBTACLC:0,0,000000000000p\r\n"...))
+	f.Add(binary.BigEndian.AppendUint16(nil, START_EVENT))
+
+	env := testEnvelope(f, key, &api.Message{OpCode: api.OpCode_CAPABILITIES})
+	fragments, err := edm.Split(env)
+
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	for _, frg := range fragments {
+		f.Add(dataEvent(1, frg))
+	}
+
+	f.Add(dataEvent(1, &edm.Fragment{Total: 2, Seq: 2, Data: env}))
+	f.Add(dataEvent(1, &edm.Fragment{Total: 0, Seq: 0}))
+
+	f.Fuzz(func(t *testing.T, event []byte) {
+		b.handleEvent(event)
+	})
+}
+
+func FuzzSession(f *testing.F) {
+	b, m := startTestBLE(f)
+	key := testKey(f, fuzzKeySeed)
+
+	pairTestBLE(f, b, key)
+	md := newTestMD(f, b, m, key)
+
+	if err := md.session(crypto.SESSION_V2); err != nil {
+		f.Fatal(err)
+	}
+
+	f.Add(uint32(api.OpCode_STATUS), []byte{})
+	f.Add(uint32(api.OpCode_LOCK), []byte{})
+	f.Add(uint32(api.OpCode_REKEY), []byte{})
+	for _, req := range []struct {
+		op  api.OpCode
+		msg proto.Message
+	}{
+		{api.OpCode_GET_LOG, &api.LogRequest{Index: 1}},
+		{api.OpCode_CONFIGURATION, &api.Configuration{BLEName: "armory", SessionMessageLimit: 16}},
+	} {
+		buf, err := proto.Marshal(req.msg)
+
+		if err != nil {
+			f.Fatal(err)
+		}
+
+		f.Add(uint32(req.op), buf)
+	}
+
+	f.Add(uint32(api.OpCode_LIST), []byte{0xff})
+
+	f.Fuzz(func(t *testing.T, op uint32, payload []byte) {
+		switch api.OpCode(op) {
+		case api.OpCode_UNLOCK, api.OpCode_BENCHMARK:
+			// rate limited or time consuming
+			return
+		case api.OpCode_PAIR, api.OpCode_SESSION, api.OpCode_NOISE_PAIR, api.OpCode_NOISE_SESSION:
+			// affecting the MD session state
+			return
+		}
+
+		md.t = t
+
+		// every in-session request must be answered
+		res, err := md.exchange(api.OpCode(op), payload)
+
+		if res.GetError() == api.ErrorCode_INVALID_SESSION {
+			err = md.session(crypto.SESSION_V2)
+		}
+
+		if err != nil {
+			t.Logf("%v, %v", api.OpCode(op), err)
+		}
+	})
+}
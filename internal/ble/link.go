@@ -0,0 +1,152 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ble
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/usbarmory/armory-drive/api"
+)
+
+// Connection represents an EDM channel, as reported by its Connect Event.
+type Connection struct {
+	// EDM channel
+	Channel uint8
+	// Connection type
+	Type uint8
+	// Bluetooth profile
+	Profile uint8
+	// Bluetooth device address
+	Address [6]byte
+	// Maximum frame size
+	FrameSize uint16
+}
+
+// AddressString returns the Bluetooth device address in AT command format.
+func (c *Connection) AddressString() string {
+	return fmt.Sprintf("%X", c.Address[:])
+}
+
+// link represents the BLE link state.
+type link struct {
+	// connected channels
+	connections map[uint8]*Connection
+
+	// channel of the link authenticated by the MD
+	channel uint8
+	// authenticated signals whether the MD link is up
+	authenticated bool
+
+	// proximity lock timer, armed while the MD link is down
+	timer *time.Timer
+}
+
+func (b *BLE) proximityLockTimeout() time.Duration {
+	return time.Duration(b.Keyring.Conf.Settings.GetProximityLockTimeout()) * time.Second
+}
+
+// connect handles EDM connect events.
+func (b *BLE) connect(buf []byte) {
+	if len(buf) < 2 {
+		return
+	}
+
+	c := &Connection{
+		Channel: buf[0],
+		Type:    buf[1],
+	}
+
+	// Bluetooth connection: profile, address and frame size
+	if c.Type == CONNECTION_BLUETOOTH && len(buf) >= 2+1+6+2 {
+		c.Profile = buf[2]
+		copy(c.Address[:], buf[3:9])
+		c.FrameSize = binary.BigEndian.Uint16(buf[9:11])
+	}
+
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.link.connections[c.Channel] = c
+}
+
+// disconnect handles EDM disconnect events, arming the proximity lock timer
+// when the MD link is dropped.
+func (b *BLE) disconnect(channel uint8) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	delete(b.link.connections, channel)
+	b.fragments.Drop(channel)
+
+	if !b.link.authenticated || b.link.channel != channel {
+		return
+	}
+
+	b.link.authenticated = false
+
+	if timeout := b.proximityLockTimeout(); timeout > 0 && b.Drive.Ready() {
+		log.Printf("MD link dropped, locking in %v", timeout)
+		b.link.timer = time.AfterFunc(timeout, b.proximityLock)
+	}
+}
+
+// authenticate records the channel of a BLE link over which a valid message
+// has been received in session, disarming the proximity lock timer.
+func (b *BLE) authenticate(channel uint8) {
+	b.link.channel = channel
+	b.link.authenticated = true
+
+	if b.link.timer != nil {
+		b.link.timer.Stop()
+		b.link.timer = nil
+	}
+}
+
+// restarted handles EDM start events, all connections are dropped as the
+// module has been restarted.
+func (b *BLE) restarted() {
+	log.Printf("BLE module restarted")
+
+	for channel := range b.Connections() {
+		b.disconnect(channel)
+	}
+
+	// the local name is not persisted across module restarts
+	b.name = b.defaultName
+
+	if name := b.Keyring.Conf.Settings.GetBLEName(); len(name) > 0 {
+		go b.applyName(name)
+	}
+}
+
+// Connections returns the active EDM connections.
+func (b *BLE) Connections() (connections map[uint8]*Connection) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	connections = make(map[uint8]*Connection)
+
+	for channel, c := range b.link.connections {
+		connections[channel] = c
+	}
+
+	return
+}
+
+func (b *BLE) proximityLock() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if b.link.authenticated || b.link.timer == nil {
+		return
+	}
+
+	b.link.timer = nil
+	b.Drive.AutoLock(api.LockTrigger_PROXIMITY)
+}
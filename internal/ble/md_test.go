@@ -0,0 +1,703 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ble
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/internal/crypto"
+	"github.com/usbarmory/armory-drive/internal/emulator"
+	"github.com/usbarmory/armory-drive/internal/noise"
+	"github.com/usbarmory/armory-drive/internal/ums"
+
+	"github.com/usbarmory/tamago/soc/nxp/usb"
+
+	"golang.org/x/crypto/hkdf"
+	"google.golang.org/protobuf/proto"
+)
+
+// response timeout, accounting for the unlock rate limit
+const testTimeout = 5 * time.Second
+
+// startTestBLE returns an instance initialized with an emulated BLE module.
+func startTestBLE(t testing.TB) (b *BLE, m *emulator.ANNA) {
+	b = newTestBLE(t)
+	m = emulator.NewANNA()
+
+	b.Transport = m
+	m.Start()
+
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(m.Close)
+
+	return
+}
+
+// testMD implements the mobile device (MD) side of the API, over a BLE
+// connection of an emulated module.
+type testMD struct {
+	t       testing.TB
+	module  *emulator.ANNA
+	channel uint8
+
+	// transport, when set, replaces the BLE connection (e.g. with the
+	// USB management interface)
+	transport func(req []byte) (res []byte)
+
+	mobileLongterm *ecdsa.PrivateKey
+	armoryLongterm *ecdsa.PublicKey
+
+	mobileEphemeral *ecdsa.PrivateKey
+	armoryEphemeral *ecdsa.PublicKey
+
+	// v1 session key
+	sessionKey []byte
+	// v2 session keys and ciphers, MD to UA (tx, sealer) and UA to MD
+	// (rx, opener)
+	txKey      []byte
+	rxKey      []byte
+	sealer     cipher.AEAD
+	opener     cipher.AEAD
+	txSequence uint64
+	rxSequence uint64
+
+	// last request timestamp
+	last int64
+}
+
+// newTestMD returns an MD, connected on a new channel, with the given
+// long-term key and trusting the UA long-term one.
+func newTestMD(t testing.TB, b *BLE, m *emulator.ANNA, key *ecdsa.PrivateKey) (md *testMD) {
+	md = &testMD{
+		t:              t,
+		module:         m,
+		channel:        uint8(len(b.Connections()) + 1),
+		mobileLongterm: key,
+		armoryLongterm: testArmoryLongterm(t, b),
+	}
+
+	m.Connect(md.channel, [6]byte{0xd0, 0, 0, 0, 0, md.channel})
+
+	// wait for the connection to be processed
+	for b.Connections()[md.channel] == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	return
+}
+
+// newUSBTestMD returns an MD, with the given long-term key and trusting the UA
+// long-term one, which exchanges envelopes over the USB management interface
+// of the given device.
+func newUSBTestMD(t testing.TB, b *BLE, device *usb.Device, key *ecdsa.PrivateKey) (md *testMD) {
+	var in, out usb.EndpointFunction
+
+	for _, iface := range device.Configurations[0].Interfaces {
+		if iface.InterfaceClass != ums.VENDOR_SPECIFIC_CLASS {
+			continue
+		}
+
+		for _, ep := range iface.Endpoints {
+			if ep.EndpointAddress&0x80 != 0 {
+				in = ep.Function
+			} else {
+				out = ep.Function
+			}
+		}
+	}
+
+	if in == nil || out == nil {
+		t.Fatal("management interface not found")
+	}
+
+	transport := func(req []byte) (res []byte) {
+		frame := binary.BigEndian.AppendUint16(nil, uint16(len(req)))
+
+		if _, err := out(append(frame, req...), nil); err != nil {
+			t.Fatal(err)
+		}
+
+		frame, err := in(nil, nil)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(frame) < 2 || int(binary.BigEndian.Uint16(frame)) != len(frame)-2 {
+			t.Fatalf("invalid management frame %x", frame)
+		}
+
+		return frame[2:]
+	}
+
+	return &testMD{
+		t:              t,
+		transport:      transport,
+		mobileLongterm: key,
+		armoryLongterm: testArmoryLongterm(t, b),
+	}
+}
+
+// testArmoryLongterm returns the UA long-term public key.
+func testArmoryLongterm(t testing.TB, b *BLE) *ecdsa.PublicKey {
+	der, err := b.Keyring.Export(crypto.UA_LONGTERM_KEY, false)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pk, err := x509.ParsePKIXPublicKey(der)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return pk.(*ecdsa.PublicKey)
+}
+
+func (md *testMD) timestamp() int64 {
+	md.last = max(time.Now().UnixMilli(), md.last+1)
+	return md.last
+}
+
+func (md *testMD) v2() bool {
+	return md.sealer != nil
+}
+
+// roundTrip sends a serialized envelope and returns the response one.
+func (md *testMD) roundTrip(req []byte) (env *api.Envelope, msg *api.Message) {
+	var data []byte
+
+	if md.transport != nil {
+		data = md.transport(req)
+	} else {
+		if err := md.module.Send(md.channel, req); err != nil {
+			md.t.Fatal(err)
+		}
+
+		res, err := md.module.Receive(testTimeout)
+
+		if err != nil {
+			md.t.Fatal(err)
+		}
+
+		if res.Channel != md.channel {
+			md.t.Fatalf("response on channel %d, expected %d", res.Channel, md.channel)
+		}
+
+		data = res.Data
+	}
+
+	env, msg, err := api.ParseEnvelope(data)
+
+	if err != nil {
+		md.t.Fatal(err)
+	}
+
+	if !msg.Response {
+		md.t.Fatal("invalid response")
+	}
+
+	return
+}
+
+// noResponse sends a serialized envelope which must not be answered, as
+// errors cannot be reported without an active session.
+func (md *testMD) noResponse(req []byte) {
+	if err := md.module.Send(md.channel, req); err != nil {
+		md.t.Fatal(err)
+	}
+
+	if res, err := md.module.Receive(100 * time.Millisecond); err == nil {
+		md.t.Fatalf("unexpected response %x", res.Data)
+	}
+}
+
+// envelope returns a serialized request, its payload is encrypted unless
+// plaintext or handshake.
+func (md *testMD) envelope(msg *api.Message) []byte {
+	op := msg.OpCode
+	encrypted := !plaintext(op) && !handshake(op)
+
+	switch {
+	case encrypted && md.v2():
+		md.txSequence += 1
+		msg.Sequence = md.txSequence
+		msg.Payload = md.sealer.Seal(nil, testNonce(msg.Sequence), msg.Payload, testAdditionalData(msg))
+	case encrypted:
+		msg.Payload = md.encryptOFB(msg.Payload)
+	}
+
+	if handshake(op) {
+		return testEnvelope(md.t, nil, msg)
+	}
+
+	key := md.mobileLongterm
+
+	if encrypted {
+		key = md.mobileEphemeral
+	}
+
+	env := &api.Envelope{
+		Message: msg.Bytes(),
+	}
+
+	sum := sha256.Sum256(env.Message)
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+
+	if err != nil {
+		md.t.Fatal(err)
+	}
+
+	env.Signature = &api.Signature{
+		R: r.Bytes(),
+		S: s.Bytes(),
+	}
+
+	// v2 sessions omit the redundant digest
+	if !encrypted || !md.v2() {
+		env.Signature.Data = sum[:]
+	}
+
+	return env.Bytes()
+}
+
+// exchange sends a request and returns its authenticated response, with
+// decrypted payload, or an error if the response reports one.
+func (md *testMD) exchange(op api.OpCode, payload []byte) (res *api.Message, err error) {
+	reqMsg := &api.Message{
+		Timestamp: md.timestamp(),
+		OpCode:    op,
+		Payload:   payload,
+	}
+
+	return md.send(reqMsg)
+}
+
+// send sends a request message and returns its authenticated response.
+func (md *testMD) send(reqMsg *api.Message) (res *api.Message, err error) {
+	op := reqMsg.OpCode
+	encrypted := !plaintext(op) && !handshake(op)
+
+	env, res := md.roundTrip(md.envelope(reqMsg))
+
+	if !handshake(op) {
+		key := md.armoryLongterm
+
+		if encrypted {
+			key = md.armoryEphemeral
+		}
+
+		// errors invalidating the session are signed with the
+		// long-term key
+		if err = testVerify(key, env); err != nil && encrypted {
+			err = testVerify(md.armoryLongterm, env)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+
+	if res.Error != api.ErrorCode_NO_ERROR {
+		return res, fmt.Errorf("request failed, %v", res.Error)
+	}
+
+	if res.OpCode != op {
+		return res, fmt.Errorf("invalid response opcode %v", res.OpCode)
+	}
+
+	switch {
+	case encrypted && md.v2():
+		if res.Sequence <= md.rxSequence {
+			return res, errors.New("stale response")
+		}
+
+		if res.Payload, err = md.opener.Open(nil, testNonce(res.Sequence), res.Payload, testAdditionalData(res)); err != nil {
+			return
+		}
+
+		md.rxSequence = res.Sequence
+	case encrypted:
+		res.Payload, err = md.decryptOFB(res.Payload)
+	}
+
+	return
+}
+
+// pair performs a pairing, with a Noise IK handshake when requested.
+func (md *testMD) pair(nonce uint64, ik bool) (err error) {
+	if !ik {
+		der, err := x509.MarshalPKIXPublicKey(&md.mobileLongterm.PublicKey)
+
+		if err != nil {
+			return err
+		}
+
+		_, err = md.exchange(api.OpCode_PAIR, (&api.KeyExchange{Key: der, Nonce: nonce}).Bytes())
+
+		return err
+	}
+
+	s, err := md.mobileLongterm.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	rs, err := md.armoryLongterm.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	hs, err := noise.NewHandshake(&noise.Config{
+		Pattern:    noise.IK,
+		Initiator:  true,
+		Prologue:   binary.BigEndian.AppendUint64([]byte(noise.PAIRING_PROLOGUE), nonce),
+		Static:     s,
+		PeerStatic: rs,
+	})
+
+	if err != nil {
+		return
+	}
+
+	req, err := hs.WriteMessage(nil)
+
+	if err != nil {
+		return
+	}
+
+	res, err := md.exchange(api.OpCode_NOISE_PAIR, req)
+
+	if err != nil {
+		return
+	}
+
+	_, err = hs.ReadMessage(res.Payload)
+
+	return
+}
+
+// session negotiates a session with the given protocol version.
+func (md *testMD) session(version uint32) (err error) {
+	md.sessionKey = nil
+	md.sealer = nil
+	md.opener = nil
+
+	if md.mobileEphemeral, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return
+	}
+
+	mobileEphemeral, err := x509.MarshalPKIXPublicKey(&md.mobileEphemeral.PublicKey)
+
+	if err != nil {
+		return
+	}
+
+	res, err := md.exchange(api.OpCode_SESSION, (&api.KeyExchange{Key: mobileEphemeral, Version: version}).Bytes())
+
+	if err != nil {
+		return
+	}
+
+	kex := &api.KeyExchange{}
+
+	if err = proto.Unmarshal(res.Payload, kex); err != nil {
+		return
+	}
+
+	pk, err := x509.ParsePKIXPublicKey(kex.Key)
+
+	if err != nil {
+		return
+	}
+
+	md.armoryEphemeral = pk.(*ecdsa.PublicKey)
+
+	priv, err := md.mobileEphemeral.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	peer, err := md.armoryEphemeral.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	preMaster, err := priv.ECDH(peer)
+
+	if err != nil {
+		return
+	}
+
+	nonce := binary.BigEndian.AppendUint64(nil, kex.Nonce)
+
+	if kex.Version < crypto.SESSION_V2 {
+		md.sessionKey = make([]byte, 32)
+		_, err = io.ReadFull(hkdf.New(sha256.New, preMaster, nonce, nil), md.sessionKey)
+		return
+	}
+
+	mobileLongterm, err := x509.MarshalPKIXPublicKey(&md.mobileLongterm.PublicKey)
+
+	if err != nil {
+		return
+	}
+
+	armoryLongterm, err := x509.MarshalPKIXPublicKey(md.armoryLongterm)
+
+	if err != nil {
+		return
+	}
+
+	h := sha256.New()
+	h.Write(mobileEphemeral)
+	h.Write(kex.Key)
+	h.Write(mobileLongterm)
+	h.Write(armoryLongterm)
+	h.Write(nonce)
+
+	keys := make([]byte, 64)
+
+	if _, err = io.ReadFull(hkdf.New(sha256.New, preMaster, nonce, append([]byte(crypto.SESSION_V2_INFO), h.Sum(nil)...)), keys); err != nil {
+		return
+	}
+
+	return md.setSessionKeys(keys[0:32], keys[32:64])
+}
+
+// noiseSession performs a Noise KK session handshake.
+func (md *testMD) noiseSession() (err error) {
+	md.sessionKey = nil
+	md.sealer = nil
+	md.opener = nil
+
+	s, err := md.mobileLongterm.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	rs, err := md.armoryLongterm.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	if md.mobileEphemeral, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		return
+	}
+
+	e, err := md.mobileEphemeral.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	reqMsg := &api.Message{
+		Timestamp: md.timestamp(),
+		OpCode:    api.OpCode_NOISE_SESSION,
+	}
+
+	hs, err := noise.NewHandshake(&noise.Config{
+		Pattern:    noise.KK,
+		Initiator:  true,
+		Prologue:   binary.BigEndian.AppendUint64([]byte(noise.SESSION_PROLOGUE), uint64(reqMsg.Timestamp)),
+		Static:     s,
+		Ephemeral:  e,
+		PeerStatic: rs,
+	})
+
+	if err != nil {
+		return
+	}
+
+	if reqMsg.Payload, err = hs.WriteMessage(nil); err != nil {
+		return
+	}
+
+	res, err := md.send(reqMsg)
+
+	if err != nil {
+		return
+	}
+
+	if _, err = hs.ReadMessage(res.Payload); err != nil {
+		return
+	}
+
+	if md.armoryEphemeral, err = ecdsa.ParseUncompressedPublicKey(elliptic.P256(), hs.PeerEphemeral().Bytes()); err != nil {
+		return
+	}
+
+	tx, rx, err := hs.Split()
+
+	if err != nil {
+		return
+	}
+
+	return md.setSessionKeys(tx, rx)
+}
+
+func (md *testMD) setSessionKeys(tx []byte, rx []byte) (err error) {
+	if md.sealer, err = testGCM(tx); err != nil {
+		return
+	}
+
+	md.opener, err = testGCM(rx)
+	md.txKey = tx
+	md.rxKey = rx
+	md.txSequence = 0
+	md.rxSequence = 0
+
+	return
+}
+
+// rekey rotates the v2 session keys with the nonce of a REKEY response.
+func (md *testMD) rekey(nonce uint64) (err error) {
+	var keys [][]byte
+
+	for _, key := range [][]byte{md.txKey, md.rxKey} {
+		next := make([]byte, len(key))
+		r := hkdf.New(sha256.New, key, binary.BigEndian.AppendUint64(nil, nonce), []byte(crypto.REKEY_INFO))
+
+		if _, err = io.ReadFull(r, next); err != nil {
+			return
+		}
+
+		keys = append(keys, next)
+	}
+
+	// sequence numbers are not reset by re-keying
+	txSequence, rxSequence := md.txSequence, md.rxSequence
+
+	if err = md.setSessionKeys(keys[0], keys[1]); err != nil {
+		return
+	}
+
+	md.txSequence = txSequence
+	md.rxSequence = rxSequence
+
+	return
+}
+
+// status returns the UA status, within the current session.
+func (md *testMD) status() (s *api.Status) {
+	res, err := md.exchange(api.OpCode_STATUS, nil)
+
+	if err != nil {
+		md.t.Fatal(err)
+	}
+
+	s = &api.Status{}
+
+	if err = proto.Unmarshal(res.Payload, s); err != nil {
+		md.t.Fatal(err)
+	}
+
+	return
+}
+
+func (md *testMD) encryptOFB(plaintext []byte) []byte {
+	block, err := aes.NewCipher(md.sessionKey)
+
+	if err != nil {
+		md.t.Fatal(err)
+	}
+
+	iv := make([]byte, aes.BlockSize)
+	rand.Read(iv)
+
+	ciphertext := make([]byte, len(plaintext))
+	cipher.NewOFB(block, iv).XORKeyStream(ciphertext, plaintext)
+
+	return append(iv, ciphertext...)
+}
+
+func (md *testMD) decryptOFB(ciphertext []byte) (plaintext []byte, err error) {
+	if len(ciphertext) < aes.BlockSize {
+		return nil, errors.New("invalid message")
+	}
+
+	block, err := aes.NewCipher(md.sessionKey)
+
+	if err != nil {
+		return
+	}
+
+	plaintext = make([]byte, len(ciphertext)-aes.BlockSize)
+	cipher.NewOFB(block, ciphertext[0:aes.BlockSize]).XORKeyStream(plaintext, ciphertext[aes.BlockSize:])
+
+	return
+}
+
+func testGCM(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func testNonce(sequence uint64) []byte {
+	return binary.BigEndian.AppendUint64(make([]byte, 4), sequence)
+}
+
+func testAdditionalData(msg *api.Message) (buf []byte) {
+	buf = binary.BigEndian.AppendUint64(buf, uint64(msg.Timestamp))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(msg.OpCode))
+
+	if msg.Response {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+
+	buf = binary.BigEndian.AppendUint32(buf, uint32(msg.Error))
+
+	return binary.BigEndian.AppendUint64(buf, msg.Sequence)
+}
+
+func testVerify(key *ecdsa.PublicKey, env *api.Envelope) error {
+	sum := sha256.Sum256(env.Message)
+	sig := env.Signature
+
+	if sig == nil || len(sig.Data) != 0 && !bytes.Equal(sig.Data, sum[:]) {
+		return errors.New("signature error, data mismatch")
+	}
+
+	if !ecdsa.Verify(key, sum[:], new(big.Int).SetBytes(sig.R), new(big.Int).SetBytes(sig.S)) {
+		return errors.New("signature error, invalid")
+	}
+
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ble
+
+import (
+	"log"
+	"time"
+
+	"github.com/usbarmory/armory-drive/api"
+)
+
+// flag to enable Noise pairing and session handshakes
+const NOISE = true
+
+// handshake returns whether an operation is a Noise handshake, whose
+// messages are authenticated by the handshake itself rather than envelope
+// signatures.
+func handshake(op api.OpCode) bool {
+	return op == api.OpCode_NOISE_PAIR || op == api.OpCode_NOISE_SESSION
+}
+
+func (b *BLE) noisePair(reqMsg *api.Message, resMsg *api.Message) {
+	res, key, err := b.Keyring.NoisePairing(reqMsg.Payload, b.pairingNonce)
+
+	if err != nil {
+		log.Printf("err: %v", err)
+		resMsg.Error = api.ErrorCode_PAIRING_KEY_NEGOTIATION_FAILED
+		return
+	}
+
+	if err = b.paired(key); err != nil {
+		log.Printf("err: %v", err)
+		resMsg.Error = api.ErrorCode_PAIRING_KEY_NEGOTIATION_FAILED
+		return
+	}
+
+	resMsg.Payload = res
+}
+
+func (b *BLE) noiseSession(reqMsg *api.Message, resMsg *api.Message) {
+	res, err := b.Keyring.NoiseSession(reqMsg.Payload, reqMsg.Timestamp)
+
+	if err != nil {
+		log.Printf("err: %v", err)
+		resMsg.Error = api.ErrorCode_SESSION_KEY_NEGOTIATION_FAILED
+		return
+	}
+
+	b.session.Reset()
+	b.session.Skew = time.Until(time.Unix(0, reqMsg.Timestamp*1000*1000))
+
+	resMsg.Timestamp = b.session.Time()
+	resMsg.Payload = res
+}
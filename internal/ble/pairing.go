@@ -16,7 +16,9 @@ import (
 
 const pairingCodeSize = 117
 
-func (b *BLE) PairingMode() (code []byte, err error) {
+// PairingMode generates a new UA long-term key and returns the pairing QR code
+// image, as well as its raw content for hosts unable to scan it.
+func (b *BLE) PairingMode() (code []byte, data []byte, err error) {
 	// Generate a new UA longterm key, it will be saved only on successful
 	// pairings.
 	if err = b.Keyring.NewLongtermKey(); err != nil {
@@ -42,13 +44,16 @@ func (b *BLE) PairingMode() (code []byte, err error) {
 		return
 	}
 
-	qr, err := qrcode.New(string(pb.Bytes()), qrcode.Medium)
+	data = pb.Bytes()
+	qr, err := qrcode.New(string(data), qrcode.Medium)
 
 	if err != nil {
 		return
 	}
 
-	return qr.PNG(pairingCodeSize)
+	code, err = qr.PNG(pairingCodeSize)
+
+	return
 }
 
 func (b *BLE) signPairingCode(qr *api.PairingQRCode) (err error) {
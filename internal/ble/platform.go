@@ -0,0 +1,26 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build tamago
+
+package ble
+
+import (
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive/internal/ota"
+
+	"github.com/usbarmory/tamago/soc/nxp/imx6ul"
+)
+
+// secureBoot returns whether SNVS, and therefore Secure Boot, is available.
+func secureBoot() bool {
+	return imx6ul.SNVS.Available()
+}
+
+// checkpointSize returns the firmware transparency log size at the checkpoint
+// of the last verified update.
+func checkpointSize(pb *api.ProofBundle) uint64 {
+	return ota.CheckpointSize(pb)
+}
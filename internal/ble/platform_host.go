@@ -0,0 +1,34 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ble
+
+import (
+	"errors"
+
+	"github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive/internal/edm"
+)
+
+// The BLE module, SNVS and firmware updates are only available on the USB
+// armory, host builds are meant for test cases, which provide a Transport.
+
+func newANNATransport() (edm.Transport, error) {
+	return nil, errors.New("BLE module not available")
+}
+
+func (b *BLE) hardwareRevision() string {
+	return ""
+}
+
+func secureBoot() bool {
+	return false
+}
+
+func checkpointSize(pb *api.ProofBundle) uint64 {
+	return 0
+}
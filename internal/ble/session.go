@@ -8,20 +8,48 @@ package ble
 import (
 	"sync"
 	"time"
+
+	"github.com/usbarmory/armory-drive/api"
 )
 
 type Session struct {
 	sync.Mutex
 
+	// last v1 session message timestamp
 	Last   int64
 	Skew   time.Duration
 	Active bool
 	Data   []byte
+
+	// session negotiation time
+	Start time.Time
+	// last in-session request time
+	Used time.Time
+	// in-session requests since negotiation or last re-keying
+	Messages uint32
+	// reason for the expiry of the last session
+	Expiry api.SessionExpiry
+
+	// expiry timer
+	timer *time.Timer
+	// re-keying nonce, pending the response
+	rekey []byte
+	// session termination, pending the response
+	terminate bool
 }
 
 func (s *Session) Reset() {
 	s.Active = false
+	s.Last = 0
 	s.Data = nil
+	s.Messages = 0
+	s.rekey = nil
+	s.terminate = false
+
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
 }
 
 func (s *Session) Time() int64 {
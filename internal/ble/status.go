@@ -0,0 +1,62 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ble
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/usbarmory/armory-drive/api"
+
+	"github.com/usbarmory/tamago/soc/nxp/usdhc"
+)
+
+// boot time, for uptime reporting
+var boot = time.Now()
+
+// busMode returns the card bus speed mode selected by the uSDHC driver.
+func busMode(info usdhc.CardInfo) string {
+	switch {
+	case info.SD && info.Rate >= usdhc.SDR104_MBPS:
+		return "SDR104"
+	case info.SD && info.Rate >= usdhc.SDR50_MBPS:
+		return "SDR50"
+	case info.MMC && info.Rate >= usdhc.HS200_MBPS:
+		return "HS200"
+	case info.DDR:
+		return "HS DDR"
+	case info.HS:
+		return "HS"
+	default:
+		return "DS"
+	}
+}
+
+// cardInfo returns the microSD card information, decoding its CID register.
+func (b *BLE) cardInfo() *api.CardInfo {
+	info := b.Drive.CardInfo()
+
+	if !info.SD {
+		return nil
+	}
+
+	// The CID register is stored by the uSDHC driver as received in its
+	// response registers, least significant byte first and without the
+	// CRC byte.
+	cid := slices.Clone(info.CID[0:15])
+	slices.Reverse(cid)
+
+	// 5.2 CID register, SD-PL-7.10
+	return &api.CardInfo{
+		CID:          cid,
+		Manufacturer: uint32(cid[0]),
+		OEM:          strings.TrimRight(string(cid[1:3]), "\x00 "),
+		Product:      strings.TrimRight(string(cid[3:8]), "\x00 "),
+		BusMode:      busMode(info),
+		Rate:         uint32(info.Rate),
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ble
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/internal/crypto"
+)
+
+// Delay imposed after the first failed unlock attempt, doubled at each
+// subsequent one up to UNLOCK_BACKOFF_MAX.
+const (
+	UNLOCK_BACKOFF_BASE = 1 * time.Second
+	UNLOCK_BACKOFF_MAX  = 1 * time.Hour
+)
+
+var errUnlockThrottled = errors.New("unlock attempt throttled")
+
+// unlockBackoff returns the delay imposed after the given number of
+// consecutive failed unlock attempts.
+func unlockBackoff(failures int) time.Duration {
+	if failures <= 0 {
+		return 0
+	}
+
+	backoff := UNLOCK_BACKOFF_BASE
+
+	for i := 1; i < failures && backoff < UNLOCK_BACKOFF_MAX; i++ {
+		backoff *= 2
+	}
+
+	return min(backoff, UNLOCK_BACKOFF_MAX)
+}
+
+// unlockRemaining returns the delay left before the next unlock attempt is
+// accepted.
+func (b *BLE) unlockRemaining() time.Duration {
+	return max(time.Until(b.unlockNotBefore), 0)
+}
+
+// verifyKEK checks the KEK against the enrolled verifier, if any, accounting
+// failed attempts.
+//
+// Each attempt is recorded as failed before any verification, or decryption,
+// so that it cannot be discarded by cutting power after a mismatch, and it is
+// cleared only on success (see unlockSucceeded()).
+//
+// The first unlock following pairing enrolls the KEK verifier. The KEK is
+// supplied by the paired MD, which authenticated the request, enrollment
+// therefore does not rely on the volume content, which cannot reliably tell
+// an invalid KEK apart.
+func (b *BLE) verifyKEK(kek []byte) (err error) {
+	b.Keyring.Conf.UnlockFailures += 1
+
+	if !b.Keyring.KEKEnrolled() {
+		verifier, err := b.Keyring.KEKVerifier(kek)
+
+		if err != nil {
+			return err
+		}
+
+		b.Keyring.EnrollKEK(verifier)
+	}
+
+	if err = b.Keyring.Save(); err != nil {
+		return
+	}
+
+	if err = b.Keyring.VerifyKEK(kek); err != nil {
+		b.unlockFailed()
+	}
+
+	return
+}
+
+// unlockFailed applies the unlock wipe threshold and backoff after a failed
+// attempt.
+func (b *BLE) unlockFailed() {
+	failures := b.Keyring.Conf.UnlockFailures
+	threshold := b.Keyring.Conf.Settings.GetUnlockWipeThreshold()
+
+	log.Printf("unlock failed (%d consecutive attempts)", failures)
+	b.Keyring.Audit(api.LogEvent_UNLOCK_REJECTED, fmt.Sprintf("invalid KEK, %d consecutive failures", failures))
+
+	if threshold > 0 && failures >= int(threshold) {
+		log.Printf("unlock wipe threshold reached, wiping keys")
+		b.Keyring.Audit(api.LogEvent_WIPED, "")
+
+		if err := b.Keyring.Wipe(); err != nil {
+			log.Printf("wipe error, %v", err)
+		}
+
+		b.unlockNotBefore = time.Time{}
+
+		// the session is terminated once the response is sent
+		b.session.terminate = true
+
+		return
+	}
+
+	b.unlockNotBefore = time.Now().Add(unlockBackoff(failures))
+}
+
+// auditUnlock records an unlock attempt outcome, invalid KEKs are recorded
+// when accounted (see unlockFailed()).
+func (b *BLE) auditUnlock(err error) {
+	switch {
+	case err == nil:
+		b.Keyring.Audit(api.LogEvent_UNLOCKED, "")
+	case errors.Is(err, crypto.ErrInvalidKEK):
+		return
+	default:
+		b.Keyring.Audit(api.LogEvent_UNLOCK_REJECTED, err.Error())
+	}
+}
+
+// unlockSucceeded resets failed attempts.
+func (b *BLE) unlockSucceeded() {
+	conf := b.Keyring.Conf
+	save := conf.UnlockFailures != 0
+
+	conf.UnlockFailures = 0
+	b.unlockNotBefore = time.Time{}
+	b.lastUnlock = b.session.Time()
+
+	if !save {
+		return
+	}
+
+	if err := b.Keyring.Save(); err != nil {
+		log.Printf("could not save unlock state, %v", err)
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ble
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/internal/crypto"
+)
+
+func TestUnlockBackoff(t *testing.T) {
+	for _, tc := range []struct {
+		failures int
+		backoff  time.Duration
+	}{
+		{-1, 0},
+		{0, 0},
+		{1, UNLOCK_BACKOFF_BASE},
+		{2, 2 * UNLOCK_BACKOFF_BASE},
+		{5, 16 * UNLOCK_BACKOFF_BASE},
+		{13, UNLOCK_BACKOFF_MAX},
+		{1 << 20, UNLOCK_BACKOFF_MAX},
+	} {
+		if backoff := unlockBackoff(tc.failures); backoff != tc.backoff {
+			t.Errorf("%d failures: backoff %v, expected %v", tc.failures, backoff, tc.backoff)
+		}
+	}
+}
+
+// testUnlockEvents returns the audit log unlock events.
+func testUnlockEvents(t *testing.T, b *BLE) (events []api.LogEvent) {
+	res, err := b.Keyring.AuditLog(0, crypto.LOG_PAGE_MAX)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range res.Entries {
+		switch entry.Event {
+		case api.LogEvent_UNLOCKED, api.LogEvent_UNLOCK_REJECTED, api.LogEvent_WIPED:
+			events = append(events, entry.Event)
+		}
+	}
+
+	return
+}
+
+func TestUnlockFailures(t *testing.T) {
+	if testing.Short() {
+		t.Skip("unlock rate limiting")
+	}
+
+	b, md := startTestSession(t, crypto.SESSION_V2)
+	kek := bytes.Repeat([]byte{0x4b}, 32)
+	invalid := bytes.Repeat([]byte{0x49}, 32)
+
+	unlock := func(kek []byte) api.ErrorCode {
+		res, _ := md.exchange(api.OpCode_UNLOCK, (&api.KeyExchange{Key: kek}).Bytes())
+		return res.Error
+	}
+
+	// The first unlock following pairing enrolls the KEK, regardless of
+	// the volume content (the emulated card is blank).
+	if res := unlock(kek); res != api.ErrorCode_NO_ERROR || !b.Keyring.KEKEnrolled() {
+		t.Fatalf("unexpected error %v", res)
+	}
+
+	if _, err := md.exchange(api.OpCode_LOCK, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if res := unlock(invalid); res != api.ErrorCode_UNLOCK_FAILED {
+		t.Fatalf("unexpected error %v", res)
+	}
+
+	// failed attempts are persistent
+	if err := b.Keyring.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if b.Keyring.Conf.UnlockFailures != 1 || b.Drive.Ready() {
+		t.Fatalf("unexpected state (failures: %d, ready: %v)", b.Keyring.Conf.UnlockFailures, b.Drive.Ready())
+	}
+
+	// throttled attempts are not verified
+	b.unlockNotBefore = time.Now().Add(time.Hour)
+
+	if s := md.status(); s.UnlockFailures != 1 || s.UnlockBackoff == 0 {
+		t.Fatalf("unexpected status (failures: %d, backoff: %d)", s.UnlockFailures, s.UnlockBackoff)
+	}
+
+	if res := unlock(kek); res != api.ErrorCode_UNLOCK_THROTTLED || b.Drive.Ready() {
+		t.Fatalf("unexpected error %v", res)
+	}
+
+	b.unlockNotBefore = time.Time{}
+
+	if res := unlock(kek); res != api.ErrorCode_NO_ERROR || !b.Drive.Ready() {
+		t.Fatalf("unexpected error %v", res)
+	}
+
+	if s := md.status(); s.UnlockFailures != 0 || s.UnlockBackoff != 0 {
+		t.Fatalf("unexpected status (failures: %d, backoff: %d)", s.UnlockFailures, s.UnlockBackoff)
+	}
+
+	if _, err := md.exchange(api.OpCode_LOCK, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// wipe threshold
+	b.Keyring.Conf.Settings.UnlockWipeThreshold = 2
+	b.Keyring.Conf.UnlockFailures = 1
+	blockKeySecret := bytes.Clone(b.Keyring.Conf.BlockKeySecret)
+
+	if res := unlock(invalid); res != api.ErrorCode_UNLOCK_FAILED {
+		t.Fatalf("unexpected error %v", res)
+	}
+
+	if b.Keyring.KEKEnrolled() || b.Keyring.MobileLongterm != nil || bytes.Equal(b.Keyring.Conf.BlockKeySecret, blockKeySecret) {
+		t.Fatal("keys not wiped")
+	}
+
+	// the session is terminated
+	if _, res := md.roundTrip(md.envelope(&api.Message{Timestamp: md.timestamp(), OpCode: api.OpCode_STATUS})); res.Error != api.ErrorCode_INVALID_SESSION {
+		t.Fatalf("session not terminated (%v)", res.Error)
+	}
+
+	events := []api.LogEvent{
+		api.LogEvent_UNLOCKED,
+		api.LogEvent_UNLOCK_REJECTED,
+		api.LogEvent_UNLOCK_REJECTED,
+		api.LogEvent_UNLOCKED,
+		api.LogEvent_UNLOCK_REJECTED,
+		api.LogEvent_WIPED,
+	}
+
+	if res := testUnlockEvents(t, b); !slices.Equal(res, events) {
+		t.Errorf("unexpected audit events %v", res)
+	}
+}
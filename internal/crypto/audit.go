@@ -0,0 +1,296 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/usbarmory/armory-drive/api"
+
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// audit log ring, following the persistent configuration, one entry
+	// per block
+	MMC_LOG_BLOCK = MMC_CONF_BLOCK + CONF_BLOCKS_V2
+	LOG_ENTRIES   = 2048
+
+	// maximum number of entries returned by AuditLog()
+	LOG_PAGE_MAX = 16
+	// maximum entry detail length
+	LOG_DETAIL_MAX = 128
+
+	// blocks read at once while scanning the log
+	logScanBlocks = 64
+)
+
+type auditLog struct {
+	sync.Mutex
+
+	// index of the oldest entry
+	first uint64
+	// index of the next entry
+	next uint64
+	// digest of the last entry
+	last []byte
+}
+
+func (k *Keyring) now() int64 {
+	if k.Clock != nil {
+		return k.Clock()
+	}
+
+	return time.Now().UnixNano() / (1000 * 1000)
+}
+
+// decodeEntry authenticates and decrypts a log entry block.
+func (k *Keyring) decodeEntry(block []byte) (entry *api.LogEntry, buf []byte, err error) {
+	plaintext, err := k.decryptSNVS(block)
+
+	if err != nil {
+		return
+	}
+
+	if len(plaintext) < 2 {
+		return nil, nil, errors.New("invalid log entry")
+	}
+
+	size := int(binary.BigEndian.Uint16(plaintext[0:2]))
+
+	if size == 0 || size > len(plaintext)-2 {
+		return nil, nil, errors.New("invalid log entry")
+	}
+
+	buf = plaintext[2 : 2+size]
+	entry = &api.LogEntry{}
+
+	if err = proto.Unmarshal(buf, entry); err != nil {
+		return nil, nil, err
+	}
+
+	return
+}
+
+// readEntry reads, and decodes, the log entry with the given index, the error
+// is nil if the entry is not present.
+func (k *Keyring) readEntry(index uint64, block []byte) (entry *api.LogEntry, raw []byte, err error) {
+	if err = mmc.ReadBlocks(MMC_LOG_BLOCK+int(index%LOG_ENTRIES), block); err != nil {
+		return
+	}
+
+	// unwritten, foreign or overwritten entries are not present
+	if entry, raw, err = k.decodeEntry(block); err != nil || entry.Index != index {
+		return nil, nil, nil
+	}
+
+	return
+}
+
+// initAudit locates the last audit log entry, starting from the index of the
+// next one as of the last configuration save, to account for entries
+// appended afterwards. The whole log is scanned only when the index is
+// unknown.
+func (k *Keyring) initAudit(next uint64) (err error) {
+	if next == 0 {
+		return k.scanAudit()
+	}
+
+	blockSize := mmc.Info().BlockSize
+	block := make([]byte, blockSize)
+
+	audit := &auditLog{
+		next: next,
+	}
+
+	entry, raw, err := k.readEntry(next-1, block)
+
+	if err != nil {
+		return
+	}
+
+	if entry != nil {
+		digest := sha256.Sum256(raw)
+		audit.last = digest[:]
+	}
+
+	for audit.next-next < LOG_ENTRIES {
+		if entry, raw, err = k.readEntry(audit.next, block); err != nil {
+			return
+		}
+
+		if entry == nil {
+			break
+		}
+
+		digest := sha256.Sum256(raw)
+		audit.next += 1
+		audit.last = digest[:]
+	}
+
+	audit.first = audit.next - min(audit.next, LOG_ENTRIES)
+	k.audit = audit
+
+	return
+}
+
+// scanAudit scans the whole audit log to locate its oldest and last entries.
+func (k *Keyring) scanAudit() (err error) {
+	blockSize := mmc.Info().BlockSize
+	buf := make([]byte, logScanBlocks*blockSize)
+
+	audit := &auditLog{}
+	found := false
+
+	for lba := 0; lba < LOG_ENTRIES; lba += logScanBlocks {
+		if err = mmc.ReadBlocks(MMC_LOG_BLOCK+lba, buf); err != nil {
+			return
+		}
+
+		for i := 0; i < logScanBlocks; i++ {
+			// unwritten, or foreign, blocks fail authentication
+			entry, raw, err := k.decodeEntry(buf[i*blockSize : (i+1)*blockSize])
+
+			if err != nil || entry.Index%LOG_ENTRIES != uint64(lba+i) {
+				continue
+			}
+
+			if !found || entry.Index < audit.first {
+				audit.first = entry.Index
+			}
+
+			if !found || entry.Index >= audit.next {
+				digest := sha256.Sum256(raw)
+				audit.next = entry.Index + 1
+				audit.last = digest[:]
+			}
+
+			found = true
+		}
+	}
+
+	k.audit = audit
+
+	return
+}
+
+// Audit records an event in the audit log, the entry is attributed to the
+// paired MD, if any.
+func (k *Keyring) Audit(event api.LogEvent, detail string) {
+	if err := k.audit.append(k, event, detail); err != nil {
+		log.Printf("could not record %v event, %v", event, err)
+	}
+}
+
+func (audit *auditLog) append(k *Keyring, event api.LogEvent, detail string) (err error) {
+	if audit == nil {
+		return errors.New("audit log not initialized")
+	}
+
+	audit.Lock()
+	defer audit.Unlock()
+
+	if len(detail) > LOG_DETAIL_MAX {
+		detail = detail[:LOG_DETAIL_MAX]
+	}
+
+	entry := &api.LogEntry{
+		Index:     audit.next,
+		Timestamp: k.now(),
+		Event:     event,
+		Detail:    detail,
+		Previous:  audit.last,
+	}
+
+	if mobileLongterm, err := k.Export(MD_LONGTERM_KEY, false); err == nil {
+		digest := sha256.Sum256(mobileLongterm)
+		entry.Device = digest[:]
+	}
+
+	blockSize := mmc.Info().BlockSize
+	buf := entry.Bytes()
+
+	if len(buf)+2 > blockSize-aes.BlockSize-sha256.Size {
+		return errors.New("log entry too large")
+	}
+
+	block, err := k.encryptSNVS(append(binary.BigEndian.AppendUint16(nil, uint16(len(buf))), buf...), blockSize)
+
+	if err != nil {
+		return
+	}
+
+	if err = mmc.WriteBlocks(MMC_LOG_BLOCK+int(entry.Index%LOG_ENTRIES), block); err != nil {
+		return
+	}
+
+	digest := sha256.Sum256(buf)
+
+	audit.next += 1
+	audit.last = digest[:]
+
+	if audit.next-audit.first > LOG_ENTRIES {
+		audit.first = audit.next - LOG_ENTRIES
+	}
+
+	return
+}
+
+// AuditLog returns up to count audit log entries, limited to LOG_PAGE_MAX,
+// starting from the given index or the oldest entry if overwritten.
+func (k *Keyring) AuditLog(index uint64, count int) (res *api.Log, err error) {
+	audit := k.audit
+
+	if audit == nil {
+		return nil, errors.New("audit log not initialized")
+	}
+
+	audit.Lock()
+	defer audit.Unlock()
+
+	res = &api.Log{
+		First: audit.first,
+		Next:  audit.next,
+	}
+
+	blockSize := mmc.Info().BlockSize
+	block := make([]byte, blockSize)
+
+	for i := max(index, audit.first); i < audit.next && len(res.Entries) < min(count, LOG_PAGE_MAX); i++ {
+		entry, _, err := k.readEntry(i, block)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if entry == nil {
+			return nil, fmt.Errorf("log entry %d not found", i)
+		}
+
+		res.Entries = append(res.Entries, entry)
+	}
+
+	return
+}
+
+// head returns the index of the next entry, 0 if not initialized.
+func (audit *auditLog) head() uint64 {
+	if audit == nil {
+		return 0
+	}
+
+	audit.Lock()
+	defer audit.Unlock()
+
+	return audit.next
+}
@@ -0,0 +1,233 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/usbarmory/armory-drive/api"
+)
+
+// testAuditLog returns all audit log entries.
+func testAuditLog(t *testing.T, k *Keyring) (res *api.Log) {
+	res = &api.Log{}
+
+	for index := uint64(0); ; {
+		page, err := k.AuditLog(index, LOG_PAGE_MAX)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		res.First = page.First
+		res.Next = page.Next
+		res.Entries = append(res.Entries, page.Entries...)
+
+		if len(page.Entries) == 0 {
+			return
+		}
+
+		index = page.Entries[len(page.Entries)-1].Index + 1
+	}
+}
+
+// checkAuditLog verifies the audit log boundaries and hash chain.
+func checkAuditLog(t *testing.T, k *Keyring, first uint64, next uint64) (entries []*api.LogEntry) {
+	t.Helper()
+
+	res := testAuditLog(t, k)
+
+	if res.First != first || res.Next != next {
+		t.Fatalf("log boundaries %d-%d, expected %d-%d", res.First, res.Next, first, next)
+	}
+
+	if len(res.Entries) != int(next-first) {
+		t.Fatalf("%d entries, expected %d", len(res.Entries), next-first)
+	}
+
+	for i, entry := range res.Entries {
+		if entry.Index != first+uint64(i) {
+			t.Fatalf("entry %d, expected %d", entry.Index, first+uint64(i))
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		digest := sha256.Sum256(res.Entries[i-1].Bytes())
+
+		if !bytes.Equal(entry.Previous, digest[:]) {
+			t.Fatalf("entry %d not chained to its predecessor", entry.Index)
+		}
+	}
+
+	return res.Entries
+}
+
+func TestAudit(t *testing.T) {
+	k := newTestKeyring(t, newTestCard())
+
+	checkAuditLog(t, k, 0, 0)
+
+	k.Audit(api.LogEvent_UNLOCKED, "")
+
+	// entries are attributed to the paired MD
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = k.Import(MD_LONGTERM_KEY, false, der); err != nil {
+		t.Fatal(err)
+	}
+
+	k.Audit(api.LogEvent_UNLOCK_REJECTED, strings.Repeat("x", LOG_DETAIL_MAX+1))
+
+	entries := checkAuditLog(t, k, 0, 2)
+
+	if len(entries[0].Previous) != 0 || len(entries[0].Device) != 0 {
+		t.Error("unexpected first entry chaining or attribution")
+	}
+
+	if e := entries[1]; e.Event != api.LogEvent_UNLOCK_REJECTED || e.Timestamp != testTime {
+		t.Errorf("unexpected entry %v", e)
+	}
+
+	if len(entries[1].Detail) != LOG_DETAIL_MAX {
+		t.Errorf("detail length %d, expected %d", len(entries[1].Detail), LOG_DETAIL_MAX)
+	}
+
+	if digest := sha256.Sum256(der); !bytes.Equal(entries[1].Device, digest[:]) {
+		t.Error("entry not attributed to paired MD")
+	}
+}
+
+func TestAuditLogPage(t *testing.T) {
+	k := newTestKeyring(t, newTestCard())
+
+	for i := range 20 {
+		k.Audit(api.LogEvent_UNLOCKED, fmt.Sprint(i))
+	}
+
+	for _, tc := range []struct {
+		index uint64
+		count int
+		first uint64
+		n     int
+	}{
+		{0, 100, 0, LOG_PAGE_MAX},
+		{0, 1, 0, 1},
+		{18, LOG_PAGE_MAX, 18, 2},
+		{20, LOG_PAGE_MAX, 0, 0},
+		{0, 0, 0, 0},
+	} {
+		res, err := k.AuditLog(tc.index, tc.count)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(res.Entries) != tc.n || (tc.n > 0 && res.Entries[0].Index != tc.first) {
+			t.Errorf("index %d, count %d: unexpected entries %v", tc.index, tc.count, res.Entries)
+		}
+	}
+
+	if _, err := (&Keyring{}).AuditLog(0, 1); err == nil {
+		t.Error("uninitialized log read")
+	}
+}
+
+func TestAuditInit(t *testing.T) {
+	card := newTestCard()
+	k := newTestKeyring(t, card)
+
+	k.Audit(api.LogEvent_UNLOCKED, "")
+
+	if err := k.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if k.Conf.LogNext != 1 {
+		t.Fatalf("saved log head %d, expected 1", k.Conf.LogNext)
+	}
+
+	// entries appended after the last save
+	k.Audit(api.LogEvent_LOCKED, "")
+	k.Audit(api.LogEvent_UNLOCKED, "")
+
+	// reboot
+	k = newTestKeyring(t, card)
+	k.Audit(api.LogEvent_LOCKED, "")
+
+	checkAuditLog(t, k, 0, 4)
+
+	// the log is preserved across pairing resets
+	if err := k.Init(true); err != nil {
+		t.Fatal(err)
+	}
+
+	k.Audit(api.LogEvent_UNLOCKED, "")
+
+	if k.Conf.LogNext != 4 {
+		t.Errorf("reset log head %d, expected 4", k.Conf.LogNext)
+	}
+
+	// unknown head, located by scanning
+	if err := k.initAudit(0); err != nil {
+		t.Fatal(err)
+	}
+
+	k.Audit(api.LogEvent_LOCKED, "")
+
+	checkAuditLog(t, k, 0, 6)
+}
+
+func TestAuditWrap(t *testing.T) {
+	card := newTestCard()
+	k := newTestKeyring(t, card)
+
+	for range LOG_ENTRIES + 5 {
+		k.Audit(api.LogEvent_UNLOCKED, "")
+	}
+
+	if err := k.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	checkAuditLog(t, k, 5, LOG_ENTRIES+5)
+
+	last := k.audit.last
+
+	for _, next := range []uint64{LOG_ENTRIES + 5, 0} {
+		if err := k.initAudit(next); err != nil {
+			t.Fatal(err)
+		}
+
+		if k.audit.first != 5 || k.audit.next != LOG_ENTRIES+5 || !bytes.Equal(k.audit.last, last) {
+			t.Fatalf("head %d: log boundaries %d-%d", next, k.audit.first, k.audit.next)
+		}
+	}
+
+	k.Audit(api.LogEvent_LOCKED, "")
+	checkAuditLog(t, k, 6, LOG_ENTRIES+6)
+}
@@ -22,9 +22,6 @@ import (
 
 	"github.com/usbarmory/armory-drive/api"
 
-	"github.com/usbarmory/tamago/dma"
-	"github.com/usbarmory/tamago/soc/nxp/imx6ul"
-
 	"golang.org/x/crypto/pbkdf2"
 	"golang.org/x/crypto/xts"
 )
@@ -51,6 +48,15 @@ const (
 // flag to select ESSIV on AES-128 CBC ciphers
 var ESSIV = false
 
+// Ciphers represents the supported encrypted storage ciphers.
+var Ciphers = []api.Cipher{
+	api.Cipher_AES128_CBC_PLAIN,
+	api.Cipher_AES128_CBC_ESSIV,
+	api.Cipher_AES128_XTS_PLAIN,
+	api.Cipher_AES256_XTS_PLAIN,
+	api.Cipher_NONE,
+}
+
 // IV buffer
 var iv = make([]byte, aes.BlockSize)
 
@@ -72,6 +78,10 @@ func (k *Keyring) deriveKey(diversifier []byte, index int, export bool) (key []b
 
 		diversifier = append(diversifier, armoryLongterm...)
 
+		// The block key secret, when present, allows to crypto-wipe
+		// encrypted storage by its disposal (see Wipe()).
+		diversifier = append(diversifier, k.Conf.BlockKeySecret...)
+
 		// We re-use the ESSIV "salt" (unfortunate name collision here, it's
 		// not actually the PBKDF2 salt, or a salt at all) as it is random and
 		// unknown, the PBKDF2 salt is random but known (as it should be).
@@ -84,12 +94,12 @@ func (k *Keyring) deriveKey(diversifier []byte, index int, export bool) (key []b
 	iv := make([]byte, aes.BlockSize)
 
 	if export {
-		key, err = imx6ul.DCP.DeriveKey(diversifier, iv, -1)
+		key, err = dcp.DeriveKey(diversifier, iv, -1)
 	} else {
 		// Move the derived key directly to the internal DCP key RAM
 		// slot, without ever exposing it to external RAM or the Go
 		// runtime.
-		_, err = imx6ul.DCP.DeriveKey(diversifier, iv, index)
+		_, err = dcp.DeriveKey(diversifier, iv, index)
 	}
 
 	if err != nil {
@@ -97,7 +107,7 @@ func (k *Keyring) deriveKey(diversifier []byte, index int, export bool) (key []b
 	}
 
 	if export {
-		err = imx6ul.DCP.SetKey(index, key)
+		err = dcp.SetKey(index, key)
 	}
 
 	return
@@ -183,7 +193,7 @@ func (k *Keyring) SetCipher(kind api.Cipher, diversifier []byte) (err error) {
 // equivalent to aes-cbc-essiv:md5
 func (k *Keyring) essiv(buf []byte, iv []byte) (err error) {
 	if DCPIV {
-		err = imx6ul.DCP.Encrypt(buf, ESSIV_KEY, iv)
+		err = dcp.Encrypt(buf, ESSIV_KEY, iv)
 	} else {
 		encrypter := cipher.NewCBCEncrypter(k.cbiv, iv)
 		encrypter.CryptBlocks(buf, buf)
@@ -194,8 +204,8 @@ func (k *Keyring) essiv(buf []byte, iv []byte) (err error) {
 
 // equivalent to aes-cbc-plain (hw)
 func (k *Keyring) cipherDCP(buf []byte, lba int, blocks int, blockSize int, enc bool, wg *sync.WaitGroup) {
-	addr, ivs := dma.Reserve(blocks*aes.BlockSize, 4)
-	defer dma.Release(addr)
+	addr, ivs := k.Pool.Reserve(blocks*aes.BlockSize, false)
+	defer k.Pool.Release(addr)
 
 	for i := 0; i < blocks; i++ {
 		off := i * aes.BlockSize
@@ -211,7 +221,7 @@ func (k *Keyring) cipherDCP(buf []byte, lba int, blocks int, blockSize int, enc
 		}
 	}
 
-	err := imx6ul.DCP.CipherChain(buf, ivs, blocks, blockSize, BLOCK_KEY, enc)
+	err := dcp.CipherChain(buf, ivs, blocks, blockSize, BLOCK_KEY, enc)
 
 	if err != nil {
 		log.Fatal(err)
@@ -411,9 +421,13 @@ func (k *Keyring) SignECDSA(data []byte, ephemeral bool) (sig *api.Signature, er
 	}
 
 	sig = &api.Signature{
-		Data: sum,
-		R:    r.Bytes(),
-		S:    s.Bytes(),
+		R: r.Bytes(),
+		S: s.Bytes(),
+	}
+
+	// v2 sessions omit the redundant digest
+	if !ephemeral || k.sessionVersion < SESSION_V2 {
+		sig.Data = sum
 	}
 
 	return
@@ -428,10 +442,16 @@ func (k *Keyring) VerifyECDSA(data []byte, sig *api.Signature, ephemeral bool) (
 		verKey = k.MobileLongterm
 	}
 
+	if sig == nil || verKey == nil {
+		return errors.New("signature error, missing signature or key")
+	}
+
 	h := sha256.New()
 	h.Write(data)
+	sum := h.Sum(nil)
 
-	if !bytes.Equal(sig.Data, h.Sum(nil)) {
+	// v2 sessions omit the redundant digest
+	if (len(sig.Data) != 0 || !ephemeral || k.sessionVersion < SESSION_V2) && !bytes.Equal(sig.Data, sum) {
 		return errors.New("signature error, data mismatch")
 	}
 
@@ -441,7 +461,7 @@ func (k *Keyring) VerifyECDSA(data []byte, sig *api.Signature, ephemeral bool) (
 	R.SetBytes(sig.R)
 	S.SetBytes(sig.S)
 
-	valid := ecdsa.Verify(verKey, sig.Data, R, S)
+	valid := ecdsa.Verify(verKey, sum, R, S)
 
 	if !valid {
 		return errors.New("signature error, invalid")
@@ -11,8 +11,6 @@ import (
 
 	logapi "github.com/usbarmory/armory-drive-log/api"
 	"github.com/usbarmory/armory-drive/api"
-
-	usbarmory "github.com/usbarmory/tamago/board/usbarmory/mk2"
 )
 
 const (
@@ -29,8 +27,28 @@ type PersistentConfiguration struct {
 	// BLE API Configuration
 	Settings *api.Configuration
 
+	// Block size multiplier of the formatted volume, 0 if not formatted,
+	// recorded once the volume is found formatted and never cleared
+	VolumeMultiplier int
+
 	// Transparency Log Checkpoint
 	ProofBundle *logapi.ProofBundle
+
+	// Consecutive failed unlock attempts
+	UnlockFailures int
+	// KEK verifier, enrolled at the first unlock following pairing.
+	//
+	// Verifiers enrolled by earlier revisions (as KEKVerifier) were
+	// derived from decrypted volume content, and therefore possibly from
+	// an invalid KEK, they are ignored on decoding to never reject, or
+	// wipe keys on, the valid one.
+	UnlockVerifier []byte
+	// Block key derivation secret, discarded on wipe, not present on
+	// pairings predating its introduction
+	BlockKeySecret []byte
+
+	// Audit log index of the next entry, as of the last save (0: unknown)
+	LogNext uint64
 }
 
 func (k *Keyring) reset() (err error) {
@@ -51,16 +69,17 @@ func (k *Keyring) reset() (err error) {
 		Settings: &api.Configuration{
 			Cipher: api.Cipher_AES128_CBC_PLAIN,
 		},
+		BlockKeySecret: Rand(32),
 	}
 
 	return k.Save()
 }
 
 func (k *Keyring) loadAt(lba int, blocks int) (err error) {
-	blockSize := usbarmory.MMC.Info().BlockSize
+	blockSize := mmc.Info().BlockSize
 	snvs := make([]byte, blocks*blockSize)
 
-	if err = usbarmory.MMC.ReadBlocks(lba, snvs); err != nil {
+	if err = mmc.ReadBlocks(lba, snvs); err != nil {
 		return
 	}
 
@@ -85,7 +104,13 @@ func (k *Keyring) Load() (err error) {
 }
 
 func (k *Keyring) Save() (err error) {
-	blockSize := usbarmory.MMC.Info().BlockSize
+	blockSize := mmc.Info().BlockSize
+
+	// the audit log position, unlike the rest of the configuration,
+	// survives pairing
+	if next := k.audit.head(); next > 0 {
+		k.Conf.LogNext = next
+	}
 
 	buf := new(bytes.Buffer)
 
@@ -99,5 +124,5 @@ func (k *Keyring) Save() (err error) {
 		return
 	}
 
-	return usbarmory.MMC.WriteBlocks(MMC_CONF_BLOCK, snvs)
+	return mmc.WriteBlocks(MMC_CONF_BLOCK, snvs)
 }
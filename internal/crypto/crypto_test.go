@@ -0,0 +1,48 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package crypto
+
+import (
+	"io"
+	"log"
+	"os"
+	"testing"
+
+	"github.com/usbarmory/armory-drive/internal/emulator"
+)
+
+const (
+	testBlockSize = 512
+	testMMCBlocks = MMC_LOG_BLOCK + LOG_ENTRIES
+	testTime      = 1700000000000
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+func newTestCard() *emulator.Card {
+	return emulator.NewCard(testBlockSize, testMMCBlocks)
+}
+
+// newTestKeyring returns an initialized instance backed by an emulated
+// internal card, which retains its state across instances as on reboots.
+func newTestKeyring(t *testing.T, card *emulator.Card) (k *Keyring) {
+	SetPlatform(card, emulator.NewDCP())
+
+	k = &Keyring{
+		Clock: func() int64 { return testTime },
+	}
+
+	if err := k.Init(false); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
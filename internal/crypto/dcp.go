@@ -8,8 +8,6 @@ package crypto
 import (
 	"crypto/aes"
 	"crypto/cipher"
-
-	"github.com/usbarmory/tamago/soc/nxp/imx6ul"
 )
 
 type dcpCipher struct {
@@ -36,7 +34,7 @@ func newDCPCipher(key []byte) (c cipher.Block, err error) {
 		keyIndex: BLOCK_KEY,
 	}
 
-	return c, imx6ul.DCP.SetKey(BLOCK_KEY, key)
+	return c, dcp.SetKey(BLOCK_KEY, key)
 }
 
 // BlockSize returns the AES block size in bytes.
@@ -46,10 +44,10 @@ func (c *dcpCipher) BlockSize() int {
 
 // Encrypt performs in-place buffer encryption using AES-128-CBC.
 func (c *dcpCipher) Encrypt(_ []byte, buf []byte) {
-	imx6ul.DCP.Encrypt(buf, c.keyIndex, zero)
+	dcp.Encrypt(buf, c.keyIndex, zero)
 }
 
 // Decrypt performs in-place buffer decryption using AES-128-CBC.
 func (c *dcpCipher) Decrypt(_ []byte, buf []byte) {
-	imx6ul.DCP.Decrypt(buf, c.keyIndex, zero)
+	dcp.Decrypt(buf, c.keyIndex, zero)
 }
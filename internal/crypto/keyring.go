@@ -14,8 +14,13 @@ import (
 	"crypto/x509"
 	"errors"
 	"io"
+	"log"
 	"sync"
 
+	"github.com/usbarmory/armory-drive/internal/pool"
+
+	"github.com/usbarmory/tamago/soc/nxp/usdhc"
+
 	"golang.org/x/crypto/hkdf"
 	"golang.org/x/crypto/xts"
 )
@@ -35,6 +40,24 @@ const (
 	MD_EPHEMERAL_KEY
 )
 
+// Storage represents the internal card holding the persistent configuration
+// and audit log.
+type Storage interface {
+	Info() usdhc.CardInfo
+	ReadBlocks(int, []byte) error
+	WriteBlocks(int, []byte) error
+}
+
+// KeyEngine represents the co-processor deriving keys from the SoC unique
+// master key, and holding them in its key RAM, for AES-128-CBC operation.
+type KeyEngine interface {
+	DeriveKey(diversifier []byte, iv []byte, index int) (key []byte, err error)
+	SetKey(index int, key []byte) error
+	Encrypt(buf []byte, index int, iv []byte) error
+	Decrypt(buf []byte, index int, iv []byte) error
+	CipherChain(buf []byte, ivs []byte, count int, size int, index int, enc bool) error
+}
+
 type Keyring struct {
 	// FDE function
 	Cipher func(buf []byte, lba int, blocks int, blockSize int, enc bool, wg *sync.WaitGroup)
@@ -42,6 +65,13 @@ type Keyring struct {
 	// Configuration instance
 	Conf *PersistentConfiguration
 
+	// DMA buffer pool
+	Pool *pool.Pool
+
+	// Clock returns the time, in milliseconds since epoch, for audit log
+	// entries, the local clock is used when not set.
+	Clock func() int64
+
 	// long term BLE peer authentication keys
 	ArmoryLongterm *ecdsa.PrivateKey
 	MobileLongterm *ecdsa.PublicKey
@@ -55,6 +85,22 @@ type Keyring struct {
 	// BLE shared session key
 	sessionKey []byte
 
+	// BLE session protocol version
+	sessionVersion uint32
+	// BLE v2 session keys and ciphers, MD to UA (rx, opener) and UA to MD
+	// (tx, sealer)
+	rxKey  []byte
+	txKey  []byte
+	opener cipher.AEAD
+	sealer cipher.AEAD
+	// BLE v2 session keys following re-keying, pending their first use by
+	// the MD
+	nextRxKey []byte
+	nextTxKey []byte
+	// BLE v2 session message sequence numbers
+	rxSequence uint64
+	txSequence uint64
+
 	// CPU bound ESSIV cipher
 	cbiv cipher.Block
 	// CPU bound block cipher
@@ -66,6 +112,9 @@ type Keyring struct {
 	salt []byte
 	// persistent storage encryption key
 	snvs []byte
+
+	// audit log state
+	audit *auditLog
 }
 
 func (k *Keyring) Init(overwrite bool) (err error) {
@@ -76,6 +125,19 @@ func (k *Keyring) Init(overwrite bool) (err error) {
 
 	err = k.Load()
 
+	// the audit log is preserved across pairings
+	if k.audit == nil {
+		var next uint64
+
+		if err == nil {
+			next = k.Conf.LogNext
+		}
+
+		if err := k.initAudit(next); err != nil {
+			log.Printf("could not initialize audit log, %v", err)
+		}
+	}
+
 	if err != nil || overwrite {
 		err = k.reset()
 
@@ -181,7 +243,9 @@ func (k *Keyring) NewLongtermKey() (err error) {
 	return
 }
 
-func (k *Keyring) NewSessionKeys(nonce []byte) (err error) {
+// NewSessionKeys generates the UA ephemeral key and derives the session keys
+// for the negotiated protocol version.
+func (k *Keyring) NewSessionKeys(nonce []byte, version uint32) (err error) {
 	k.armoryEphemeral, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 
 	if err != nil {
@@ -197,8 +261,18 @@ func (k *Keyring) NewSessionKeys(nonce []byte) (err error) {
 
 	s, _ := k.mobileEphemeral.ScalarMult(peerX, peerY, privX)
 	shared := s.Bytes()
+	clear(privX)
 
 	copy(k.preMaster[len(k.preMaster)-len(shared):], shared)
+	clear(shared)
+
+	defer clear(k.preMaster)
+
+	k.sessionVersion = version
+
+	if version >= SESSION_V2 {
+		return k.newSessionV2(nonce)
+	}
 
 	hkdf := hkdf.New(sha256.New, k.preMaster, nonce, nil)
 
@@ -208,8 +282,24 @@ func (k *Keyring) NewSessionKeys(nonce []byte) (err error) {
 	return
 }
 
+// ClearSessionKeys zeroizes and discards the current session keys.
 func (k *Keyring) ClearSessionKeys() {
+	clear(k.sessionKey)
+	clear(k.preMaster)
+	clear(k.rxKey)
+	clear(k.txKey)
+	k.clearNextKeys()
+
+	if k.armoryEphemeral != nil {
+		clear(k.armoryEphemeral.D.Bits())
+	}
+
 	k.sessionKey = []byte{}
+	k.sessionVersion = 0
+	k.rxKey = nil
+	k.txKey = nil
+	k.opener = nil
+	k.sealer = nil
 	k.armoryEphemeral = nil
 	k.mobileEphemeral = nil
 }
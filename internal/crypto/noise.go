@@ -0,0 +1,144 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package crypto
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+
+	"github.com/usbarmory/armory-drive/internal/noise"
+)
+
+// NoiseSession processes a Noise KK session handshake message from the MD,
+// bound to the request timestamp, returning the handshake response.
+//
+// On success the UA and MD ephemeral keys are replaced with the handshake
+// ones and the transport keys are used as v2 session keys, on handshake
+// failure the current session is left unchanged.
+func (k *Keyring) NoiseSession(msg []byte, timestamp int64) (res []byte, err error) {
+	if k.ArmoryLongterm == nil || k.MobileLongterm == nil {
+		return nil, errors.New("missing long-term keys")
+	}
+
+	s, err := k.ArmoryLongterm.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	rs, err := k.MobileLongterm.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	// the UA ephemeral key is also used to sign in-session messages
+	armoryEphemeral, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		return
+	}
+
+	e, err := armoryEphemeral.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	hs, err := noise.NewHandshake(&noise.Config{
+		Pattern:    noise.KK,
+		Prologue:   binary.BigEndian.AppendUint64([]byte(noise.SESSION_PROLOGUE), uint64(timestamp)),
+		Static:     s,
+		Ephemeral:  e,
+		PeerStatic: rs,
+	})
+
+	if err != nil {
+		return
+	}
+
+	if _, err = hs.ReadMessage(msg); err != nil {
+		return
+	}
+
+	mobileEphemeral, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), hs.PeerEphemeral().Bytes())
+
+	if err != nil {
+		return
+	}
+
+	if res, err = hs.WriteMessage(nil); err != nil {
+		return
+	}
+
+	k1, k2, err := hs.Split()
+
+	if err != nil {
+		return
+	}
+
+	defer clear(k1)
+	defer clear(k2)
+
+	k.ClearSessionKeys()
+
+	k.armoryEphemeral = armoryEphemeral
+	k.mobileEphemeral = mobileEphemeral
+	k.sessionVersion = SESSION_V2
+	k.rxSequence = 0
+	k.txSequence = 0
+
+	err = k.setSessionKeys(k1, k2)
+
+	return
+}
+
+// NoisePairing processes a Noise IK pairing handshake message from the MD,
+// bound to the pairing nonce, returning the handshake response and the MD
+// long-term public key (DER).
+func (k *Keyring) NoisePairing(msg []byte, nonce uint64) (res []byte, mobileLongterm []byte, err error) {
+	if k.ArmoryLongterm == nil {
+		return nil, nil, errors.New("missing long-term key")
+	}
+
+	s, err := k.ArmoryLongterm.ECDH()
+
+	if err != nil {
+		return
+	}
+
+	hs, err := noise.NewHandshake(&noise.Config{
+		Pattern:  noise.IK,
+		Prologue: binary.BigEndian.AppendUint64([]byte(noise.PAIRING_PROLOGUE), nonce),
+		Static:   s,
+	})
+
+	if err != nil {
+		return
+	}
+
+	if _, err = hs.ReadMessage(msg); err != nil {
+		return
+	}
+
+	pubKey, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), hs.PeerStatic().Bytes())
+
+	if err != nil {
+		return
+	}
+
+	if mobileLongterm, err = x509.MarshalPKIXPublicKey(pubKey); err != nil {
+		return
+	}
+
+	res, err = hs.WriteMessage(nil)
+
+	return
+}
@@ -0,0 +1,19 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build tamago
+
+package crypto
+
+import (
+	"github.com/usbarmory/tamago/soc/nxp/imx6ul"
+
+	usbarmory "github.com/usbarmory/tamago/board/usbarmory/mk2"
+)
+
+var (
+	mmc Storage   = usbarmory.MMC
+	dcp KeyEngine = imx6ul.DCP
+)
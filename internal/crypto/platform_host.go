@@ -0,0 +1,22 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package crypto
+
+// The internal card and DCP are only available on the USB armory, host
+// builds are meant for test cases, which provide their own.
+var (
+	mmc Storage
+	dcp KeyEngine
+)
+
+// SetPlatform sets the internal card and DCP on host builds (e.g. see package
+// emulator).
+func SetPlatform(card Storage, engine KeyEngine) {
+	mmc = card
+	dcp = engine
+}
@@ -0,0 +1,260 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"github.com/usbarmory/armory-drive/api"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// BLE session protocol versions
+const (
+	SESSION_V1 = 1
+	SESSION_V2 = 2
+
+	// highest supported version
+	SESSION_VERSION = SESSION_V2
+)
+
+// HKDF info prefix for v2 session keys
+const SESSION_V2_INFO = "armory-drive session v2"
+
+// HKDF info for session keys rotation
+const REKEY_INFO = "armory-drive rekey"
+
+// ErrStale is returned for in-session messages which have already been
+// received, or are older than the last received one.
+var ErrStale = errors.New("stale message")
+
+// SessionVersion returns the protocol version of the current session.
+func (k *Keyring) SessionVersion() uint32 {
+	return k.sessionVersion
+}
+
+// transcript returns the v2 session handshake digest, binding ephemeral and
+// long-term keys of both parties to the session nonce.
+func (k *Keyring) transcript(nonce []byte) (sum []byte, err error) {
+	h := sha256.New()
+
+	for _, index := range []int{MD_EPHEMERAL_KEY, UA_EPHEMERAL_KEY, MD_LONGTERM_KEY, UA_LONGTERM_KEY} {
+		var der []byte
+
+		if der, err = k.Export(index, false); err != nil {
+			return
+		}
+
+		h.Write(der)
+	}
+
+	h.Write(nonce)
+
+	return h.Sum(nil), nil
+}
+
+func newGCM(key []byte) (aead cipher.AEAD, err error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// newSessionV2 derives per-direction v2 session keys from the pre-master
+// secret.
+func (k *Keyring) newSessionV2(nonce []byte) (err error) {
+	transcript, err := k.transcript(nonce)
+
+	if err != nil {
+		return
+	}
+
+	info := append([]byte(SESSION_V2_INFO), transcript...)
+	keys := make([]byte, 64)
+
+	if _, err = io.ReadFull(hkdf.New(sha256.New, k.preMaster, nonce, info), keys); err != nil {
+		return
+	}
+
+	defer clear(keys)
+
+	if err = k.setSessionKeys(keys[0:32], keys[32:64]); err != nil {
+		return
+	}
+
+	k.txSequence = 0
+	k.rxSequence = 0
+
+	return
+}
+
+// setSessionKeys sets the v2 session keys, respectively for MD to UA and UA
+// to MD messages.
+func (k *Keyring) setSessionKeys(rx []byte, tx []byte) (err error) {
+	if k.opener, err = newGCM(rx); err != nil {
+		return
+	}
+
+	if k.sealer, err = newGCM(tx); err != nil {
+		return
+	}
+
+	clear(k.rxKey)
+	clear(k.txKey)
+
+	k.rxKey = append([]byte{}, rx...)
+	k.txKey = append([]byte{}, tx...)
+
+	return
+}
+
+func rekey(key []byte, nonce []byte) (next []byte, err error) {
+	next = make([]byte, len(key))
+	_, err = io.ReadFull(hkdf.New(sha256.New, key, nonce, []byte(REKEY_INFO)), next)
+	return
+}
+
+// Rekey rotates the session keys, without ECDH renegotiation, by deriving
+// the next ones from the current ones and the nonce.
+//
+// The current keys are retained until a message from the MD is authenticated
+// with either generation, as the MD might not have received the nonce, the
+// unused generation is then zeroized.
+func (k *Keyring) Rekey(nonce []byte) (err error) {
+	if k.sessionVersion < SESSION_V2 || k.opener == nil {
+		return errors.New("re-keying requires an active v2 session")
+	}
+
+	k.clearNextKeys()
+
+	if k.nextRxKey, err = rekey(k.rxKey, nonce); err != nil {
+		return
+	}
+
+	k.nextTxKey, err = rekey(k.txKey, nonce)
+
+	return
+}
+
+func (k *Keyring) clearNextKeys() {
+	clear(k.nextRxKey)
+	clear(k.nextTxKey)
+
+	k.nextRxKey = nil
+	k.nextTxKey = nil
+}
+
+// openNext authenticates and decrypts a message with the keys pending after
+// re-keying, which replace the current ones on success.
+func (k *Keyring) openNext(msg *api.Message) (payload []byte, err error) {
+	opener, err := newGCM(k.nextRxKey)
+
+	if err != nil {
+		return
+	}
+
+	if payload, err = opener.Open(nil, gcmNonce(msg.Sequence), msg.Payload, additionalData(msg)); err != nil {
+		return
+	}
+
+	if err = k.setSessionKeys(k.nextRxKey, k.nextTxKey); err != nil {
+		return
+	}
+
+	k.clearNextKeys()
+
+	return
+}
+
+func gcmNonce(sequence uint64) (nonce []byte) {
+	nonce = make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], sequence)
+	return
+}
+
+// additionalData returns the message fields authenticated, along with the
+// encrypted payload, by v2 sessions.
+func additionalData(msg *api.Message) (buf []byte) {
+	buf = binary.BigEndian.AppendUint64(buf, uint64(msg.Timestamp))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(msg.OpCode))
+
+	if msg.Response {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+
+	buf = binary.BigEndian.AppendUint32(buf, uint32(msg.Error))
+
+	return binary.BigEndian.AppendUint64(buf, msg.Sequence)
+}
+
+// Seal assigns the next v2 session sequence number to a message, encrypting
+// and authenticating its payload along with its additional data.
+func (k *Keyring) Seal(msg *api.Message) (err error) {
+	if k.sealer == nil {
+		return errors.New("no active session")
+	}
+
+	if k.txSequence == math.MaxUint64 {
+		return errors.New("sequence exhausted")
+	}
+
+	k.txSequence += 1
+
+	msg.Sequence = k.txSequence
+	msg.Payload = k.sealer.Seal(nil, gcmNonce(msg.Sequence), msg.Payload, additionalData(msg))
+
+	return
+}
+
+// Open authenticates and decrypts a v2 session message payload, along with
+// its additional data, ErrStale is returned for sequence numbers not greater
+// than the last received one.
+//
+// After re-keying, messages are accepted with either key generation, the
+// first authenticated one determines the keys retained for the session.
+func (k *Keyring) Open(msg *api.Message) (err error) {
+	var payload []byte
+
+	if k.opener == nil {
+		return errors.New("no active session")
+	}
+
+	if msg.Sequence <= k.rxSequence {
+		return ErrStale
+	}
+
+	if k.nextRxKey != nil {
+		if payload, err = k.openNext(msg); err == nil {
+			msg.Payload = payload
+			k.rxSequence = msg.Sequence
+			return
+		}
+	}
+
+	if payload, err = k.opener.Open(nil, gcmNonce(msg.Sequence), msg.Payload, additionalData(msg)); err != nil {
+		return
+	}
+
+	// the MD did not re-key
+	k.clearNextKeys()
+
+	msg.Payload = payload
+	k.rxSequence = msg.Sequence
+
+	return
+}
@@ -0,0 +1,89 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package crypto
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// KEK verifier diversifier
+const KEK_DIV = "floppyKEK"
+
+// ErrInvalidKEK is returned when a KEK does not match the enrolled one.
+var ErrInvalidKEK = errors.New("invalid KEK")
+
+// KEKVerifier returns the verifier for a KEK, which is enrolled at the first
+// unlock following pairing (see EnrollKEK()).
+func (k *Keyring) KEKVerifier(kek []byte) (verifier []byte, err error) {
+	armoryLongterm, err := k.Export(UA_LONGTERM_KEY, false)
+
+	if err != nil {
+		return
+	}
+
+	mac := hmac.New(sha256.New, kek)
+	mac.Write([]byte(KEK_DIV))
+	mac.Write(armoryLongterm)
+
+	return mac.Sum(nil), nil
+}
+
+// KEKEnrolled returns whether a KEK verifier is available to detect invalid
+// KEKs.
+func (k *Keyring) KEKEnrolled() bool {
+	return len(k.Conf.UnlockVerifier) > 0
+}
+
+// EnrollKEK sets the verifier (see KEKVerifier()) for the KEK of the first
+// unlock following pairing, the persistent configuration must then be saved.
+func (k *Keyring) EnrollKEK(verifier []byte) {
+	k.Conf.UnlockVerifier = verifier
+}
+
+// VerifyKEK returns ErrInvalidKEK if the KEK does not match the enrolled
+// verifier.
+func (k *Keyring) VerifyKEK(kek []byte) (err error) {
+	if !k.KEKEnrolled() {
+		return errors.New("no enrolled KEK")
+	}
+
+	verifier, err := k.KEKVerifier(kek)
+
+	if err != nil {
+		return
+	}
+
+	if !hmac.Equal(verifier, k.Conf.UnlockVerifier) {
+		return ErrInvalidKEK
+	}
+
+	return
+}
+
+// Wipe discards the block key secret, making encrypted storage
+// unrecoverable, as well as all pairing keys and settings. The UA long-term
+// key is replaced and the device must be paired again.
+//
+// Pairings predating the block key secret introduction are only diversified
+// by the UA long-term public key, its replacement prevents further
+// derivation of the previous block key on this device.
+func (k *Keyring) Wipe() (err error) {
+	if k.Conf != nil {
+		clear(k.Conf.BlockKeySecret)
+		clear(k.Conf.UnlockVerifier)
+	}
+
+	if k.ArmoryLongterm != nil {
+		clear(k.ArmoryLongterm.D.Bits())
+	}
+
+	k.ArmoryLongterm = nil
+	k.MobileLongterm = nil
+
+	return k.Init(true)
+}
@@ -0,0 +1,163 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package crypto
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"testing"
+
+	"github.com/usbarmory/armory-drive/api"
+)
+
+func TestKEKVerifier(t *testing.T) {
+	k := newTestKeyring(t, newTestCard())
+	kek := bytes.Repeat([]byte{0x4b}, 32)
+
+	verifier, err := k.KEKVerifier(kek)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v, _ := k.KEKVerifier(kek); !bytes.Equal(v, verifier) {
+		t.Fatal("verifier not deterministic")
+	}
+
+	if v, _ := k.KEKVerifier(kek[1:]); bytes.Equal(v, verifier) {
+		t.Fatal("verifier not bound to KEK")
+	}
+
+	if k.KEKEnrolled() {
+		t.Fatal("KEK enrolled on initialization")
+	}
+
+	if err = k.VerifyKEK(kek); err == nil || errors.Is(err, ErrInvalidKEK) {
+		t.Fatalf("unexpected error without enrollment %v", err)
+	}
+
+	k.EnrollKEK(verifier)
+
+	if err = k.VerifyKEK(kek); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = k.VerifyKEK(kek[1:]); !errors.Is(err, ErrInvalidKEK) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// the verifier is bound to the UA long-term key
+	if err = k.NewLongtermKey(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = k.VerifyKEK(kek); !errors.Is(err, ErrInvalidKEK) {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
+
+func TestWipe(t *testing.T) {
+	card := newTestCard()
+	k := newTestKeyring(t, card)
+	kek := bytes.Repeat([]byte{0x4b}, 32)
+
+	verifier, err := k.KEKVerifier(kek)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	k.EnrollKEK(verifier)
+	k.Conf.UnlockFailures = 3
+	k.Conf.MobileLongterm, _ = k.Export(UA_LONGTERM_KEY, false)
+
+	if err = k.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	k.Audit(api.LogEvent_WIPED, "")
+
+	armoryLongterm := k.Conf.ArmoryLongterm
+	blockKeySecret := bytes.Clone(k.Conf.BlockKeySecret)
+
+	if err = k.Wipe(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reboot
+	k = newTestKeyring(t, card)
+	conf := k.Conf
+
+	if bytes.Equal(conf.ArmoryLongterm, armoryLongterm) {
+		t.Error("UA long-term key not replaced")
+	}
+
+	if len(conf.BlockKeySecret) == 0 || bytes.Equal(conf.BlockKeySecret, blockKeySecret) {
+		t.Error("block key secret not replaced")
+	}
+
+	if k.KEKEnrolled() || conf.UnlockFailures != 0 || len(conf.MobileLongterm) != 0 || k.MobileLongterm != nil {
+		t.Error("configuration not reset")
+	}
+
+	// the audit log survives the wipe
+	if conf.LogNext != 1 {
+		t.Errorf("log head %d, expected 1", conf.LogNext)
+	}
+}
+
+// legacyConfiguration mirrors the persistent configuration of revisions
+// enrolling the KEK verifier from decrypted volume content.
+type legacyConfiguration struct {
+	ArmoryLongterm []byte
+	Settings       *api.Configuration
+	UnlockFailures int
+	KEKVerifier    []byte
+}
+
+func TestLegacyKEKVerifier(t *testing.T) {
+	card := newTestCard()
+	k := newTestKeyring(t, card)
+
+	conf := &legacyConfiguration{
+		ArmoryLongterm: k.Conf.ArmoryLongterm,
+		Settings:       &api.Configuration{UnlockWipeThreshold: 1},
+		UnlockFailures: 1,
+		KEKVerifier:    bytes.Repeat([]byte{0xaa}, 32),
+	}
+
+	buf := new(bytes.Buffer)
+
+	if err := gob.NewEncoder(buf).Encode(conf); err != nil {
+		t.Fatal(err)
+	}
+
+	snvs, err := k.encryptSNVS(buf.Bytes(), CONF_BLOCKS_V2*card.Info().BlockSize)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = card.WriteBlocks(MMC_CONF_BLOCK, snvs); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = k.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if k.Conf.UnlockFailures != 1 || k.Conf.Settings.UnlockWipeThreshold != 1 {
+		t.Fatalf("unexpected configuration %+v", k.Conf)
+	}
+
+	// a heuristic verifier must never reject, and wipe keys on, any KEK
+	if k.KEKEnrolled() {
+		t.Fatal("legacy KEK verifier enrolled")
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package edm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+)
+
+// AT_TIMEOUT is the default maximum time for AT command responses.
+const AT_TIMEOUT = 5 * time.Second
+
+// ErrAT is returned for AT commands terminated with an error result code.
+var ErrAT = errors.New("AT command error")
+
+var resultError = []byte("\r\nERROR\r\n")
+
+// WaitFor reads from the transport, in AT command mode, until the received
+// data matches the argument pattern or the timeout expires. An error is
+// returned if an ERROR result code is received before a match.
+func WaitFor(t Transport, pattern *regexp.Regexp, timeout time.Duration) (match [][]byte, err error) {
+	var buf []byte
+
+	c := make([]byte, 1)
+
+	if err = t.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return
+	}
+
+	defer t.SetReadDeadline(time.Time{})
+
+	for len(match) == 0 {
+		if _, err = t.Read(c); err != nil {
+			return
+		}
+
+		buf = append(buf, c[0])
+
+		if match = pattern.FindSubmatch(buf); len(match) != 0 {
+			break
+		}
+
+		if bytes.HasSuffix(buf, resultError) {
+			return nil, ErrAT
+		}
+	}
+
+	return
+}
+
+// Command issues an AT command, in AT command mode, and waits for a
+// response matching the argument pattern.
+func Command(t Transport, cmd string, pattern *regexp.Regexp, timeout time.Duration) (match [][]byte, err error) {
+	if _, err = t.Write([]byte(cmd + "\r")); err != nil {
+		return
+	}
+
+	if match, err = WaitFor(t, pattern, timeout); err != nil {
+		return nil, fmt.Errorf("%s, %w", cmd, err)
+	}
+
+	return
+}
+
+// Result parses an AT command response, returning its information text
+// without the final result code.
+func Result(res []byte) (info []byte, err error) {
+	res = bytes.TrimSpace(res)
+
+	switch {
+	case bytes.HasSuffix(res, []byte("ERROR")):
+		return nil, ErrAT
+	case bytes.HasSuffix(res, []byte("OK")):
+		res = bytes.TrimSpace(bytes.TrimSuffix(res, []byte("OK")))
+	}
+
+	return res, nil
+}
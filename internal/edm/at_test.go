@@ -0,0 +1,118 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package edm
+
+import (
+	"bytes"
+	"errors"
+	"regexp"
+	"testing"
+	"time"
+)
+
+// testTransport returns scripted responses, timing out once exhausted.
+type testTransport struct {
+	rx       []byte
+	tx       []byte
+	deadline time.Time
+}
+
+func (t *testTransport) Read(buf []byte) (n int, err error) {
+	if len(t.rx) == 0 {
+		if t.deadline.IsZero() {
+			return 0, errors.New("read without deadline")
+		}
+
+		return 0, ErrTimeout
+	}
+
+	n = copy(buf, t.rx)
+	t.rx = t.rx[n:]
+
+	return
+}
+
+func (t *testTransport) Write(buf []byte) (int, error) {
+	t.tx = append(t.tx, buf...)
+	return len(buf), nil
+}
+
+func (t *testTransport) SetReadDeadline(deadline time.Time) error {
+	t.deadline = deadline
+	return nil
+}
+
+var testPattern = regexp.MustCompile(`\+UBTLN:"(.*)"\r\nOK\r\n`)
+
+func TestCommand(t *testing.T) {
+	tr := &testTransport{
+		rx: []byte("\r\n+STARTUP\r\n\r\n+UBTLN:\"armory\"\r\nOK\r\n"),
+	}
+
+	match, err := Command(tr, "AT+UBTLN?", testPattern, time.Second)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(match[1]) != "armory" {
+		t.Errorf("unexpected match %q", match[1])
+	}
+
+	if string(tr.tx) != "AT+UBTLN?\r" {
+		t.Errorf("unexpected command %q", tr.tx)
+	}
+
+	if !tr.deadline.IsZero() {
+		t.Error("read deadline not cleared")
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	tr := &testTransport{
+		rx: []byte("\r\nERROR\r\n\r\n+UBTLN:\"armory\"\r\nOK\r\n"),
+	}
+
+	if _, err := Command(tr, "AT+UBTLN?", testPattern, time.Second); !errors.Is(err, ErrAT) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	// data following the result code is not consumed
+	if len(tr.rx) == 0 {
+		t.Error("data consumed after error")
+	}
+
+	tr = &testTransport{
+		rx: []byte("\r\n+UBTLN:\"arm"),
+	}
+
+	if _, err := Command(tr, "AT+UBTLN?", testPattern, time.Second); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if !tr.deadline.IsZero() {
+		t.Error("read deadline not cleared")
+	}
+}
+
+func TestResult(t *testing.T) {
+	for _, tc := range []struct {
+		res  string
+		info string
+		err  error
+	}{
+		{"\r\nOK\r\n", "", nil},
+		{"\r\n+UBTRSS:-42\r\nOK\r\n", "+UBTRSS:-42", nil},
+		{"\r\n+UBTRSS:-42\r\n", "+UBTRSS:-42", nil},
+		{"\r\nERROR\r\n", "", ErrAT},
+	} {
+		info, err := Result([]byte(tc.res))
+
+		if !errors.Is(err, tc.err) || !bytes.Equal(info, []byte(tc.info)) {
+			t.Errorf("%q: unexpected result %q, %v", tc.res, info, err)
+		}
+	}
+}
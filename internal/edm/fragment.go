@@ -0,0 +1,149 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package edm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// Packet                      (4 bytes + []byte) max: 251
+	//   Data Event | Data Command (3 bytes + []byte) max: 247
+	//      Fragment               (2 bytes + []byte) max: 244
+	//        protobuf                                max: 242
+
+	FRAGMENT_MAX_LENGTH = 244
+	PROTOBUF_MAX_LENGTH = 242
+
+	// maximum size of a fragmented message, in either direction
+	MESSAGE_MAX_LENGTH = 32 * 1024
+	// maximum time between the first and last fragment of a message
+	REASSEMBLY_TIMEOUT = 10 * time.Second
+)
+
+// Fragment represents a message fragment carried by EDM Data Events and
+// Commands.
+type Fragment struct {
+	Total uint8
+	Seq   uint8
+	Data  []byte
+}
+
+func (frg *Fragment) Parse(data []byte) (err error) {
+	if len(data) < 2 {
+		return errors.New("invalid fragment length")
+	}
+
+	frg.Total = uint8(data[0])
+	frg.Seq = uint8(data[1])
+	frg.Data = data[2:]
+
+	return
+}
+
+func (frg *Fragment) Bytes() []byte {
+	buf := new(bytes.Buffer)
+
+	buf.WriteByte(frg.Total)
+	buf.WriteByte(frg.Seq)
+	buf.Write(frg.Data)
+
+	return buf.Bytes()
+}
+
+// reassembly represents a partially received message.
+type reassembly struct {
+	total    uint8
+	seq      uint8
+	data     []byte
+	deadline time.Time
+}
+
+// Reassembler tracks fragmented messages on each EDM channel.
+type Reassembler struct {
+	channels map[uint8]*reassembly
+}
+
+func NewReassembler() *Reassembler {
+	return &Reassembler{
+		channels: make(map[uint8]*reassembly),
+	}
+}
+
+// Add processes a message fragment received on a given channel, the message
+// is returned once all its fragments have been received in sequence.
+//
+// Any invalid fragment discards the partial message, which must then be
+// transmitted again from its first fragment.
+func (r *Reassembler) Add(channel uint8, frg *Fragment) (msg []byte, err error) {
+	if frg.Total == 0 || frg.Seq == 0 || frg.Seq > frg.Total {
+		r.Drop(channel)
+		return nil, fmt.Errorf("invalid fragment %d/%d", frg.Seq, frg.Total)
+	}
+
+	if frg.Seq == 1 {
+		r.channels[channel] = &reassembly{
+			total:    frg.Total,
+			deadline: time.Now().Add(REASSEMBLY_TIMEOUT),
+		}
+	}
+
+	m, ok := r.channels[channel]
+
+	switch {
+	case !ok:
+		return nil, fmt.Errorf("fragment %d/%d without message start", frg.Seq, frg.Total)
+	case time.Now().After(m.deadline):
+		err = errors.New("message reassembly timeout")
+	case frg.Total != m.total || frg.Seq != m.seq+1:
+		err = fmt.Errorf("out of sequence fragment %d/%d", frg.Seq, frg.Total)
+	case len(m.data)+len(frg.Data) > MESSAGE_MAX_LENGTH:
+		err = errors.New("message exceeds maximum length")
+	}
+
+	if err != nil {
+		r.Drop(channel)
+		return
+	}
+
+	m.seq = frg.Seq
+	m.data = append(m.data, frg.Data...)
+
+	if m.seq == m.total {
+		msg = m.data
+		r.Drop(channel)
+	}
+
+	return
+}
+
+// Drop discards any partial message received on a given channel.
+func (r *Reassembler) Drop(channel uint8) {
+	delete(r.channels, channel)
+}
+
+// Split splits a message in fragments fitting a single EDM packet.
+func Split(msg []byte) (fragments []*Fragment, err error) {
+	if len(msg) > MESSAGE_MAX_LENGTH {
+		return nil, errors.New("message exceeds maximum length")
+	}
+
+	for i := 0; i < len(msg); i += PROTOBUF_MAX_LENGTH {
+		fragments = append(fragments, &Fragment{
+			Data: msg[i:min(i+PROTOBUF_MAX_LENGTH, len(msg))],
+		})
+	}
+
+	for i, frg := range fragments {
+		frg.Total = uint8(len(fragments))
+		frg.Seq = uint8(i + 1)
+	}
+
+	return
+}
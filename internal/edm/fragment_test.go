@@ -0,0 +1,172 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package edm
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestFragment(t *testing.T) {
+	frg := &Fragment{}
+
+	if err := frg.Parse([]byte{0x01}); err == nil {
+		t.Error("short fragment parsed")
+	}
+
+	if err := frg.Parse([]byte{0x02, 0x01, 0x0a}); err != nil {
+		t.Fatal(err)
+	}
+
+	if frg.Total != 2 || frg.Seq != 1 || !bytes.Equal(frg.Data, []byte{0x0a}) {
+		t.Errorf("unexpected fragment %+v", frg)
+	}
+
+	if !bytes.Equal(frg.Bytes(), []byte{0x02, 0x01, 0x0a}) {
+		t.Errorf("unexpected fragment encoding %x", frg.Bytes())
+	}
+}
+
+func TestSplit(t *testing.T) {
+	for _, size := range []int{0, 1, PROTOBUF_MAX_LENGTH, PROTOBUF_MAX_LENGTH + 1, MESSAGE_MAX_LENGTH} {
+		msg := make([]byte, size)
+
+		for i := range msg {
+			msg[i] = byte(i)
+		}
+
+		fragments, err := Split(msg)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n := (size + PROTOBUF_MAX_LENGTH - 1) / PROTOBUF_MAX_LENGTH; len(fragments) != n {
+			t.Fatalf("size %d: %d fragments, expected %d", size, len(fragments), n)
+		}
+
+		r := NewReassembler()
+		var res []byte
+
+		for _, frg := range fragments {
+			if len(frg.Bytes()) > FRAGMENT_MAX_LENGTH {
+				t.Fatalf("size %d: fragment exceeds maximum length", size)
+			}
+
+			if res, err = r.Add(0, frg); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if !bytes.Equal(res, msg) {
+			t.Errorf("size %d: reassembled message mismatch", size)
+		}
+	}
+
+	if _, err := Split(make([]byte, MESSAGE_MAX_LENGTH+1)); err == nil {
+		t.Error("oversized message split")
+	}
+}
+
+func TestReassembler(t *testing.T) {
+	r := NewReassembler()
+
+	add := func(channel uint8, total uint8, seq uint8, data string) (string, error) {
+		msg, err := r.Add(channel, &Fragment{Total: total, Seq: seq, Data: []byte(data)})
+		return string(msg), err
+	}
+
+	// interleaved channels
+	for _, f := range []struct {
+		channel uint8
+		seq     uint8
+		data    string
+		msg     string
+	}{
+		{1, 1, "a", ""},
+		{2, 1, "c", ""},
+		{1, 2, "b", "ab"},
+		{2, 2, "d", "cd"},
+	} {
+		if msg, err := add(f.channel, 2, f.seq, f.data); err != nil || msg != f.msg {
+			t.Fatalf("unexpected result %q, %v", msg, err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name      string
+		fragments [][2]uint8
+	}{
+		{"invalid total", [][2]uint8{{0, 1}}},
+		{"invalid sequence", [][2]uint8{{2, 0}}},
+		{"sequence exceeding total", [][2]uint8{{2, 3}}},
+		{"without start", [][2]uint8{{2, 2}}},
+		{"out of sequence", [][2]uint8{{3, 1}, {3, 3}}},
+		{"duplicate", [][2]uint8{{3, 1}, {3, 2}, {3, 2}}},
+		{"total mismatch", [][2]uint8{{3, 1}, {2, 2}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var err error
+
+			for _, f := range tc.fragments {
+				_, err = add(1, f[0], f[1], "x")
+			}
+
+			if err == nil {
+				t.Fatal("invalid fragment accepted")
+			}
+
+			// the partial message is discarded
+			if _, err = add(1, 3, 3, "x"); err == nil {
+				t.Fatal("partial message retained")
+			}
+		})
+	}
+
+	// a first fragment restarts reassembly
+	add(1, 2, 1, "x")
+
+	if msg, err := add(1, 1, 1, "a"); err != nil || msg != "a" {
+		t.Fatalf("unexpected result %q, %v", msg, err)
+	}
+
+	// dropped channel
+	add(1, 2, 1, "a")
+	r.Drop(1)
+
+	if _, err := add(1, 2, 2, "b"); err == nil {
+		t.Fatal("fragment accepted after drop")
+	}
+}
+
+func TestReassemblerLimits(t *testing.T) {
+	r := NewReassembler()
+	data := make([]byte, MESSAGE_MAX_LENGTH/2+1)
+
+	if _, err := r.Add(1, &Fragment{Total: 2, Seq: 1, Data: data}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.Add(1, &Fragment{Total: 2, Seq: 2, Data: data}); err == nil {
+		t.Fatal("oversized message reassembled")
+	}
+
+	if _, err := r.Add(1, &Fragment{Total: 2, Seq: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// expire the reassembly deadline
+	r.channels[1].deadline = time.Now().Add(-time.Second)
+
+	if _, err := r.Add(1, &Fragment{Total: 2, Seq: 2}); err == nil {
+		t.Fatal("expired message reassembled")
+	}
+
+	if _, ok := r.channels[1]; ok {
+		t.Fatal("expired message retained")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package edm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzDecoder(f *testing.F) {
+	pkt := &Packet{}
+	pkt.SetDefaults()
+	pkt.SetPayload([]byte{0x00, 0x31, 0x01, 0x01, 0x01, 0x0a})
+
+	f.Add(pkt.Bytes(), 3)
+	f.Add(append([]byte{0x55, START, 0x00}, pkt.Bytes()...), 1)
+	f.Add([]byte{START, 0x00, 0x00, STOP}, 4)
+	f.Add([]byte{START, 0xff, 0xff, STOP}, 2)
+
+	f.Fuzz(func(t *testing.T, stream []byte, chunk int) {
+		dec := &Decoder{}
+		chunk = max(chunk, 1)
+
+		for i := 0; i < len(stream); i += chunk {
+			dec.Write(stream[i:min(i+chunk, len(stream))])
+
+			for payload, ok := dec.Next(); ok; payload, ok = dec.Next() {
+				if len(payload) == 0 || len(payload) > PAYLOAD_MAX_LENGTH {
+					t.Fatalf("invalid payload length %d", len(payload))
+				}
+
+				// decoded packets must be decoded identically once
+				// re-encoded
+				pkt := &Packet{}
+				pkt.SetDefaults()
+				pkt.SetPayload(payload)
+
+				d := &Decoder{}
+				d.Write(pkt.Bytes())
+
+				if res, ok := d.Next(); !ok || !bytes.Equal(res, payload) {
+					t.Fatalf("packet mismatch")
+				}
+			}
+		}
+	})
+}
+
+func FuzzReassembler(f *testing.F) {
+	f.Add([]byte{0, 1, 1, 'a'})
+	f.Add([]byte{0, 2, 1, 'a', 0, 2, 2, 'b'})
+	f.Add([]byte{0, 2, 1, 'a', 1, 2, 1, 'c', 0, 2, 2, 'b', 1, 2, 2, 'd'})
+	f.Add([]byte{0, 2, 2, 'b'})
+	f.Add([]byte{0, 0, 0})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := NewReassembler()
+
+		// each fragment is encoded as channel, total, sequence and a
+		// data byte
+		for i := 0; i+3 < len(data); i += 4 {
+			frg := &Fragment{}
+
+			if err := frg.Parse(data[i+1 : i+4]); err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := r.Add(data[i], frg)
+
+			if err != nil && msg != nil {
+				t.Fatalf("message returned with error")
+			}
+
+			if len(msg) > int(frg.Total) {
+				t.Fatalf("invalid message length %d", len(msg))
+			}
+		}
+	})
+}
+
+func FuzzSplit(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("armory"))
+	f.Add(bytes.Repeat([]byte{0xaa}, PROTOBUF_MAX_LENGTH+1))
+
+	f.Fuzz(func(t *testing.T, msg []byte) {
+		fragments, err := Split(msg)
+
+		if err != nil {
+			if len(msg) <= MESSAGE_MAX_LENGTH {
+				t.Fatal(err)
+			}
+
+			return
+		}
+
+		r := NewReassembler()
+
+		for i, frg := range fragments {
+			parsed := &Fragment{}
+
+			if err = parsed.Parse(frg.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+
+			res, err := r.Add(0, parsed)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if i == len(fragments)-1 && !bytes.Equal(res, msg) {
+				t.Fatalf("message mismatch")
+			}
+		}
+	})
+}
+
+func FuzzResult(f *testing.F) {
+	f.Add([]byte("\r\n+UBTLN:\"UA\"\r\nOK\r\n"))
+	f.Add([]byte("\r\nERROR\r\n"))
+	f.Add([]byte("OK"))
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, res []byte) {
+		info, err := Result(res)
+
+		if err == nil && len(info) > len(res) {
+			t.Fatalf("invalid information text")
+		}
+	})
+}
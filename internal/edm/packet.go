@@ -0,0 +1,103 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package edm
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+const (
+	START = 0xAA
+	STOP  = 0x55
+
+	// maximum packet payload length
+	PAYLOAD_MAX_LENGTH = 247
+)
+
+type Packet struct {
+	Start   uint8
+	Length  uint16
+	Payload []byte
+	Stop    uint8
+}
+
+func (pkt *Packet) SetDefaults() {
+	pkt.Start = START
+	pkt.Stop = STOP
+}
+
+func (pkt *Packet) SetPayload(buf []byte) {
+	pkt.Length = uint16(len(buf))
+	pkt.Payload = buf
+}
+
+func (pkt *Packet) Bytes() []byte {
+	buf := new(bytes.Buffer)
+
+	binary.Write(buf, binary.BigEndian, pkt.Start)
+	binary.Write(buf, binary.BigEndian, pkt.Length)
+	buf.Write(pkt.Payload)
+	binary.Write(buf, binary.BigEndian, pkt.Stop)
+
+	return buf.Bytes()
+}
+
+// Decoder extracts packet payloads from a received byte stream, resuming
+// from the following start byte whenever invalid framing is detected.
+type Decoder struct {
+	buf []byte
+}
+
+// Write appends received data to the decoder buffer.
+func (d *Decoder) Write(p []byte) (n int, err error) {
+	d.buf = append(d.buf, p...)
+	return len(p), nil
+}
+
+// Next returns the payload of the next complete packet, if available. The
+// payload is valid only until the next Write.
+func (d *Decoder) Next() (payload []byte, ok bool) {
+	for {
+		// look for the beginning of packet
+		i := bytes.IndexByte(d.buf, START)
+
+		if i < 0 {
+			d.buf = d.buf[:0]
+			return
+		}
+
+		d.buf = d.buf[i:]
+
+		if len(d.buf) < 3 {
+			return
+		}
+
+		length := int(binary.BigEndian.Uint16(d.buf[1:3]))
+
+		if length == 0 || length > PAYLOAD_MAX_LENGTH {
+			d.buf = d.buf[1:]
+			continue
+		}
+
+		// from payload length to packet length
+		length += 4
+
+		if len(d.buf) < length {
+			return
+		}
+
+		if d.buf[length-1] != STOP {
+			d.buf = d.buf[1:]
+			continue
+		}
+
+		payload = d.buf[3 : length-1]
+		d.buf = d.buf[length:]
+
+		return payload, true
+	}
+}
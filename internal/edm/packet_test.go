@@ -0,0 +1,77 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package edm
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testPacket(payload []byte) []byte {
+	pkt := &Packet{}
+	pkt.SetDefaults()
+	pkt.SetPayload(payload)
+
+	return pkt.Bytes()
+}
+
+func TestPacket(t *testing.T) {
+	buf := testPacket([]byte{0x00, 0x71})
+
+	if !bytes.Equal(buf, []byte{START, 0x00, 0x02, 0x00, 0x71, STOP}) {
+		t.Errorf("unexpected packet %x", buf)
+	}
+}
+
+// decode returns all payloads decoded from a stream, written in chunks.
+func decode(stream []byte, chunk int) (payloads [][]byte) {
+	dec := &Decoder{}
+
+	for i := 0; i < len(stream); i += chunk {
+		dec.Write(stream[i:min(i+chunk, len(stream))])
+
+		for payload, ok := dec.Next(); ok; payload, ok = dec.Next() {
+			payloads = append(payloads, bytes.Clone(payload))
+		}
+	}
+
+	return
+}
+
+func TestDecoder(t *testing.T) {
+	a := []byte{0x00, 0x31, 0x01, 0x01, 0x01, 0x0a}
+	b := bytes.Repeat([]byte{START}, PAYLOAD_MAX_LENGTH)
+
+	for _, tc := range []struct {
+		name     string
+		stream   []byte
+		payloads [][]byte
+	}{
+		{"single", testPacket(a), [][]byte{a}},
+		{"multiple", append(testPacket(a), testPacket(b)...), [][]byte{a, b}},
+		{"leading garbage", append([]byte{0x00, STOP, 0x01}, testPacket(a)...), [][]byte{a}},
+		{"empty payload", append([]byte{START, 0x00, 0x00, STOP}, testPacket(a)...), [][]byte{a}},
+		{"invalid length", append([]byte{START, 0x00, PAYLOAD_MAX_LENGTH + 1}, testPacket(a)...), [][]byte{a}},
+		{"missing stop", append(testPacket(a)[:len(a)+3], testPacket(b)...), [][]byte{b}},
+		{"truncated", testPacket(a)[:len(a)+3], nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, chunk := range []int{1, 2, 7, len(tc.stream)} {
+				payloads := decode(tc.stream, chunk)
+
+				if len(payloads) != len(tc.payloads) {
+					t.Fatalf("chunk %d: %d payloads, expected %d", chunk, len(payloads), len(tc.payloads))
+				}
+
+				for i := range payloads {
+					if !bytes.Equal(payloads[i], tc.payloads[i]) {
+						t.Fatalf("chunk %d: payload %d mismatch %x", chunk, i, payloads[i])
+					}
+				}
+			}
+		})
+	}
+}
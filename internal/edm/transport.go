@@ -0,0 +1,34 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package edm implements the u-connectXpress Extended Data Mode (EDM)
+// framing, as well as AT command exchanges, towards u-blox modules.
+//
+// The package is independent from the underlying hardware, which is accessed
+// through the Transport interface.
+package edm
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrTimeout is returned when a read deadline expires.
+var ErrTimeout = errors.New("timeout")
+
+// Transport represents the byte stream towards a u-blox module.
+type Transport interface {
+	// Read blocks until at least one byte is received, or until the read
+	// deadline expires, in which case ErrTimeout is returned.
+	io.Reader
+
+	// Write transmits all bytes, honoring flow control.
+	io.Writer
+
+	// SetReadDeadline sets the deadline for subsequent Read calls, a zero
+	// value disables it.
+	SetReadDeadline(t time.Time) error
+}
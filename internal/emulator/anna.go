@@ -0,0 +1,407 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package emulator
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/usbarmory/armory-drive/internal/edm"
+)
+
+const (
+	// u-connectXpress Extended Data Mode packet identifiers
+	connectEvent    = 0x11
+	disconnectEvent = 0x21
+	dataEvent       = 0x31
+	dataCommand     = 0x36
+	atRequest       = 0x44
+	atConfirmation  = 0x45
+	startEvent      = 0x71
+
+	// Bluetooth connection, Bluetooth Low Energy profile
+	connectionBluetooth = 0x01
+	profileGATT         = 0x0e
+	// maximum frame size
+	frameSize = 244
+)
+
+// DefaultName is the local name reported by NewANNA instances.
+const DefaultName = "UA-EMULATOR"
+
+// Message represents a message received from the host, reassembled from its
+// EDM Data Command fragments.
+type Message struct {
+	Channel uint8
+	Data    []byte
+}
+
+// ANNA emulates a u-blox ANNA-B112 BLE module, running u-connectXpress, as
+// seen by its host through an edm.Transport.
+//
+// The module starts in AT command mode and enters Extended Data Mode on ATO2,
+// AT commands are answered by a script, which test cases can override to
+// inject errors or timeouts. Remote devices are represented by EDM channels
+// on which messages are exchanged with Connect, Send, Receive and Disconnect.
+type ANNA struct {
+	sync.Mutex
+
+	// Handler, when set, is invoked, with the module lock held, for each AT
+	// command, returning its full response (e.g. "\r\nERROR\r\n"), a nil
+	// value suppresses the response, while ok set to false falls back to
+	// the default script.
+	Handler func(cmd string) (res []byte, ok bool)
+
+	name string
+	edm  bool
+
+	// received commands
+	commands []string
+	// partial AT command, in AT command mode
+	line []byte
+
+	// module to host data
+	rx       []byte
+	rxReady  chan struct{}
+	deadline time.Time
+
+	// host to module data, in Extended Data Mode
+	dec       edm.Decoder
+	fragments *edm.Reassembler
+
+	// messages received from the host
+	messages []*Message
+	msgReady chan struct{}
+
+	closed bool
+}
+
+// NewANNA returns an emulated module, Start must be invoked to signal its
+// startup to the host.
+func NewANNA() *ANNA {
+	return &ANNA{
+		name:      DefaultName,
+		rxReady:   make(chan struct{}, 1),
+		fragments: edm.NewReassembler(),
+		msgReady:  make(chan struct{}, 1),
+	}
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// tx queues data towards the host, the lock must be held.
+func (m *ANNA) tx(buf []byte) {
+	m.rx = append(m.rx, buf...)
+	signal(m.rxReady)
+}
+
+// txPayload queues an EDM packet towards the host, the lock must be held.
+func (m *ANNA) txPayload(kind uint16, payload []byte) {
+	pkt := &edm.Packet{}
+	pkt.SetDefaults()
+	pkt.SetPayload(append(binary.BigEndian.AppendUint16(nil, kind), payload...))
+
+	m.tx(pkt.Bytes())
+}
+
+// Start signals the module startup, reported with +STARTUP in AT command mode
+// and with a Start Event in Extended Data Mode.
+func (m *ANNA) Start() {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.edm {
+		m.txPayload(startEvent, nil)
+		return
+	}
+
+	m.tx([]byte("\r\n+STARTUP\r\n"))
+}
+
+// Restart emulates a module reset, in Extended Data Mode, which drops all
+// connections and restores the default local name.
+func (m *ANNA) Restart() {
+	m.Lock()
+	m.name = DefaultName
+	m.fragments = edm.NewReassembler()
+	m.Unlock()
+
+	m.Start()
+}
+
+// Name returns the module local name.
+func (m *ANNA) Name() string {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.name
+}
+
+// Commands returns the AT commands received from the host.
+func (m *ANNA) Commands() []string {
+	m.Lock()
+	defer m.Unlock()
+
+	return append([]string{}, m.commands...)
+}
+
+// EDM returns whether the module is in Extended Data Mode.
+func (m *ANNA) EDM() bool {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.edm
+}
+
+// Inject queues raw data towards the host.
+func (m *ANNA) Inject(buf []byte) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.tx(buf)
+}
+
+// Event queues an EDM packet, with the given identifier and payload, towards
+// the host.
+func (m *ANNA) Event(kind uint16, payload []byte) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.txPayload(kind, payload)
+}
+
+// Connect reports a BLE connection, from a device with the given address, on
+// an EDM channel.
+func (m *ANNA) Connect(channel uint8, addr [6]byte) {
+	buf := []byte{channel, connectionBluetooth, profileGATT}
+	buf = append(buf, addr[:]...)
+	buf = binary.BigEndian.AppendUint16(buf, frameSize)
+
+	m.Event(connectEvent, buf)
+}
+
+// Disconnect reports the termination of the connection on an EDM channel.
+func (m *ANNA) Disconnect(channel uint8) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.fragments.Drop(channel)
+	m.txPayload(disconnectEvent, []byte{channel})
+}
+
+// Send transmits a message to the host, over an EDM channel, as a sequence of
+// fragments.
+func (m *ANNA) Send(channel uint8, msg []byte) (err error) {
+	fragments, err := edm.Split(msg)
+
+	if err != nil {
+		return
+	}
+
+	for _, frg := range fragments {
+		m.Event(dataEvent, append([]byte{channel}, frg.Bytes()...))
+	}
+
+	return
+}
+
+// Receive returns the next message received from the host, or an error if
+// none is received before the timeout expires.
+func (m *ANNA) Receive(timeout time.Duration) (msg *Message, err error) {
+	deadline := time.After(timeout)
+
+	for {
+		m.Lock()
+
+		if len(m.messages) > 0 {
+			msg = m.messages[0]
+			m.messages = m.messages[1:]
+			m.Unlock()
+			return
+		}
+
+		m.Unlock()
+
+		select {
+		case <-m.msgReady:
+		case <-deadline:
+			return nil, edm.ErrTimeout
+		}
+	}
+}
+
+// Close terminates the transport, pending and subsequent reads return
+// io.EOF.
+func (m *ANNA) Close() {
+	m.Lock()
+	defer m.Unlock()
+
+	m.closed = true
+	signal(m.rxReady)
+}
+
+// Read implements edm.Transport, returning data queued towards the host.
+func (m *ANNA) Read(buf []byte) (n int, err error) {
+	if len(buf) == 0 {
+		return
+	}
+
+	for {
+		m.Lock()
+
+		if m.closed {
+			m.Unlock()
+			return 0, io.EOF
+		}
+
+		if len(m.rx) > 0 {
+			n = copy(buf, m.rx)
+			m.rx = m.rx[n:]
+			m.Unlock()
+			return
+		}
+
+		deadline := m.deadline
+		m.Unlock()
+
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return 0, edm.ErrTimeout
+		}
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			expired = timer.C
+		}
+
+		select {
+		case <-m.rxReady:
+		case <-expired:
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Write implements edm.Transport, processing data received from the host.
+func (m *ANNA) Write(buf []byte) (n int, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.edm {
+		m.dec.Write(buf)
+
+		for payload, ok := m.dec.Next(); ok; payload, ok = m.dec.Next() {
+			m.handlePacket(payload)
+		}
+
+		return len(buf), nil
+	}
+
+	for _, c := range buf {
+		if c != '\r' {
+			m.line = append(m.line, c)
+			continue
+		}
+
+		cmd := string(m.line)
+		m.line = nil
+
+		res := m.command(cmd)
+		m.tx(res)
+
+		if cmd == "ATO2" && bytes.HasSuffix(res, []byte("OK\r\n")) {
+			m.edm = true
+		}
+	}
+
+	return len(buf), nil
+}
+
+// SetReadDeadline implements edm.Transport.
+func (m *ANNA) SetReadDeadline(deadline time.Time) error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.deadline = deadline
+	signal(m.rxReady)
+
+	return nil
+}
+
+// handlePacket processes an EDM packet payload received from the host, the
+// lock must be held.
+func (m *ANNA) handlePacket(buf []byte) {
+	if len(buf) < 2 {
+		return
+	}
+
+	kind := binary.BigEndian.Uint16(buf[0:2])
+	payload := buf[2:]
+
+	switch kind {
+	case atRequest:
+		cmd := strings.TrimSuffix(string(payload), "\r")
+
+		if res := m.command(cmd); res != nil {
+			m.txPayload(atConfirmation, res)
+		}
+	case dataCommand:
+		if len(payload) < 1 {
+			return
+		}
+
+		frg := &edm.Fragment{}
+
+		if err := frg.Parse(payload[1:]); err != nil {
+			return
+		}
+
+		if msg, err := m.fragments.Add(payload[0], frg); err == nil && msg != nil {
+			m.messages = append(m.messages, &Message{Channel: payload[0], Data: msg})
+			signal(m.msgReady)
+		}
+	}
+}
+
+// command returns the response to an AT command, the lock must be held.
+func (m *ANNA) command(cmd string) (res []byte) {
+	m.commands = append(m.commands, cmd)
+
+	if m.Handler != nil {
+		if res, ok := m.Handler(cmd); ok {
+			return res
+		}
+	}
+
+	switch {
+	case cmd == "AT+UBTLN?":
+		return fmt.Appendf(nil, "\r\n+UBTLN:\"%s\"\r\nOK\r\n", m.name)
+	case strings.HasPrefix(cmd, "AT+UBTLN=\""):
+		m.name = strings.TrimSuffix(strings.TrimPrefix(cmd, "AT+UBTLN=\""), "\"")
+	case strings.HasPrefix(cmd, "AT+UBTRSS="):
+		return []byte("\r\n+UBTRSS:-42\r\nOK\r\n")
+	case cmd == "AT", cmd == "ATO2", strings.HasPrefix(cmd, "AT+UBTDM="):
+	default:
+		return []byte("\r\nERROR\r\n")
+	}
+
+	return []byte("\r\nOK\r\n")
+}
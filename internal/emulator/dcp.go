@@ -0,0 +1,171 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package emulator
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"errors"
+	"sync"
+)
+
+// DCP key RAM slots
+const keySlots = 4
+
+// DCP emulates the NXP Data Co-Processor AES-128-CBC operation, key
+// derivation uses the given device key in place of the OTPMK.
+type DCP struct {
+	sync.Mutex
+
+	// Key is the emulated OTPMK
+	Key []byte
+
+	// key RAM
+	slots [keySlots][]byte
+}
+
+// NewDCP returns an emulated DCP with a fixed test OTPMK.
+func NewDCP() *DCP {
+	return &DCP{
+		Key: bytes.Repeat([]byte{0xaa}, aes.BlockSize),
+	}
+}
+
+func pad(buf []byte) []byte {
+	n := 0
+
+	if r := len(buf) % aes.BlockSize; r != 0 {
+		n = aes.BlockSize - r
+	}
+
+	return append(append([]byte{}, buf...), bytes.Repeat([]byte{byte(n)}, n)...)
+}
+
+func cbc(key []byte, buf []byte, iv []byte, enc bool) (err error) {
+	if len(buf)%aes.BlockSize != 0 {
+		return errors.New("invalid input size")
+	}
+
+	if len(iv) != aes.BlockSize {
+		return errors.New("invalid IV size")
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return
+	}
+
+	if enc {
+		cipher.NewCBCEncrypter(block, iv).CryptBlocks(buf, buf)
+	} else {
+		cipher.NewCBCDecrypter(block, iv).CryptBlocks(buf, buf)
+	}
+
+	return
+}
+
+func (hw *DCP) slot(index int) (key []byte, err error) {
+	if index < 0 || index >= keySlots {
+		return nil, errors.New("key index must be between 0 and 3")
+	}
+
+	if key = hw.slots[index]; key == nil {
+		return nil, errors.New("key not set")
+	}
+
+	return
+}
+
+// DeriveKey derives a key by AES-128-CBC encryption of the diversifier with
+// the emulated OTPMK, the key is either returned (negative index) or set in
+// the corresponding key RAM slot.
+func (hw *DCP) DeriveKey(diversifier []byte, iv []byte, index int) (key []byte, err error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	key = pad(diversifier)
+
+	if err = cbc(hw.Key, key, iv, true); err != nil {
+		return nil, err
+	}
+
+	if index < 0 {
+		return
+	}
+
+	if index >= keySlots {
+		return nil, errors.New("key index must be between 0 and 3")
+	}
+
+	hw.slots[index] = key[0:aes.BlockSize]
+
+	return nil, nil
+}
+
+// SetKey sets an AES-128 key in a key RAM slot.
+func (hw *DCP) SetKey(index int, key []byte) (err error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	if index < 0 || index >= keySlots {
+		return errors.New("key index must be between 0 and 3")
+	}
+
+	if len(key) > aes.BlockSize {
+		return errors.New("invalid key size")
+	}
+
+	hw.slots[index] = append([]byte{}, key...)
+
+	return
+}
+
+// Encrypt performs in-place AES-128-CBC encryption with a key RAM slot.
+func (hw *DCP) Encrypt(buf []byte, index int, iv []byte) (err error) {
+	return hw.cipher(buf, index, iv, true)
+}
+
+// Decrypt performs in-place AES-128-CBC decryption with a key RAM slot.
+func (hw *DCP) Decrypt(buf []byte, index int, iv []byte) (err error) {
+	return hw.cipher(buf, index, iv, false)
+}
+
+func (hw *DCP) cipher(buf []byte, index int, iv []byte, enc bool) (err error) {
+	hw.Lock()
+	defer hw.Unlock()
+
+	key, err := hw.slot(index)
+
+	if err != nil {
+		return
+	}
+
+	return cbc(key, buf, iv, enc)
+}
+
+// CipherChain performs in-place AES-128-CBC encryption or decryption of
+// consecutive slices, each with its own IV.
+func (hw *DCP) CipherChain(buf []byte, ivs []byte, count int, size int, index int, enc bool) (err error) {
+	if len(buf) != size*count || len(buf)%aes.BlockSize != 0 {
+		return errors.New("invalid input size")
+	}
+
+	if len(ivs) != aes.BlockSize*count {
+		return errors.New("invalid IV size")
+	}
+
+	for i := 0; i < count; i++ {
+		iv := ivs[i*aes.BlockSize : (i+1)*aes.BlockSize]
+
+		if err = hw.cipher(buf[i*size:(i+1)*size], index, iv, enc); err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,30 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package emulator
+
+import (
+	"sync"
+	"unsafe"
+
+	"github.com/usbarmory/tamago/dma"
+)
+
+var (
+	dmaOnce   sync.Once
+	dmaRegion []byte
+)
+
+// InitDMA initializes the global DMA region, used by the dma package, within
+// Go memory, which is retained for the process lifetime. Only the first
+// invocation has effect.
+func InitDMA(size int) (err error) {
+	dmaOnce.Do(func() {
+		dmaRegion = make([]byte, size)
+		err = dma.Init(uint(uintptr(unsafe.Pointer(&dmaRegion[0]))), size)
+	})
+
+	return
+}
@@ -0,0 +1,9 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package emulator implements host emulation of the USB armory Mk II
+// peripherals used by armory-drive, to exercise its packages in test cases
+// without the target hardware.
+package emulator
@@ -0,0 +1,64 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package led drives the USB armory Mk II LEDs according to the configured
+// LED policy.
+package led
+
+import (
+	"sync"
+
+	"github.com/usbarmory/armory-drive/api"
+)
+
+var (
+	mux    sync.Mutex
+	policy api.LEDPolicy
+	// requested LED states
+	state = make(map[string]bool)
+)
+
+// allowed returns whether a LED can be lit under the current policy.
+func allowed(name string) bool {
+	switch policy {
+	case api.LEDPolicy_LED_MINIMAL:
+		return name == "white"
+	case api.LEDPolicy_LED_STEALTH:
+		return false
+	default:
+		return true
+	}
+}
+
+// Set changes a LED state, the LED is lit only if allowed by the LED policy.
+func Set(name string, on bool) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	state[name] = on
+	setLED(name, on && allowed(name))
+}
+
+// Override changes a LED state regardless of the LED policy, it is meant for
+// feedback which must not be hidden (e.g. firmware update in progress).
+func Override(name string, on bool) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	state[name] = on
+	setLED(name, on)
+}
+
+// SetPolicy changes the LED policy, updating LEDs accordingly.
+func SetPolicy(p api.LEDPolicy) {
+	mux.Lock()
+	defer mux.Unlock()
+
+	policy = p
+
+	for name, on := range state {
+		setLED(name, on && allowed(name))
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build tamago
+
+package led
+
+import (
+	usbarmory "github.com/usbarmory/tamago/board/usbarmory/mk2"
+)
+
+func setLED(name string, on bool) {
+	usbarmory.LED(name, on)
+}
@@ -0,0 +1,12 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package led
+
+// LEDs are only available on the USB armory, host builds only track their
+// requested state.
+func setLED(name string, on bool) {}
@@ -0,0 +1,392 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package noise implements the Noise Protocol Framework handshakes used by
+// the Armory Drive API, instantiated with P-256, AES-256-GCM and SHA-256.
+//
+// As P-256 is not part of the Noise specification DH functions, public keys
+// are encoded as uncompressed SEC 1 points and DH outputs are the shared
+// secret X coordinate.
+//
+// This package is only meant to be used with `GOOS=tamago GOARCH=arm` as
+// supported by the TamaGo framework for bare metal Go on ARM SoCs, see
+// https://github.com/usbarmory/tamago, as well as on hosts for the Go client.
+package noise
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"errors"
+	"fmt"
+)
+
+const (
+	// DHLEN is the P-256 uncompressed public key size
+	DHLEN = 65
+	// TAGLEN is the AES-256-GCM authentication tag size
+	TAGLEN = 16
+)
+
+// Armory Drive handshake prologues, the pairing one is followed by the
+// pairing nonce (64-bit big-endian).
+const (
+	SESSION_PROLOGUE = "armory-drive session"
+	PAIRING_PROLOGUE = "armory-drive pairing"
+)
+
+// Token represents a handshake message pattern token.
+type Token int
+
+// p7.1, Handshake pattern basics, The Noise Protocol Framework, Revision 34
+const (
+	E Token = iota
+	S
+	EE
+	ES
+	SE
+	SS
+)
+
+// Pattern represents a Noise handshake pattern.
+type Pattern struct {
+	// Name is the handshake pattern name
+	Name string
+	// Initiator pre-message tokens
+	Initiator []Token
+	// Responder pre-message tokens
+	Responder []Token
+	// Messages tokens, alternating from the initiator
+	Messages [][]Token
+}
+
+// KK is the Noise KK pattern, used for session negotiation where both
+// long-term keys are known after pairing.
+var KK = &Pattern{
+	Name:      "KK",
+	Initiator: []Token{S},
+	Responder: []Token{S},
+	Messages: [][]Token{
+		{E, ES, SS},
+		{E, EE, SE},
+	},
+}
+
+// IK is the Noise IK pattern, used for pairing where the responder long-term
+// key is known from its pairing code while the initiator one is transmitted
+// encrypted, completing in a single round trip.
+var IK = &Pattern{
+	Name:      "IK",
+	Responder: []Token{S},
+	Messages: [][]Token{
+		{E, ES, S, SS},
+		{E, EE, SE},
+	},
+}
+
+// p4.1, DH functions, The Noise Protocol Framework, Revision 34
+type dhFunction struct {
+	ecdh.Curve
+
+	// DH function name
+	name string
+	// public key size
+	size int
+}
+
+var p256 = &dhFunction{
+	Curve: ecdh.P256(),
+	name:  "P256",
+	size:  DHLEN,
+}
+
+// Config represents a handshake configuration.
+type Config struct {
+	// Pattern is the handshake pattern
+	Pattern *Pattern
+	// Initiator selects the handshake role
+	Initiator bool
+	// Prologue is the data both parties must agree on
+	Prologue []byte
+	// Static is the local long-term key pair
+	Static *ecdh.PrivateKey
+	// Ephemeral is the local ephemeral key pair, generated when not set
+	Ephemeral *ecdh.PrivateKey
+	// PeerStatic is the remote long-term public key, when known
+	PeerStatic *ecdh.PublicKey
+
+	// DH function, P-256 when not set
+	curve *dhFunction
+}
+
+// Handshake represents a Noise HandshakeState.
+type Handshake struct {
+	symmetricState
+
+	pattern   *Pattern
+	initiator bool
+	curve     *dhFunction
+
+	s  *ecdh.PrivateKey
+	e  *ecdh.PrivateKey
+	rs *ecdh.PublicKey
+	re *ecdh.PublicKey
+
+	// index of the next handshake message
+	index int
+}
+
+// ProtocolName returns the Noise protocol name for a handshake pattern.
+func ProtocolName(p *Pattern) string {
+	return protocolName(p, p256)
+}
+
+func protocolName(p *Pattern, dh *dhFunction) string {
+	return fmt.Sprintf("Noise_%s_%s_AESGCM_SHA256", p.Name, dh.name)
+}
+
+// NewHandshake initializes a handshake state.
+func NewHandshake(c *Config) (hs *Handshake, err error) {
+	if c.Pattern == nil {
+		return nil, errors.New("invalid pattern")
+	}
+
+	hs = &Handshake{
+		pattern:   c.Pattern,
+		initiator: c.Initiator,
+		s:         c.Static,
+		e:         c.Ephemeral,
+		rs:        c.PeerStatic,
+		curve:     c.curve,
+	}
+
+	if hs.curve == nil {
+		hs.curve = p256
+	}
+
+	hs.initializeSymmetric(protocolName(c.Pattern, hs.curve))
+	hs.mixHash(c.Prologue)
+
+	var static *ecdh.PublicKey
+
+	if hs.s != nil {
+		static = hs.s.PublicKey()
+	}
+
+	initiator, responder := static, hs.rs
+
+	if !hs.initiator {
+		initiator, responder = hs.rs, static
+	}
+
+	if err = hs.preMessage(c.Pattern.Initiator, initiator); err != nil {
+		return nil, err
+	}
+
+	if err = hs.preMessage(c.Pattern.Responder, responder); err != nil {
+		return nil, err
+	}
+
+	return
+}
+
+func (hs *Handshake) preMessage(tokens []Token, pub *ecdh.PublicKey) (err error) {
+	for _, t := range tokens {
+		if t != S {
+			return errors.New("unsupported pre-message token")
+		}
+
+		if pub == nil {
+			return errors.New("missing static key")
+		}
+
+		hs.mixHash(pub.Bytes())
+	}
+
+	return
+}
+
+// Complete returns whether all handshake messages have been processed.
+func (hs *Handshake) Complete() bool {
+	return hs.index >= len(hs.pattern.Messages)
+}
+
+// PeerStatic returns the remote long-term public key.
+func (hs *Handshake) PeerStatic() *ecdh.PublicKey {
+	return hs.rs
+}
+
+// PeerEphemeral returns the remote ephemeral public key.
+func (hs *Handshake) PeerEphemeral() *ecdh.PublicKey {
+	return hs.re
+}
+
+// Ephemeral returns the local ephemeral key pair.
+func (hs *Handshake) Ephemeral() *ecdh.PrivateKey {
+	return hs.e
+}
+
+func (hs *Handshake) tokens(write bool) (tokens []Token, err error) {
+	if hs.Complete() {
+		return nil, errors.New("handshake complete")
+	}
+
+	// the initiator writes even messages
+	if (hs.index%2 == 0) != (hs.initiator == write) {
+		return nil, errors.New("unexpected handshake message")
+	}
+
+	tokens = hs.pattern.Messages[hs.index]
+	hs.index += 1
+
+	return
+}
+
+func (hs *Handshake) dh(t Token) (err error) {
+	var priv *ecdh.PrivateKey
+	var pub *ecdh.PublicKey
+
+	// es: initiator ephemeral, responder static
+	// se: initiator static, responder ephemeral
+	switch {
+	case t == EE:
+		priv, pub = hs.e, hs.re
+	case t == SS:
+		priv, pub = hs.s, hs.rs
+	case (t == ES) == hs.initiator:
+		priv, pub = hs.e, hs.rs
+	default:
+		priv, pub = hs.s, hs.re
+	}
+
+	if priv == nil || pub == nil {
+		return errors.New("missing key")
+	}
+
+	shared, err := priv.ECDH(pub)
+
+	if err != nil {
+		return
+	}
+
+	return hs.mixKey(shared)
+}
+
+// WriteMessage returns the next handshake message, carrying the optional
+// payload.
+func (hs *Handshake) WriteMessage(payload []byte) (msg []byte, err error) {
+	tokens, err := hs.tokens(true)
+
+	if err != nil {
+		return
+	}
+
+	for _, t := range tokens {
+		switch t {
+		case E:
+			if hs.e == nil {
+				if hs.e, err = hs.curve.GenerateKey(rand.Reader); err != nil {
+					return
+				}
+			}
+
+			pub := hs.e.PublicKey().Bytes()
+			hs.mixHash(pub)
+			msg = append(msg, pub...)
+		case S:
+			if hs.s == nil {
+				return nil, errors.New("missing static key")
+			}
+
+			var buf []byte
+
+			if buf, err = hs.encryptAndHash(hs.s.PublicKey().Bytes()); err != nil {
+				return
+			}
+
+			msg = append(msg, buf...)
+		default:
+			if err = hs.dh(t); err != nil {
+				return
+			}
+		}
+	}
+
+	buf, err := hs.encryptAndHash(payload)
+
+	if err != nil {
+		return
+	}
+
+	return append(msg, buf...), nil
+}
+
+// ReadMessage processes the next handshake message, returning its payload.
+func (hs *Handshake) ReadMessage(msg []byte) (payload []byte, err error) {
+	tokens, err := hs.tokens(false)
+
+	if err != nil {
+		return
+	}
+
+	for _, t := range tokens {
+		switch t {
+		case E:
+			if len(msg) < hs.curve.size {
+				return nil, errors.New("invalid handshake message")
+			}
+
+			if hs.re, err = hs.curve.NewPublicKey(msg[0:hs.curve.size]); err != nil {
+				return
+			}
+
+			hs.mixHash(msg[0:hs.curve.size])
+			msg = msg[hs.curve.size:]
+		case S:
+			size := hs.curve.size
+
+			if hs.aead != nil {
+				size += TAGLEN
+			}
+
+			if len(msg) < size {
+				return nil, errors.New("invalid handshake message")
+			}
+
+			var pub []byte
+
+			if pub, err = hs.decryptAndHash(msg[0:size]); err != nil {
+				return
+			}
+
+			if hs.rs, err = hs.curve.NewPublicKey(pub); err != nil {
+				return
+			}
+
+			msg = msg[size:]
+		default:
+			if err = hs.dh(t); err != nil {
+				return
+			}
+		}
+	}
+
+	return hs.decryptAndHash(msg)
+}
+
+// Split returns the transport keys of a complete handshake, respectively for
+// initiator to responder and responder to initiator messages.
+func (hs *Handshake) Split() (k1 []byte, k2 []byte, err error) {
+	if !hs.Complete() {
+		return nil, nil, errors.New("handshake incomplete")
+	}
+
+	return hs.split()
+}
+
+// HandshakeHash returns the handshake hash, which uniquely identifies the
+// handshake and may be used for channel binding.
+func (hs *Handshake) HandshakeHash() []byte {
+	return append([]byte{}, hs.h...)
+}
@@ -0,0 +1,343 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package noise
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+)
+
+var (
+	testPrologue = []byte(SESSION_PROLOGUE)
+	testPayload  = []byte("armory")
+)
+
+func testKey(t *testing.T) *ecdh.PrivateKey {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// testHandshakes returns initiator and responder handshake states, for the
+// given pattern, between two long-term key pairs.
+func testHandshakes(t *testing.T, p *Pattern, is *ecdh.PrivateKey, rs *ecdh.PrivateKey) (init *Handshake, resp *Handshake) {
+	c := &Config{
+		Pattern:    p,
+		Initiator:  true,
+		Prologue:   testPrologue,
+		Static:     is,
+		PeerStatic: rs.PublicKey(),
+	}
+
+	init, err := NewHandshake(c)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = &Config{
+		Pattern:  p,
+		Prologue: testPrologue,
+		Static:   rs,
+	}
+
+	// IK transmits the initiator long-term key
+	if p == KK {
+		c.PeerStatic = is.PublicKey()
+	}
+
+	if resp, err = NewHandshake(c); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+// mustWrite returns the next handshake message.
+func mustWrite(t *testing.T, hs *Handshake) []byte {
+	msg, err := hs.WriteMessage(testPayload)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msg
+}
+
+// testHandshake completes a handshake, returning its messages.
+func testHandshake(t *testing.T, init *Handshake, resp *Handshake) (msgs [][]byte) {
+	for sender, receiver := init, resp; !init.Complete(); sender, receiver = receiver, sender {
+		msg := mustWrite(t, sender)
+		payload, err := receiver.ReadMessage(msg)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(payload, testPayload) {
+			t.Fatal("payload mismatch")
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	if !resp.Complete() {
+		t.Fatal("responder handshake incomplete")
+	}
+
+	return
+}
+
+func TestHandshake(t *testing.T) {
+	for _, p := range []*Pattern{KK, IK} {
+		t.Run(p.Name, func(t *testing.T) {
+			is := testKey(t)
+			rs := testKey(t)
+
+			init, resp := testHandshakes(t, p, is, rs)
+
+			if _, _, err := init.Split(); err == nil {
+				t.Fatal("incomplete handshake split")
+			}
+
+			msgs := testHandshake(t, init, resp)
+
+			if len(msgs) != len(p.Messages) {
+				t.Fatalf("%d messages, expected %d", len(msgs), len(p.Messages))
+			}
+
+			// message 1: e, (encrypted) s, payload
+			size := DHLEN + len(testPayload) + TAGLEN
+
+			if p == IK {
+				size += DHLEN + TAGLEN
+			}
+
+			if len(msgs[0]) != size {
+				t.Errorf("message 1 size %d, expected %d", len(msgs[0]), size)
+			}
+
+			// the initiator long-term key is not transmitted in clear
+			if bytes.Contains(msgs[0], is.PublicKey().Bytes()) {
+				t.Error("initiator long-term key disclosed")
+			}
+
+			if !resp.PeerStatic().Equal(is.PublicKey()) {
+				t.Error("initiator long-term key mismatch")
+			}
+
+			if !init.PeerEphemeral().Equal(resp.Ephemeral().PublicKey()) || !resp.PeerEphemeral().Equal(init.Ephemeral().PublicKey()) {
+				t.Error("ephemeral key mismatch")
+			}
+
+			if !bytes.Equal(init.HandshakeHash(), resp.HandshakeHash()) {
+				t.Error("handshake hash mismatch")
+			}
+
+			ik1, ik2, err := init.Split()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rk1, rk2, err := resp.Split()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(ik1, rk1) || !bytes.Equal(ik2, rk2) || bytes.Equal(ik1, ik2) {
+				t.Fatal("transport keys mismatch")
+			}
+
+			if len(ik1) != KEYLEN || len(ik2) != KEYLEN {
+				t.Fatal("invalid transport key size")
+			}
+
+			if _, err = init.WriteMessage(nil); err == nil {
+				t.Error("message written after handshake completion")
+			}
+		})
+	}
+}
+
+func TestHandshakeOrder(t *testing.T) {
+	init, resp := testHandshakes(t, KK, testKey(t), testKey(t))
+
+	if _, err := resp.WriteMessage(nil); err == nil {
+		t.Error("responder wrote message 1")
+	}
+
+	if _, err := init.ReadMessage(nil); err == nil {
+		t.Error("initiator read message 1")
+	}
+}
+
+func TestHandshakeConfig(t *testing.T) {
+	if _, err := NewHandshake(&Config{}); err == nil {
+		t.Error("handshake without pattern")
+	}
+
+	// the responder long-term key is always required
+	if _, err := NewHandshake(&Config{Pattern: IK, Initiator: true, Static: testKey(t)}); err == nil {
+		t.Error("IK initiator without responder key")
+	}
+
+	if _, err := NewHandshake(&Config{Pattern: KK, Static: testKey(t)}); err == nil {
+		t.Error("KK responder without initiator key")
+	}
+}
+
+func TestHandshakeMismatch(t *testing.T) {
+	is := testKey(t)
+	rs := testKey(t)
+
+	for _, tc := range []struct {
+		name   string
+		config func(c *Config)
+	}{
+		{"prologue", func(c *Config) { c.Prologue = []byte(PAIRING_PROLOGUE) }},
+		{"static", func(c *Config) { c.Static = testKey(t) }},
+		{"peer static", func(c *Config) { c.PeerStatic = testKey(t).PublicKey() }},
+		{"pattern", func(c *Config) { c.Pattern = IK; c.PeerStatic = nil }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			init, _ := testHandshakes(t, KK, is, rs)
+
+			c := &Config{
+				Pattern:    KK,
+				Prologue:   testPrologue,
+				Static:     rs,
+				PeerStatic: is.PublicKey(),
+			}
+
+			tc.config(c)
+
+			resp, err := NewHandshake(c)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			msg, err := init.WriteMessage(testPayload)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = resp.ReadMessage(msg); err == nil {
+				t.Fatal("mismatching handshake accepted")
+			}
+		})
+	}
+}
+
+func TestTamper(t *testing.T) {
+	is := testKey(t)
+	rs := testKey(t)
+
+	for _, p := range []*Pattern{KK, IK} {
+		t.Run(p.Name, func(t *testing.T) {
+			init, resp := testHandshakes(t, p, is, rs)
+			msgs := testHandshake(t, init, resp)
+
+			for i := range msgs {
+				for j := range msgs[i] {
+					init, resp := testHandshakes(t, p, is, rs)
+					sender, receiver := init, resp
+
+					if i == 1 {
+						if _, err := resp.ReadMessage(mustWrite(t, init)); err != nil {
+							t.Fatal(err)
+						}
+
+						sender, receiver = resp, init
+					}
+
+					msg := mustWrite(t, sender)
+					msg[j] ^= 0x01
+
+					if _, err := receiver.ReadMessage(msg); err == nil {
+						t.Fatalf("message %d: tampered byte %d accepted", i+1, j)
+					}
+				}
+			}
+
+			init, resp = testHandshakes(t, p, is, rs)
+
+			if _, err := resp.ReadMessage(mustWrite(t, init)[:DHLEN]); err == nil {
+				t.Fatal("truncated message accepted")
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	is := testKey(t)
+	rs := testKey(t)
+
+	for _, p := range []*Pattern{KK, IK} {
+		t.Run(p.Name, func(t *testing.T) {
+			init, resp := testHandshakes(t, p, is, rs)
+			msgs := testHandshake(t, init, resp)
+
+			// a handshake message is processed only once
+			if _, err := resp.ReadMessage(msgs[0]); err == nil {
+				t.Error("message 1 processed twice")
+			}
+
+			// a response is bound to the initiator ephemeral key
+			init, _ = testHandshakes(t, p, is, rs)
+			mustWrite(t, init)
+
+			if _, err := init.ReadMessage(msgs[1]); err == nil {
+				t.Error("replayed message 2 accepted")
+			}
+
+			// a replayed request leads to different transport keys
+			init, resp = testHandshakes(t, p, is, rs)
+			msgs = testHandshake(t, init, resp)
+			k1, k2, _ := init.Split()
+
+			_, replay := testHandshakes(t, p, is, rs)
+
+			if _, err := replay.ReadMessage(msgs[0]); err != nil {
+				t.Fatal(err)
+			}
+
+			mustWrite(t, replay)
+			rk1, rk2, _ := replay.Split()
+
+			if bytes.Equal(k1, rk1) || bytes.Equal(k2, rk2) {
+				t.Error("transport keys reused on replay")
+			}
+
+			// transport messages are processed only once
+			tx := testTransport(t, k1)
+			rx := testTransport(t, k1)
+
+			ct, err := tx.encryptWithAd(nil, testPayload)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = rx.decryptWithAd(nil, ct); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err = rx.decryptWithAd(nil, ct); err == nil {
+				t.Error("transport message processed twice")
+			}
+		})
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package noise
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// HASHLEN is the SHA-256 digest size
+	HASHLEN = sha256.Size
+	// KEYLEN is the AES-256-GCM key size
+	KEYLEN = 32
+)
+
+// p5.1, The CipherState object, The Noise Protocol Framework, Revision 34
+type cipherState struct {
+	aead cipher.AEAD
+	n    uint64
+}
+
+// p12.4, The AESGCM cipher functions, The Noise Protocol Framework, Revision 34
+func nonce(n uint64) (buf []byte) {
+	buf = make([]byte, 12)
+	binary.BigEndian.PutUint64(buf[4:], n)
+	return
+}
+
+func (cs *cipherState) initializeKey(key []byte) (err error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return
+	}
+
+	cs.aead, err = cipher.NewGCM(block)
+	cs.n = 0
+
+	return
+}
+
+func (cs *cipherState) encryptWithAd(ad []byte, plaintext []byte) (ciphertext []byte, err error) {
+	if cs.aead == nil {
+		return plaintext, nil
+	}
+
+	if cs.n == math.MaxUint64 {
+		return nil, errors.New("nonce exhausted")
+	}
+
+	ciphertext = cs.aead.Seal(nil, nonce(cs.n), plaintext, ad)
+	cs.n += 1
+
+	return
+}
+
+func (cs *cipherState) decryptWithAd(ad []byte, ciphertext []byte) (plaintext []byte, err error) {
+	if cs.aead == nil {
+		return ciphertext, nil
+	}
+
+	if cs.n == math.MaxUint64 {
+		return nil, errors.New("nonce exhausted")
+	}
+
+	if plaintext, err = cs.aead.Open(nil, nonce(cs.n), ciphertext, ad); err != nil {
+		return
+	}
+
+	cs.n += 1
+
+	return
+}
+
+// p5.2, The SymmetricState object, The Noise Protocol Framework, Revision 34
+type symmetricState struct {
+	cipherState
+
+	ck []byte
+	h  []byte
+}
+
+func (ss *symmetricState) initializeSymmetric(protocolName string) {
+	if len(protocolName) <= HASHLEN {
+		ss.h = make([]byte, HASHLEN)
+		copy(ss.h, protocolName)
+	} else {
+		sum := sha256.Sum256([]byte(protocolName))
+		ss.h = sum[:]
+	}
+
+	ss.ck = append([]byte{}, ss.h...)
+}
+
+// p4.3, Hash functions, The Noise Protocol Framework, Revision 34
+//
+// The Noise HKDF function matches RFC 5869 with the chaining key as salt and
+// an empty info.
+func (ss *symmetricState) hkdf(ikm []byte) (out1 []byte, out2 []byte, err error) {
+	out := make([]byte, 2*HASHLEN)
+
+	if _, err = io.ReadFull(hkdf.New(sha256.New, ikm, ss.ck, nil), out); err != nil {
+		return
+	}
+
+	return out[0:HASHLEN], out[HASHLEN:], nil
+}
+
+func (ss *symmetricState) mixKey(ikm []byte) (err error) {
+	ck, tempk, err := ss.hkdf(ikm)
+
+	if err != nil {
+		return
+	}
+
+	ss.ck = ck
+
+	return ss.initializeKey(tempk[0:KEYLEN])
+}
+
+func (ss *symmetricState) mixHash(data []byte) {
+	h := sha256.New()
+	h.Write(ss.h)
+	h.Write(data)
+	ss.h = h.Sum(nil)
+}
+
+func (ss *symmetricState) encryptAndHash(plaintext []byte) (ciphertext []byte, err error) {
+	if ciphertext, err = ss.encryptWithAd(ss.h, plaintext); err != nil {
+		return
+	}
+
+	ss.mixHash(ciphertext)
+
+	return
+}
+
+func (ss *symmetricState) decryptAndHash(ciphertext []byte) (plaintext []byte, err error) {
+	if plaintext, err = ss.decryptWithAd(ss.h, ciphertext); err != nil {
+		return
+	}
+
+	ss.mixHash(ciphertext)
+
+	return
+}
+
+func (ss *symmetricState) split() (k1 []byte, k2 []byte, err error) {
+	if k1, k2, err = ss.hkdf(nil); err != nil {
+		return
+	}
+
+	return k1[0:KEYLEN], k2[0:KEYLEN], nil
+}
@@ -0,0 +1,305 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package noise
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The published Noise test vectors, in the cacophony and snow formats, are
+// retrieved in testdata with `make noise_vectors`. They cover 25519 and 448
+// DH functions only, therefore X25519 is instantiated to validate the
+// handshake state machine, symmetric state and AESGCM/SHA256 functions.
+var x25519 = &dhFunction{
+	Curve: ecdh.X25519(),
+	name:  "25519",
+	size:  32,
+}
+
+type hexBytes []byte
+
+func (b *hexBytes) UnmarshalJSON(data []byte) (err error) {
+	var s string
+
+	if err = json.Unmarshal(data, &s); err != nil {
+		return
+	}
+
+	*b, err = hex.DecodeString(s)
+
+	return
+}
+
+type testMessage struct {
+	Payload    hexBytes `json:"payload"`
+	Ciphertext hexBytes `json:"ciphertext"`
+}
+
+type testVector struct {
+	ProtocolName string `json:"protocol_name"`
+
+	InitPrologue     hexBytes `json:"init_prologue"`
+	InitStatic       hexBytes `json:"init_static"`
+	InitEphemeral    hexBytes `json:"init_ephemeral"`
+	InitRemoteStatic hexBytes `json:"init_remote_static"`
+
+	RespPrologue     hexBytes `json:"resp_prologue"`
+	RespStatic       hexBytes `json:"resp_static"`
+	RespEphemeral    hexBytes `json:"resp_ephemeral"`
+	RespRemoteStatic hexBytes `json:"resp_remote_static"`
+
+	HandshakeHash hexBytes      `json:"handshake_hash"`
+	Messages      []testMessage `json:"messages"`
+}
+
+// testVectors returns the supported vectors found in testdata, indexed by
+// file name.
+func testVectors(t *testing.T) (vectors map[string][]*testVector) {
+	files, err := filepath.Glob(filepath.Join("testdata", "*.txt"))
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) == 0 {
+		t.Skip("no test vectors, retrieve them with `make noise_vectors`")
+	}
+
+	vectors = make(map[string][]*testVector)
+
+	for _, f := range files {
+		buf, err := os.ReadFile(f)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		all := struct {
+			Vectors []*testVector `json:"vectors"`
+		}{}
+
+		if err = json.Unmarshal(buf, &all); err != nil {
+			t.Fatalf("%s: %v", f, err)
+		}
+
+		for _, v := range all.Vectors {
+			if _, _, ok := testProtocol(v.ProtocolName); ok {
+				vectors[f] = append(vectors[f], v)
+			}
+		}
+	}
+
+	return
+}
+
+func testProtocol(name string) (p *Pattern, dh *dhFunction, ok bool) {
+	for _, p = range []*Pattern{KK, IK} {
+		for _, dh = range []*dhFunction{x25519, p256} {
+			if name == protocolName(p, dh) {
+				return p, dh, true
+			}
+		}
+	}
+
+	return nil, nil, false
+}
+
+func testPrivateKey(t *testing.T, dh *dhFunction, buf []byte) *ecdh.PrivateKey {
+	if len(buf) == 0 {
+		return nil
+	}
+
+	key, err := dh.NewPrivateKey(buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func testPublicKey(t *testing.T, dh *dhFunction, buf []byte) *ecdh.PublicKey {
+	if len(buf) == 0 {
+		return nil
+	}
+
+	key, err := dh.NewPublicKey(buf)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+func testTransport(t *testing.T, key []byte) *cipherState {
+	cs := &cipherState{}
+
+	if err := cs.initializeKey(key); err != nil {
+		t.Fatal(err)
+	}
+
+	return cs
+}
+
+func runVector(t *testing.T, v *testVector) {
+	p, dh, _ := testProtocol(v.ProtocolName)
+
+	init, err := NewHandshake(&Config{
+		Pattern:    p,
+		Initiator:  true,
+		Prologue:   v.InitPrologue,
+		Static:     testPrivateKey(t, dh, v.InitStatic),
+		Ephemeral:  testPrivateKey(t, dh, v.InitEphemeral),
+		PeerStatic: testPublicKey(t, dh, v.InitRemoteStatic),
+		curve:      dh,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp, err := NewHandshake(&Config{
+		Pattern:    p,
+		Prologue:   v.RespPrologue,
+		Static:     testPrivateKey(t, dh, v.RespStatic),
+		Ephemeral:  testPrivateKey(t, dh, v.RespEphemeral),
+		PeerStatic: testPublicKey(t, dh, v.RespRemoteStatic),
+		curve:      dh,
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// transport cipher states, respectively for the initiator and responder
+	var tx [2]*cipherState
+	var rx [2]*cipherState
+
+	for i, m := range v.Messages {
+		var ct []byte
+		var pt []byte
+
+		if !init.Complete() {
+			sender, receiver := init, resp
+
+			if i%2 == 1 {
+				sender, receiver = resp, init
+			}
+
+			if ct, err = sender.WriteMessage(m.Payload); err != nil {
+				t.Fatalf("message %d: %v", i, err)
+			}
+
+			if !bytes.Equal(ct, m.Ciphertext) {
+				t.Fatalf("message %d: ciphertext mismatch\n%x\n%x", i, ct, m.Ciphertext)
+			}
+
+			if pt, err = receiver.ReadMessage(ct); err != nil {
+				t.Fatalf("message %d: %v", i, err)
+			}
+
+			if !bytes.Equal(pt, m.Payload) {
+				t.Fatalf("message %d: payload mismatch", i)
+			}
+
+			if !init.Complete() {
+				continue
+			}
+
+			if !resp.Complete() {
+				t.Fatal("responder handshake incomplete")
+			}
+
+			if len(v.HandshakeHash) > 0 {
+				if !bytes.Equal(init.HandshakeHash(), v.HandshakeHash) || !bytes.Equal(resp.HandshakeHash(), v.HandshakeHash) {
+					t.Fatal("handshake hash mismatch")
+				}
+			}
+
+			ik1, ik2, err := init.Split()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rk1, rk2, err := resp.Split()
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tx[0], rx[0] = testTransport(t, ik1), testTransport(t, ik2)
+			tx[1], rx[1] = testTransport(t, rk2), testTransport(t, rk1)
+
+			continue
+		}
+
+		sender, receiver := 0, 1
+
+		if i%2 == 1 {
+			sender, receiver = 1, 0
+		}
+
+		if ct, err = tx[sender].encryptWithAd(nil, m.Payload); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+
+		if !bytes.Equal(ct, m.Ciphertext) {
+			t.Fatalf("message %d: ciphertext mismatch\n%x\n%x", i, ct, m.Ciphertext)
+		}
+
+		if pt, err = rx[receiver].decryptWithAd(nil, ct); err != nil {
+			t.Fatalf("message %d: %v", i, err)
+		}
+
+		if !bytes.Equal(pt, m.Payload) {
+			t.Fatalf("message %d: payload mismatch", i)
+		}
+	}
+
+	if !init.Complete() {
+		t.Fatal("handshake incomplete")
+	}
+}
+
+func TestVectors(t *testing.T) {
+	vectors := testVectors(t)
+
+	for _, name := range []string{ProtocolName(KK), ProtocolName(IK), protocolName(KK, x25519), protocolName(IK, x25519)} {
+		t.Run(name, func(t *testing.T) {
+			n := 0
+
+			for f, all := range vectors {
+				for _, v := range all {
+					if v.ProtocolName != name {
+						continue
+					}
+
+					n += 1
+
+					t.Run(filepath.Base(f), func(t *testing.T) {
+						runVector(t, v)
+					})
+				}
+			}
+
+			if n == 0 {
+				t.Skip("no test vectors")
+			}
+		})
+	}
+
+	if len(vectors) == 0 {
+		t.Fatal("no KK or IK test vectors found")
+	}
+}
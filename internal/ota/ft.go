@@ -91,3 +91,31 @@ func verifyProof(imx []byte, csf []byte, proof []byte, oldProof *api.ProofBundle
 
 	return
 }
+
+// CheckpointSize returns the firmware transparency log size at the checkpoint
+// of the last verified update, 0 if not available.
+func CheckpointSize(pb *api.ProofBundle) uint64 {
+	var cp api.Checkpoint
+
+	if pb == nil {
+		return 0
+	}
+
+	logSigV, err := note.NewVerifier(string(LogPublicKey))
+
+	if err != nil {
+		return 0
+	}
+
+	n, err := note.Open(pb.NewCheckpoint, note.VerifierList(logSigV))
+
+	if err != nil {
+		return 0
+	}
+
+	if err = cp.Unmarshal([]byte(n.Text)); err != nil {
+		return 0
+	}
+
+	return cp.Size
+}
@@ -14,8 +14,10 @@ import (
 	"runtime"
 	"time"
 
-	"github.com/usbarmory/armory-drive-log/api"
+	logapi "github.com/usbarmory/armory-drive-log/api"
+	"github.com/usbarmory/armory-drive/api"
 	"github.com/usbarmory/armory-drive/internal/crypto"
+	"github.com/usbarmory/armory-drive/internal/led"
 
 	usbarmory "github.com/usbarmory/tamago/board/usbarmory/mk2"
 
@@ -69,6 +71,12 @@ func update(entry fs.DirectoryEntry, keyring *crypto.Keyring) {
 	var exit = make(chan bool)
 
 	defer func() {
+		if err != nil {
+			keyring.Audit(api.LogEvent_FIRMWARE_UPDATE_FAILED, err.Error())
+		} else {
+			keyring.Audit(api.LogEvent_FIRMWARE_UPDATED, "")
+		}
+
 		exit <- true
 	}()
 
@@ -84,11 +92,11 @@ func update(entry fs.DirectoryEntry, keyring *crypto.Keyring) {
 		for {
 			select {
 			case <-exit:
-				usbarmory.LED("white", false)
+				led.Override("white", false)
 
 				if err != nil {
 					log.Printf("firmware update error, %v", err)
-					usbarmory.LED("blue", true)
+					led.Override("blue", true)
 				}
 
 				return
@@ -96,7 +104,7 @@ func update(entry fs.DirectoryEntry, keyring *crypto.Keyring) {
 			}
 
 			on = !on
-			usbarmory.LED("white", on)
+			led.Override("white", on)
 
 			runtime.Gosched()
 			time.Sleep(100 * time.Millisecond)
@@ -118,7 +126,7 @@ func update(entry fs.DirectoryEntry, keyring *crypto.Keyring) {
 	}
 
 	if len(proof) > 0 {
-		var pb *api.ProofBundle
+		var pb *logapi.ProofBundle
 
 		// firmware authentication
 		pb, err = verifyProof(imx, csf, proof, keyring.Conf.ProofBundle)
@@ -142,6 +150,6 @@ func update(entry fs.DirectoryEntry, keyring *crypto.Keyring) {
 
 	log.Println("firmware update complete")
 
-	usbarmory.LED("blue", false)
-	usbarmory.LED("white", false)
+	led.Set("blue", false)
+	led.Set("white", false)
 }
@@ -0,0 +1,181 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+// Package pool implements a size-classed pool of pre-allocated DMA buffers,
+// to avoid allocator churn, and fragmentation of the DMA region, on
+// repeated reservations of short lived buffers.
+package pool
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/usbarmory/tamago/dma"
+)
+
+// Class represents a buffer size class.
+type Class struct {
+	// Size is the buffer size in bytes
+	Size int
+	// Count is the number of pre-allocated buffers
+	Count int
+}
+
+// DefaultClasses accommodates DCP IV chains and mass storage transfers.
+var DefaultClasses = []Class{
+	{Size: 512, Count: 32},
+	{Size: 64 * 1024, Count: 8},
+	{Size: 256 * 1024, Count: 8},
+	{Size: 1024 * 1024, Count: 4},
+}
+
+// Stats represents pool usage counters.
+type Stats struct {
+	// Hits counts reservations served by pre-allocated buffers
+	Hits uint64
+	// Misses counts reservations served by the DMA allocator, as
+	// exceeding the largest class or due to class exhaustion
+	Misses uint64
+	// Releases counts released buffers
+	Releases uint64
+	// Zeroised counts buffers zeroised on release
+	Zeroised uint64
+	// InUse is the number of pre-allocated buffers currently reserved
+	InUse int
+	// Peak is the highest number of pre-allocated buffers simultaneously
+	// reserved
+	Peak int
+}
+
+type buffer struct {
+	addr uint
+	buf  []byte
+
+	// owning class, nil for DMA allocator fallbacks
+	class *class
+	// zeroise on release
+	zero bool
+}
+
+type class struct {
+	size int
+	free []*buffer
+}
+
+// Pool represents a pool of pre-allocated DMA buffers.
+type Pool struct {
+	sync.Mutex
+
+	align int
+
+	classes []*class
+	// reserved buffers, indexed by address
+	reserved map[uint]*buffer
+
+	stats Stats
+}
+
+// New pre-allocates DMA buffers for each size class, with the given
+// alignment.
+func New(classes []Class, align int) (p *Pool) {
+	p = &Pool{
+		align:    align,
+		reserved: make(map[uint]*buffer),
+	}
+
+	for _, c := range classes {
+		cl := &class{
+			size: c.Size,
+		}
+
+		for i := 0; i < c.Count; i++ {
+			b := &buffer{class: cl}
+			b.addr, b.buf = dma.Reserve(c.Size, align)
+			cl.free = append(cl.free, b)
+		}
+
+		p.classes = append(p.classes, cl)
+	}
+
+	sort.Slice(p.classes, func(i, j int) bool {
+		return p.classes[i].size < p.classes[j].size
+	})
+
+	return
+}
+
+// Reserve returns a DMA buffer of the requested size, from the smallest
+// class with available buffers, the buffer is zeroised on release when
+// requested (e.g. for plaintext data).
+//
+// The buffer content is not initialized.
+func (p *Pool) Reserve(size int, zero bool) (addr uint, buf []byte) {
+	p.Lock()
+	defer p.Unlock()
+
+	for _, c := range p.classes {
+		if c.size < size || len(c.free) == 0 {
+			continue
+		}
+
+		b := c.free[len(c.free)-1]
+		c.free = c.free[:len(c.free)-1]
+		b.zero = zero
+
+		p.reserved[b.addr] = b
+
+		p.stats.Hits += 1
+		p.stats.InUse += 1
+		p.stats.Peak = max(p.stats.Peak, p.stats.InUse)
+
+		return b.addr, b.buf[0:size]
+	}
+
+	b := &buffer{zero: zero}
+	b.addr, b.buf = dma.Reserve(size, p.align)
+
+	p.reserved[b.addr] = b
+	p.stats.Misses += 1
+
+	return b.addr, b.buf
+}
+
+// Release returns a buffer to the pool, buffers not reserved through the
+// pool are released to the DMA allocator.
+func (p *Pool) Release(addr uint) {
+	p.Lock()
+	defer p.Unlock()
+
+	b, ok := p.reserved[addr]
+
+	if !ok {
+		dma.Release(addr)
+		return
+	}
+
+	delete(p.reserved, addr)
+	p.stats.Releases += 1
+
+	if b.zero {
+		clear(b.buf)
+		p.stats.Zeroised += 1
+	}
+
+	if b.class == nil {
+		dma.Release(addr)
+		return
+	}
+
+	b.class.free = append(b.class.free, b)
+	p.stats.InUse -= 1
+}
+
+// Stats returns the pool usage counters.
+func (p *Pool) Stats() Stats {
+	p.Lock()
+	defer p.Unlock()
+
+	return p.stats
+}
@@ -0,0 +1,207 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package pool
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/usbarmory/armory-drive/internal/emulator"
+
+	"github.com/usbarmory/tamago/dma"
+)
+
+const testAlign = 4096
+
+// unsorted classes
+var testClasses = []Class{
+	{Size: 4096, Count: 2},
+	{Size: 512, Count: 2},
+}
+
+func newTestPool(t *testing.T) *Pool {
+	if err := emulator.InitDMA(16 * 1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	return New(testClasses, testAlign)
+}
+
+func TestReserve(t *testing.T) {
+	p := newTestPool(t)
+
+	for _, tc := range []struct {
+		size  int
+		class int
+	}{
+		{1, 512},
+		{512, 512},
+		{513, 4096},
+		{4096, 4096},
+	} {
+		addr, buf := p.Reserve(tc.size, false)
+
+		if len(buf) != tc.size || cap(buf) < tc.class {
+			t.Errorf("size %d: buffer length %d, capacity %d", tc.size, len(buf), cap(buf))
+		}
+
+		if addr%testAlign != 0 {
+			t.Errorf("size %d: unaligned address %#x", tc.size, addr)
+		}
+	}
+
+	s := p.Stats()
+
+	if s.Hits != 4 || s.Misses != 0 || s.InUse != 4 || s.Peak != 4 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestReserveFallback(t *testing.T) {
+	p := newTestPool(t)
+
+	// exceeding the largest class
+	addr, buf := p.Reserve(8192, false)
+
+	if len(buf) != 8192 || addr%testAlign != 0 {
+		t.Errorf("invalid fallback buffer (length %d, address %#x)", len(buf), addr)
+	}
+
+	p.Release(addr)
+
+	// class exhaustion, served by larger classes first
+	var reserved []uint
+
+	for range 5 {
+		addr, _ := p.Reserve(512, false)
+		reserved = append(reserved, addr)
+	}
+
+	s := p.Stats()
+
+	if s.Hits != 4 || s.Misses != 2 || s.InUse != 4 || s.Releases != 1 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	for _, addr := range reserved {
+		p.Release(addr)
+	}
+
+	if s = p.Stats(); s.InUse != 0 || s.Peak != 4 || s.Releases != 6 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestRelease(t *testing.T) {
+	p := newTestPool(t)
+
+	addr, buf := p.Reserve(512, false)
+	copy(buf, "armory")
+	p.Release(addr)
+
+	// released buffers are reused, without initialization
+	next, buf := p.Reserve(512, false)
+
+	if next != addr {
+		t.Fatalf("buffer %#x not reused (%#x)", addr, next)
+	}
+
+	if !bytes.HasPrefix(buf, []byte("armory")) {
+		t.Error("buffer content not retained")
+	}
+
+	p.Release(next)
+
+	// buffers not reserved through the pool are released to the DMA
+	// allocator without affecting the pool
+	addr, _ = dma.Reserve(512, testAlign)
+	p.Release(addr)
+
+	if s := p.Stats(); s.Releases != 2 || s.InUse != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestZeroise(t *testing.T) {
+	p := newTestPool(t)
+
+	for _, size := range []int{512, 8192} {
+		addr, buf := p.Reserve(size, true)
+		copy(buf, bytes.Repeat([]byte{0xff}, size))
+		// retain the underlying memory past its release
+		full := buf[:cap(buf)]
+		p.Release(addr)
+
+		if size == 8192 {
+			// fallback buffers are returned to the DMA allocator
+			// once zeroised
+			if !bytes.Equal(buf, make([]byte, size)) {
+				t.Errorf("size %d: buffer not zeroised", size)
+			}
+
+			continue
+		}
+
+		if !bytes.Equal(full, make([]byte, len(full))) {
+			t.Errorf("size %d: buffer not zeroised", size)
+		}
+	}
+
+	if s := p.Stats(); s.Zeroised != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+
+	// the zeroise request does not outlive the reservation
+	addr, buf := p.Reserve(512, true)
+	p.Release(addr)
+
+	addr, buf = p.Reserve(512, false)
+	copy(buf, "armory")
+	p.Release(addr)
+
+	if _, buf = p.Reserve(512, false); !bytes.HasPrefix(buf, []byte("armory")) {
+		t.Error("buffer zeroised without request")
+	}
+
+	if s := p.Stats(); s.Zeroised != 3 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestConcurrency(t *testing.T) {
+	p := newTestPool(t)
+
+	var wg sync.WaitGroup
+
+	for i := range 8 {
+		wg.Add(1)
+
+		go func(b byte) {
+			defer wg.Done()
+
+			for range 100 {
+				addr, buf := p.Reserve(512, true)
+
+				for j := range buf {
+					buf[j] = b
+				}
+
+				if !bytes.Equal(buf, bytes.Repeat([]byte{b}, len(buf))) {
+					t.Error("buffer shared across reservations")
+				}
+
+				p.Release(addr)
+			}
+		}(byte(i + 1))
+	}
+
+	wg.Wait()
+
+	if s := p.Stats(); s.InUse != 0 || s.Hits+s.Misses != 800 || s.Releases != 800 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
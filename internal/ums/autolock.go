@@ -0,0 +1,114 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ums
+
+import (
+	"log"
+	"time"
+
+	"github.com/usbarmory/armory-drive/api"
+)
+
+func idleLockTimeout(settings *api.Configuration) time.Duration {
+	return time.Duration(settings.GetIdleLockTimeout()) * time.Minute
+}
+
+// activity records a data transfer, postponing the idle lock.
+func (d *Drive) activity() {
+	d.lastActivity.Store(time.Now().UnixNano())
+}
+
+// idle returns the time elapsed since the last data transfer.
+func (d *Drive) idle() time.Duration {
+	return time.Since(time.Unix(0, d.lastActivity.Load()))
+}
+
+// armIdleLock starts the idle lock timer, according to the configured
+// timeout, it must be invoked when the drive is unlocked.
+func (d *Drive) armIdleLock() {
+	d.disarmIdleLock()
+	d.activity()
+
+	if timeout := idleLockTimeout(d.Keyring.Conf.Settings); timeout > 0 {
+		d.idleTimer = time.AfterFunc(timeout, d.idleLock)
+	}
+}
+
+func (d *Drive) disarmIdleLock() {
+	if d.idleTimer != nil {
+		d.idleTimer.Stop()
+		d.idleTimer = nil
+	}
+}
+
+// idleLock locks the drive once the idle timeout is reached, the timer is
+// re-armed for the remaining time when data transfers occurred meanwhile.
+func (d *Drive) idleLock() {
+	timeout := idleLockTimeout(d.Keyring.Conf.Settings)
+
+	if !d.Ready() || d.idleTimer == nil || timeout == 0 {
+		return
+	}
+
+	if left := timeout - d.idle(); left > 0 {
+		d.idleTimer.Reset(left)
+		return
+	}
+
+	d.AutoLock(api.LockTrigger_IDLE)
+}
+
+// IdleLockRemaining returns the time left before the drive is locked due to
+// inactivity, zero is returned when locked or without idle lock policy.
+func (d *Drive) IdleLockRemaining() time.Duration {
+	timeout := idleLockTimeout(d.Keyring.Conf.Settings)
+
+	if !d.Ready() || !d.Cipher || d.idleTimer == nil || timeout == 0 {
+		return 0
+	}
+
+	return max(timeout-d.idle(), 0)
+}
+
+// Suspend handles USB suspend events, locking the drive if required by the
+// configured policy.
+func (d *Drive) Suspend() {
+	if d.Keyring.Conf.Settings.GetLockOnSuspend() {
+		d.AutoLock(api.LockTrigger_USB_SUSPEND)
+	}
+}
+
+// BusReset handles USB bus reset events, locking the drive if required by the
+// configured policy. Only resets following an active configuration are
+// considered, as the host resets the bus also on first enumeration.
+func (d *Drive) BusReset() {
+	if !d.configured.Swap(false) {
+		return
+	}
+
+	if d.Keyring.Conf.Settings.GetLockOnReset() {
+		d.AutoLock(api.LockTrigger_USB_RESET)
+	}
+}
+
+// AutoLock locks an unlocked encrypted drive, recording the lock trigger, the
+// operation (and its logging) is asynchronous as it might be invoked within
+// interrupt handling while locking requires DCP and uSDHC operation.
+func (d *Drive) AutoLock(trigger api.LockTrigger) {
+	if !d.Ready() || !d.Cipher {
+		return
+	}
+
+	d.LockTrigger = trigger
+
+	go func() {
+		log.Printf("locking drive on %v", trigger)
+
+		if err := d.Lock(); err != nil {
+			log.Printf("could not lock drive, %v", err)
+		}
+	}()
+}
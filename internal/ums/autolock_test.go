@@ -0,0 +1,155 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ums
+
+import (
+	"testing"
+	"time"
+
+	"github.com/usbarmory/armory-drive/api"
+
+	"github.com/usbarmory/tamago/dma"
+	"github.com/usbarmory/tamago/soc/nxp/usb"
+)
+
+// waitLock waits for an asynchronous lock, triggered by the given event.
+func waitLock(t *testing.T, d *Drive, trigger api.LockTrigger) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for d.Ready() || d.Keyring.Cipher != nil {
+		if time.Now().After(deadline) {
+			t.Fatalf("drive not locked on %v", trigger)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	if d.LockTrigger != trigger {
+		t.Fatalf("unexpected lock trigger %v", d.LockTrigger)
+	}
+}
+
+// expectUnlocked checks that the drive is not locked, asynchronously, within
+// a short delay.
+func expectUnlocked(t *testing.T, d *Drive) {
+	t.Helper()
+
+	time.Sleep(50 * time.Millisecond)
+
+	if !d.Ready() {
+		t.Fatalf("drive locked on %v", d.LockTrigger)
+	}
+}
+
+func TestIdleLock(t *testing.T) {
+	d, _ := newTestDrive(t, true)
+
+	// no timer without idle lock policy
+	unlockTestDrive(t, d, testKEK)
+
+	if d.idleTimer != nil || d.IdleLockRemaining() != 0 {
+		t.Fatal("idle lock armed without policy")
+	}
+
+	d.Keyring.Conf.Settings.IdleLockTimeout = 1
+	timeout := time.Minute
+
+	unlockTestDrive(t, d, testKEK)
+
+	if d.idleTimer == nil {
+		t.Fatal("idle lock not armed")
+	}
+
+	if left := d.IdleLockRemaining(); left <= 0 || left > timeout {
+		t.Fatalf("unexpected idle lock remaining time %v", left)
+	}
+
+	// activity within the timeout re-arms the timer
+	d.lastActivity.Store(time.Now().Add(-timeout / 2).UnixNano())
+	d.idleLock()
+
+	expectUnlocked(t, d)
+
+	if left := d.IdleLockRemaining(); left <= 0 || left > timeout/2 {
+		t.Fatalf("unexpected idle lock remaining time %v", left)
+	}
+
+	// data transfers postpone the idle lock
+	var cdb [16]byte
+	copy(cdb[:], read10(0, 1))
+
+	_, data, _, err := d.handleCDB(cdb, &usb.CBW{})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reserved, addr := dma.Reserved(data); reserved {
+		d.Pool.Release(addr)
+	}
+
+	if left := d.IdleLockRemaining(); left < timeout-time.Second {
+		t.Fatalf("idle lock not postponed by data transfer (%v)", left)
+	}
+
+	d.lastActivity.Store(time.Now().Add(-timeout).UnixNano())
+	d.idleLock()
+
+	waitLock(t, d, api.LockTrigger_IDLE)
+
+	if d.idleTimer != nil || d.IdleLockRemaining() != 0 {
+		t.Fatal("idle lock armed after lock")
+	}
+}
+
+func TestSuspendLock(t *testing.T) {
+	d, _ := newTestDrive(t, true)
+	unlockTestDrive(t, d, testKEK)
+
+	d.Suspend()
+	expectUnlocked(t, d)
+
+	d.Keyring.Conf.Settings.LockOnSuspend = true
+	d.Suspend()
+
+	waitLock(t, d, api.LockTrigger_USB_SUSPEND)
+}
+
+func TestBusResetLock(t *testing.T) {
+	d, _ := newTestDrive(t, true)
+	d.Keyring.Conf.Settings.LockOnReset = true
+	unlockTestDrive(t, d, testKEK)
+
+	setConfiguration := func(conf uint16) {
+		if _, _, _, err := d.setup(&usb.SetupData{Request: usb.SET_CONFIGURATION, Value: conf << 8}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// enumeration resets are ignored
+	d.BusReset()
+	expectUnlocked(t, d)
+
+	// as well as those following deconfiguration
+	setConfiguration(1)
+	setConfiguration(0)
+	d.BusReset()
+	expectUnlocked(t, d)
+
+	setConfiguration(1)
+	d.BusReset()
+
+	waitLock(t, d, api.LockTrigger_USB_RESET)
+
+	// only the first reset is considered
+	unlockTestDrive(t, d, testKEK)
+	d.BusReset()
+	expectUnlocked(t, d)
+}
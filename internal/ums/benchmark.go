@@ -0,0 +1,166 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ums
+
+import (
+	"crypto/aes"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/internal/crypto"
+)
+
+const (
+	// BENCHMARK_SIZE represents the size of the scratch region, at the end
+	// of the card, covered by sequential passes.
+	BENCHMARK_SIZE = 16 * 1024 * 1024
+	// BENCHMARK_TRANSFER represents the size of each sequential transfer.
+	BENCHMARK_TRANSFER = 1024 * 1024
+	// BENCHMARK_RANDOM_OPS represents the number of single logical block
+	// operations performed by random passes.
+	BENCHMARK_RANDOM_OPS = 256
+	// BENCHMARK_DURATION represents the time after which no further cipher
+	// is measured by a single benchmark, bounding the time the management
+	// API is held by each request.
+	BENCHMARK_DURATION = 2 * time.Second
+)
+
+// Benchmark measures the encrypted read and write throughput of the given
+// ciphers (all supported ones if none is given), through the same pipelines
+// used to serve the host.
+//
+// Ciphers are measured in order, at least one and no further ones once
+// BENCHMARK_DURATION has elapsed, results are returned only for measured
+// ciphers.
+//
+// Each cipher is set with a temporary key. The scratch region content is
+// preserved as any write pass re-encrypts, with the same key, the data
+// obtained by decrypting the same logical blocks in the preceding read pass.
+//
+// The drive must be locked, the FDE key is cleared on return.
+func (d *Drive) Benchmark(ciphers []api.Cipher) (results []*api.BenchmarkResult, err error) {
+	return d.benchmarkCiphers(ciphers, BENCHMARK_DURATION)
+}
+
+func (d *Drive) benchmarkCiphers(ciphers []api.Cipher, duration time.Duration) (results []*api.BenchmarkResult, err error) {
+	if d.Ready() || !d.Cipher {
+		return nil, errors.New("benchmark requires a locked encrypted drive")
+	}
+
+	if len(ciphers) == 0 {
+		ciphers = []api.Cipher{
+			api.Cipher_AES128_CBC_PLAIN,
+			api.Cipher_AES128_CBC_ESSIV,
+			api.Cipher_AES128_XTS_PLAIN,
+			api.Cipher_AES256_XTS_PLAIN,
+		}
+	}
+
+	blockSize := d.card.Info().BlockSize * d.Mult
+	start := d.card.Info().Blocks/d.Mult - BENCHMARK_SIZE/blockSize
+
+	if start < 0 {
+		return nil, errors.New("card too small for benchmark")
+	}
+
+	// the scratch region is decrypted in the buffer
+	addr, buf := d.Pool.Reserve(BENCHMARK_SIZE, true)
+	defer d.Pool.Release(addr)
+
+	defer d.Keyring.SetCipher(api.Cipher_NONE, nil)
+
+	deadline := time.Now().Add(duration)
+
+	for _, c := range ciphers {
+		var r *api.BenchmarkResult
+
+		if len(results) > 0 && time.Now().After(deadline) {
+			break
+		}
+
+		if r, err = d.benchmark(c, start, buf); err != nil {
+			return
+		}
+
+		results = append(results, r)
+	}
+
+	return
+}
+
+func (d *Drive) benchmark(c api.Cipher, start int, buf []byte) (r *api.BenchmarkResult, err error) {
+	var t time.Time
+
+	if err = d.Keyring.SetCipher(c, crypto.Rand(aes.BlockSize)); err != nil {
+		return
+	}
+
+	r = &api.BenchmarkResult{
+		Cipher: c,
+	}
+
+	blockSize := d.card.Info().BlockSize * d.Mult
+	blocks := len(buf) / blockSize
+	batch := BENCHMARK_TRANSFER / blockSize
+
+	t = time.Now()
+
+	for i := 0; i < blocks; i += batch {
+		if err = d.readBlocks(start+i, batch, buf[i*blockSize:(i+batch)*blockSize]); err != nil {
+			return
+		}
+	}
+
+	r.SequentialRead = throughput(len(buf), time.Since(t))
+	t = time.Now()
+
+	for i := 0; i < blocks; i += batch {
+		if err = d.writeBlocks(start+i, buf[i*blockSize:(i+batch)*blockSize]); err != nil {
+			return
+		}
+	}
+
+	r.SequentialWrite = throughput(len(buf), time.Since(t))
+
+	lbas := make([]int, BENCHMARK_RANDOM_OPS)
+
+	for i := range lbas {
+		lbas[i] = start + rand.IntN(blocks)
+	}
+
+	t = time.Now()
+
+	for i, lba := range lbas {
+		if err = d.readBlocks(lba, 1, buf[i*blockSize:(i+1)*blockSize]); err != nil {
+			return
+		}
+	}
+
+	r.RandomRead = rate(len(lbas), time.Since(t))
+	t = time.Now()
+
+	for i, lba := range lbas {
+		if err = d.writeBlocks(lba, buf[i*blockSize:(i+1)*blockSize]); err != nil {
+			return
+		}
+	}
+
+	r.RandomWrite = rate(len(lbas), time.Since(t))
+
+	return
+}
+
+// throughput returns MB/s
+func throughput(size int, d time.Duration) float32 {
+	return float32(float64(size) / 1e6 / d.Seconds())
+}
+
+// rate returns operations per second
+func rate(ops int, d time.Duration) float32 {
+	return float32(float64(ops) / d.Seconds())
+}
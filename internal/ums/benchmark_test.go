@@ -0,0 +1,81 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ums
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/usbarmory/armory-drive/api"
+)
+
+func TestBenchmark(t *testing.T) {
+	d, card := newTestDrive(t, true)
+
+	info := card.Info()
+	start := info.Blocks - BENCHMARK_SIZE/info.BlockSize
+
+	// scratch region samples, as raw card blocks
+	samples := map[int][]byte{}
+
+	for _, lba := range []int{start, start + 1, (start + info.Blocks) / 2, info.Blocks - 1} {
+		samples[lba] = bytes.Repeat([]byte{byte(lba)}, info.BlockSize)
+		card.SetBlock(lba, samples[lba])
+	}
+
+	ciphers := []api.Cipher{
+		api.Cipher_AES128_CBC_PLAIN,
+		api.Cipher_AES128_CBC_ESSIV,
+		api.Cipher_AES128_XTS_PLAIN,
+		api.Cipher_AES256_XTS_PLAIN,
+	}
+
+	for _, tc := range []struct {
+		name     string
+		duration time.Duration
+		results  int
+	}{
+		{"capped", 0, 1},
+		{"all", time.Hour, len(ciphers)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			results, err := d.benchmarkCiphers(nil, tc.duration)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(results) != tc.results {
+				t.Fatalf("unexpected number of results %d", len(results))
+			}
+
+			for i, r := range results {
+				if r.Cipher != ciphers[i] || r.SequentialRead <= 0 || r.SequentialWrite <= 0 || r.RandomRead <= 0 || r.RandomWrite <= 0 {
+					t.Fatalf("unexpected result %+v", r)
+				}
+			}
+
+			if d.Keyring.Cipher != nil {
+				t.Fatal("FDE key not cleared")
+			}
+
+			for lba, data := range samples {
+				if !bytes.Equal(card.Block(lba), data) {
+					t.Fatalf("scratch region not preserved at LBA %d", lba)
+				}
+			}
+		})
+	}
+
+	unlockTestDrive(t, d, testKEK)
+
+	if _, err := d.Benchmark(nil); err == nil {
+		t.Fatal("benchmark of unlocked drive")
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ums
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/usbarmory/armory-drive/internal/pool"
+)
+
+const (
+	// WRITE_CACHE_SIZE represents the write-back cache window size, which
+	// matches the typical SD allocation unit size so that cached writes
+	// are merged within a single allocation unit.
+	WRITE_CACHE_SIZE = 4 * 1024 * 1024
+
+	// WRITE_CACHE_DELAY represents the idle time after which cached writes
+	// are committed to the card, regardless of host cache synchronization.
+	WRITE_CACHE_DELAY = 1 * time.Second
+)
+
+// writeCache represents a write-back cache of encrypted blocks, confined
+// within a window aligned to the card allocation unit.
+//
+// As the cache holds only ciphertext, cached blocks can be committed to the
+// card after the FDE key has been cleared.
+type writeCache struct {
+	sync.Mutex
+
+	card  Card
+	stats *stats
+	pool  *pool.Pool
+
+	// logical block size and multiplier
+	blockSize int
+	mult      int
+
+	// first logical block of the cached window (-1 if unset)
+	start int
+	// window size in logical blocks
+	blocks int
+
+	dirty []bool
+	timer *time.Timer
+
+	// failure of the last background commit, not yet reported
+	failure error
+
+	addr uint
+	buf  []byte
+}
+
+func newWriteCache(card Card, stats *stats, p *pool.Pool, blockSize int, mult int) (c *writeCache) {
+	c = &writeCache{
+		card:      card,
+		stats:     stats,
+		pool:      p,
+		blockSize: blockSize,
+		mult:      mult,
+		start:     -1,
+		blocks:    WRITE_CACHE_SIZE / blockSize,
+	}
+
+	c.dirty = make([]bool, c.blocks)
+	// cached blocks are encrypted, no need to zeroise on release
+	c.addr, c.buf = p.Reserve(c.blocks*blockSize, false)
+
+	c.timer = time.AfterFunc(WRITE_CACHE_DELAY, c.background)
+
+	return
+}
+
+// background commits cached blocks once idle, failures are retained to be
+// reported to the host as deferred errors.
+func (c *writeCache) background() {
+	c.Lock()
+	defer c.Unlock()
+
+	if err := c.commit(); err != nil {
+		log.Printf("could not commit cached writes, %v", err)
+		c.stats.cacheErrors.Add(1)
+		c.failure = err
+	}
+}
+
+// deferred returns, and clears, the failure of the last background commit.
+func (c *writeCache) deferred() (err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	err = c.failure
+	c.failure = nil
+
+	return
+}
+
+// fits returns whether a logical block range can be cached.
+func (c *writeCache) fits(lba int, blocks int) bool {
+	return blocks > 0 && lba/c.blocks == (lba+blocks-1)/c.blocks
+}
+
+// store caches encrypted logical blocks, committing the current window if
+// the blocks belong to a different one.
+func (c *writeCache) store(lba int, buf []byte) (err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	if window := lba - lba%c.blocks; window != c.start {
+		if err = c.commit(); err != nil {
+			return
+		}
+
+		c.start = window
+	}
+
+	off := lba - c.start
+	n := len(buf) / c.blockSize
+
+	copy(c.buf[off*c.blockSize:], buf)
+
+	for i := off; i < off+n; i++ {
+		c.dirty[i] = true
+	}
+
+	c.timer.Reset(WRITE_CACHE_DELAY)
+
+	return
+}
+
+// overlay replaces encrypted logical blocks, read from the card, with their
+// cached version.
+func (c *writeCache) overlay(lba int, buf []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.start < 0 {
+		return
+	}
+
+	n := len(buf) / c.blockSize
+
+	for i := 0; i < n; i++ {
+		off := lba + i - c.start
+
+		if off < 0 || off >= c.blocks || !c.dirty[off] {
+			continue
+		}
+
+		copy(buf[i*c.blockSize:(i+1)*c.blockSize], c.buf[off*c.blockSize:])
+	}
+}
+
+// flush commits all cached blocks to the card.
+func (c *writeCache) flush() (err error) {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.commit()
+}
+
+// commit writes each contiguous run of dirty blocks as a single burst.
+func (c *writeCache) commit() (err error) {
+	if c.start < 0 {
+		return
+	}
+
+	for i := 0; i < c.blocks; {
+		if !c.dirty[i] {
+			i++
+			continue
+		}
+
+		end := i
+
+		for end < c.blocks && c.dirty[end] {
+			end++
+		}
+
+		slice := c.buf[i*c.blockSize : end*c.blockSize]
+
+		if err = c.stats.write(len(slice), c.card.WriteBlocks((c.start+i)*c.mult, slice)); err != nil {
+			return
+		}
+
+		for ; i < end; i++ {
+			c.dirty[i] = false
+		}
+	}
+
+	return
+}
+
+// release frees the cache DMA buffer, cached blocks must be committed
+// beforehand.
+func (c *writeCache) release() {
+	c.Lock()
+	defer c.Unlock()
+
+	c.timer.Stop()
+	c.start = -1
+
+	c.pool.Release(c.addr)
+}
+
+// writeCache returns the write-back cache instance, when enabled.
+func (d *Drive) writeCache() *writeCache {
+	if !d.Cipher || !d.Keyring.Conf.Settings.GetWriteCache() {
+		return nil
+	}
+
+	if d.cache == nil {
+		d.cache = newWriteCache(d.card, &d.stats, d.Pool, d.card.Info().BlockSize*d.Mult, d.Mult)
+	}
+
+	return d.cache
+}
+
+// flush commits cached writes, if any, to the card.
+func (d *Drive) flush() (err error) {
+	if d.cache == nil {
+		return
+	}
+
+	return d.cache.flush()
+}
+
+// releaseCache commits cached writes, if any, and releases the cache.
+func (d *Drive) releaseCache() (err error) {
+	if d.cache == nil {
+		return
+	}
+
+	if err = d.cache.flush(); err != nil {
+		return
+	}
+
+	d.cache.release()
+	d.cache = nil
+
+	return
+}
+
+// deferredError returns, as deferred error, the failure of a background
+// cache commit not yet reported to the host.
+func (d *Drive) deferredError() error {
+	if d.cache == nil {
+		return nil
+	}
+
+	if err := d.cache.deferred(); err != nil {
+		return &checkCondition{
+			senseData: senseData{key: MEDIUM_ERROR, code: WRITE_ERROR, deferred: true},
+			err:       err,
+		}
+	}
+
+	return nil
+}
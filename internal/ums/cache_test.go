@@ -0,0 +1,245 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ums
+
+import (
+	"bytes"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/usbarmory/armory-drive/internal/emulator"
+
+	"github.com/usbarmory/tamago/dma"
+	"github.com/usbarmory/tamago/soc/nxp/usb"
+)
+
+// failingCard represents an emulated card whose writes fail on demand.
+type failingCard struct {
+	*emulator.Card
+	fail atomic.Bool
+}
+
+func (c *failingCard) WriteBlocks(lba int, buf []byte) error {
+	if c.fail.Load() {
+		return errors.New("card write error")
+	}
+
+	return c.Card.WriteBlocks(lba, buf)
+}
+
+// newTestCache returns an unlocked drive with the write-back cache enabled.
+func newTestCache(t *testing.T) (d *Drive, card *failingCard) {
+	d, c := newTestDrive(t, true)
+
+	card = &failingCard{Card: c}
+	d.card = card
+
+	d.Keyring.Conf.Settings.WriteCache = true
+	unlockTestDrive(t, d, testKEK)
+
+	return
+}
+
+// pattern returns plaintext logical blocks filled with a value derived from
+// their address.
+func pattern(d *Drive, lba int, blocks int) (buf []byte) {
+	blockSize := d.card.Info().BlockSize * d.Mult
+
+	for i := 0; i < blocks; i++ {
+		buf = append(buf, bytes.Repeat([]byte{byte(lba + i + 1)}, blockSize)...)
+	}
+
+	return
+}
+
+func writeTest(t *testing.T, d *Drive, lba int, blocks int) {
+	t.Helper()
+
+	// the buffer is encrypted in place
+	if err := d.write(lba, pattern(d, lba, blocks)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTest(t *testing.T, d *Drive, lba int, blocks int) {
+	t.Helper()
+
+	data, err := d.read(lba, blocks)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reserved, addr := dma.Reserved(data); reserved {
+		defer d.Pool.Release(addr)
+	}
+
+	if !bytes.Equal(data, pattern(d, lba, blocks)) {
+		t.Fatalf("LBA %d: unexpected plaintext", lba)
+	}
+}
+
+// committed returns whether a logical block has been written to the card.
+func committed(d *Drive, card *failingCard, lba int) bool {
+	return card.Block(lba*d.Mult) != nil
+}
+
+func TestWriteCacheOverlay(t *testing.T) {
+	d, card := newTestCache(t)
+
+	writeTest(t, d, 8, 4)
+
+	if committed(d, card, 8) {
+		t.Fatal("cached blocks written through")
+	}
+
+	readTest(t, d, 8, 4)
+	// partial overlap
+	readTest(t, d, 10, 1)
+
+	// cached blocks are overlaid on committed ones
+	writeTest(t, d, 20, 1)
+
+	if err := d.flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeTest(t, d, 9, 2)
+	readTest(t, d, 8, 4)
+
+	// writes not fitting the cache window commit it beforehand
+	blocks := WRITE_CACHE_SIZE / (d.card.Info().BlockSize * d.Mult)
+	writeTest(t, d, blocks-1, 2)
+
+	if !committed(d, card, 9) {
+		t.Fatal("cached blocks not committed before write through")
+	}
+
+	readTest(t, d, 8, 4)
+	readTest(t, d, blocks-1, 2)
+}
+
+func TestWriteCacheSynchronize(t *testing.T) {
+	d, card := newTestCache(t)
+
+	for _, op := range []byte{SYNCHRONIZE_CACHE_10, SYNCHRONIZE_CACHE_16} {
+		writeTest(t, d, 1, 2)
+
+		if committed(d, card, 1) {
+			t.Fatal("cached blocks written through")
+		}
+
+		if _, _, _, err := d.handleCDB([16]byte{op}, &usb.CBW{}); err != nil {
+			t.Fatal(err)
+		}
+
+		if !committed(d, card, 1) || !committed(d, card, 2) {
+			t.Fatalf("cached blocks not committed by %#x", op)
+		}
+
+		card.SetBlock(1*d.Mult, nil)
+		card.SetBlock(2*d.Mult, nil)
+	}
+
+	// commit failures are reported as current errors
+	writeTest(t, d, 1, 1)
+	card.fail.Store(true)
+
+	_, _, _, err := d.handleCDB([16]byte{SYNCHRONIZE_CACHE_10}, &usb.CBW{})
+
+	if s := senseOf(err); s.key != MEDIUM_ERROR || s.code != WRITE_ERROR || s.deferred {
+		t.Fatalf("unexpected error %v (%+v)", err, s)
+	}
+}
+
+func TestWriteCacheDeferredError(t *testing.T) {
+	d, card := newTestCache(t)
+
+	writeTest(t, d, 1, 1)
+	card.fail.Store(true)
+
+	deadline := time.Now().Add(WRITE_CACHE_DELAY + 5*time.Second)
+
+	for d.stats.cacheErrors.Load() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("background commit timeout")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	card.fail.Store(false)
+
+	// the failure is reported at the next command
+	if _, err := d.rx(cbw(1, 0, false, TEST_UNIT_READY, 0, 0, 0, 0, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := csw(t, d); c.Tag != 1 || c.Status != usb.CSW_STATUS_COMMAND_FAILED {
+		t.Fatalf("unexpected CSW %+v", c)
+	}
+
+	if _, err := d.rx(cbw(2, senseLength, true, REQUEST_SENSE, 0, 0, 0, senseLength, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sense := <-d.send
+
+	if len(sense) != senseLength || sense[0] != DEFERRED_ERROR || sense[2] != MEDIUM_ERROR || sense[12] != WRITE_ERROR>>8 {
+		t.Fatalf("unexpected sense data %x", sense)
+	}
+
+	if c := csw(t, d); c.Tag != 2 || c.Status != usb.CSW_STATUS_COMMAND_PASSED {
+		t.Fatalf("unexpected CSW %+v", c)
+	}
+
+	// deferred errors are reported once
+	if _, err := d.rx(cbw(3, 0, false, TEST_UNIT_READY, 0, 0, 0, 0, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := csw(t, d); c.Tag != 3 || c.Status != usb.CSW_STATUS_COMMAND_PASSED {
+		t.Fatalf("unexpected CSW %+v", c)
+	}
+}
+
+func TestWriteCacheLock(t *testing.T) {
+	d, card := newTestCache(t)
+
+	writeTest(t, d, 1, 1)
+
+	if committed(d, card, 1) {
+		t.Fatal("cached blocks written through")
+	}
+
+	if err := d.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if !committed(d, card, 1) {
+		t.Fatal("cached blocks not committed on lock")
+	}
+
+	// committed blocks are readable after unlock
+	unlockTestDrive(t, d, testKEK)
+	readTest(t, d, 1, 1)
+
+	// commit failures are reported on lock, which completes regardless
+	writeTest(t, d, 2, 1)
+	card.fail.Store(true)
+
+	if err := d.Lock(); err == nil {
+		t.Fatal("commit failure not reported")
+	}
+
+	if d.Ready() {
+		t.Fatal("drive ready after lock")
+	}
+}
@@ -0,0 +1,211 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ums
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+
+	"github.com/usbarmory/armory-drive/api"
+)
+
+// formatted returns whether a block carries the MBR (or boot sector)
+// signature, which is present on partitioned or formatted volumes.
+func formatted(block []byte) bool {
+	return len(block) >= blockSize && binary.LittleEndian.Uint16(block[blockSize-2:]) == bootSignature
+}
+
+func multiplier(settings *api.Configuration) int {
+	if n := settings.GetBlockSizeMultiplier(); n > 0 {
+		return int(n)
+	}
+
+	return BLOCK_SIZE_MULTIPLIER
+}
+
+func (d *Drive) readPipelineSize() int {
+	if n := d.Keyring.Conf.Settings.GetReadPipelineSize(); n > 0 {
+		return int(n)
+	}
+
+	return READ_PIPELINE_SIZE
+}
+
+func (d *Drive) writePipelineSize() int {
+	if n := d.Keyring.Conf.Settings.GetWritePipelineSize(); n > 0 {
+		return int(n)
+	}
+
+	return WRITE_PIPELINE_SIZE
+}
+
+// printable returns whether a string consists of printable ASCII characters
+// only.
+func printable(s string) bool {
+	for _, c := range []byte(s) {
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// identity returns the configured vendor and product identification, or the
+// default ones.
+func identity(settings *api.Configuration) (vendor string, product string) {
+	vendor = VendorID
+	product = ProductID
+
+	if v := settings.GetUSBVendor(); len(v) > 0 {
+		vendor = v
+	}
+
+	if p := settings.GetUSBProduct(); len(p) > 0 {
+		product = p
+	}
+
+	return
+}
+
+// readOnly returns whether encrypted storage is exposed as write protected.
+func (d *Drive) readOnly() bool {
+	return d.Cipher && d.Keyring.Conf.Settings.GetReadOnly()
+}
+
+// Validate checks configuration parameters against supported ranges, as well
+// as against the block size multiplier of the formatted volume, if any.
+func (d *Drive) Validate(settings *api.Configuration) (err error) {
+	mult := settings.GetBlockSizeMultiplier()
+
+	if mult > MAX_BLOCK_SIZE_MULTIPLIER || mult&(mult-1) != 0 {
+		return fmt.Errorf("invalid block size multiplier %d", mult)
+	}
+
+	if n := settings.GetReadPipelineSize(); n > MAX_PIPELINE_SIZE {
+		return fmt.Errorf("invalid read pipeline size %d", n)
+	}
+
+	if n := settings.GetWritePipelineSize(); n > MAX_PIPELINE_SIZE {
+		return fmt.Errorf("invalid write pipeline size %d", n)
+	}
+
+	if _, ok := api.LEDPolicy_name[int32(settings.GetLEDPolicy())]; !ok {
+		return fmt.Errorf("invalid LED policy %d", settings.GetLEDPolicy())
+	}
+
+	if v := settings.GetUSBVendor(); len(v) > len(VendorID) || !printable(v) {
+		return fmt.Errorf("invalid USB vendor %q", v)
+	}
+
+	if p := settings.GetUSBProduct(); len(p) > len(ProductID) || !printable(p) {
+		return fmt.Errorf("invalid USB product %q", p)
+	}
+
+	if vol := d.Keyring.Conf.VolumeMultiplier; vol != 0 && multiplier(settings) != vol {
+		return fmt.Errorf("volume formatted with %d bytes logical blocks", vol*d.card.Info().BlockSize)
+	}
+
+	return
+}
+
+// Configure applies the configured block size multiplier and arms the idle
+// lock policy, it must be invoked once the FDE key is set and before the
+// drive is made ready.
+//
+// The configured multiplier is ignored on formatted volumes, which retain the
+// one in use at format time.
+func (d *Drive) Configure() (err error) {
+	if !d.Cipher {
+		return
+	}
+
+	conf := d.Keyring.Conf
+	mult := multiplier(conf.Settings)
+
+	d.stats.reset()
+
+	// The first 512 bytes of logical block 0 decrypt identically
+	// regardless of the multiplier, as their IV (or tweak) is not
+	// affected by the logical block size.
+	blockSize := d.card.Info().BlockSize * d.Mult
+	addr, block := d.Pool.Reserve(blockSize, true)
+	defer d.Pool.Release(addr)
+
+	if err = d.readBlocks(0, 1, block); err != nil {
+		return
+	}
+
+	if formatted(block) {
+		if conf.VolumeMultiplier != 0 {
+			mult = conf.VolumeMultiplier
+		} else {
+			// volume formatted before multiplier tracking
+			mult = BLOCK_SIZE_MULTIPLIER
+		}
+	}
+
+	// the write-back cache, committed at lock, is released once disabled
+	if !conf.Settings.GetWriteCache() {
+		if err = d.releaseCache(); err != nil {
+			return
+		}
+	}
+
+	if err = d.setMultiplier(mult); err != nil {
+		return
+	}
+
+	d.track(block)
+
+	d.LockTrigger = api.LockTrigger_NO_TRIGGER
+	d.armIdleLock()
+
+	return
+}
+
+// track records the block size multiplier once the volume is found formatted
+// from its first logical block plaintext, either at unlock or when written by
+// the host.
+//
+// The multiplier is only recorded with an enrolled KEK verifier, which
+// ensures that the FDE key has been set with a verified KEK (see
+// crypto.Keyring.VerifyKEK()). A recorded multiplier is never cleared.
+func (d *Drive) track(block []byte) {
+	conf := d.Keyring.Conf
+
+	if !d.Keyring.KEKEnrolled() || !formatted(block) || conf.VolumeMultiplier != 0 {
+		return
+	}
+
+	conf.VolumeMultiplier = d.Mult
+
+	if err := d.Keyring.Save(); err != nil {
+		log.Printf("could not save volume block size multiplier, %v", err)
+	}
+}
+
+// setMultiplier changes the logical block size, the cache and read-ahead
+// buffers, sized after it, are released accordingly.
+func (d *Drive) setMultiplier(mult int) (err error) {
+	if mult == d.Mult {
+		return
+	}
+
+	if err = d.releaseCache(); err != nil {
+		return
+	}
+
+	if d.ahead != nil {
+		d.ahead.release(d.Pool)
+		d.ahead = nil
+	}
+
+	d.Mult = mult
+
+	return
+}
@@ -0,0 +1,109 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ums
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/usbarmory/armory-drive/api"
+)
+
+func TestValidate(t *testing.T) {
+	d, _ := newTestDrive(t, true)
+
+	for _, tc := range []struct {
+		name     string
+		settings *api.Configuration
+		volume   int
+		valid    bool
+	}{
+		{"defaults", &api.Configuration{}, 0, true},
+		{"multiplier", &api.Configuration{BlockSizeMultiplier: 4}, 0, true},
+		{"maximum multiplier", &api.Configuration{BlockSizeMultiplier: MAX_BLOCK_SIZE_MULTIPLIER}, 0, true},
+		{"multiplier not a power of 2", &api.Configuration{BlockSizeMultiplier: 3}, 0, false},
+		{"multiplier not a power of 2 (upper bits)", &api.Configuration{BlockSizeMultiplier: 6}, 0, false},
+		{"multiplier too large", &api.Configuration{BlockSizeMultiplier: 2 * MAX_BLOCK_SIZE_MULTIPLIER}, 0, false},
+		{"maximum pipelines", &api.Configuration{ReadPipelineSize: MAX_PIPELINE_SIZE, WritePipelineSize: MAX_PIPELINE_SIZE}, 0, true},
+		{"read pipeline too large", &api.Configuration{ReadPipelineSize: MAX_PIPELINE_SIZE + 1}, 0, false},
+		{"write pipeline too large", &api.Configuration{WritePipelineSize: MAX_PIPELINE_SIZE + 1}, 0, false},
+		{"LED policy", &api.Configuration{LEDPolicy: api.LEDPolicy_LED_STEALTH}, 0, true},
+		{"invalid LED policy", &api.Configuration{LEDPolicy: api.LEDPolicy(3)}, 0, false},
+		{"USB strings", &api.Configuration{USBVendor: "Vendor", USBProduct: "Product ~!"}, 0, true},
+		{"non-printable USB vendor", &api.Configuration{USBVendor: "Vendor\n"}, 0, false},
+		{"non-printable USB vendor (UTF-8)", &api.Configuration{USBVendor: "Vendör"}, 0, false},
+		{"non-printable USB product", &api.Configuration{USBProduct: "Prod\x7fuct"}, 0, false},
+		{"USB vendor too long", &api.Configuration{USBVendor: strings.Repeat("V", len(VendorID)+1)}, 0, false},
+		{"USB product too long", &api.Configuration{USBProduct: strings.Repeat("P", len(ProductID)+1)}, 0, false},
+		{"volume multiplier", &api.Configuration{BlockSizeMultiplier: 4}, 4, true},
+		{"default volume multiplier", &api.Configuration{}, BLOCK_SIZE_MULTIPLIER, true},
+		{"volume multiplier mismatch", &api.Configuration{BlockSizeMultiplier: 4}, BLOCK_SIZE_MULTIPLIER, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d.Keyring.Conf.VolumeMultiplier = tc.volume
+
+			if err := d.Validate(tc.settings); (err == nil) != tc.valid {
+				t.Fatalf("unexpected validation result %v", err)
+			}
+		})
+	}
+}
+
+func TestVolumeMultiplier(t *testing.T) {
+	d, _ := newTestDrive(t, true)
+
+	// FDE key set without a verified KEK, as no verifier is enrolled
+	if err := d.Keyring.SetCipher(d.Keyring.Conf.Settings.Cipher, testKEK); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Configure(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.SetReady(true)
+
+	// format the volume
+	mbr := make([]byte, d.card.Info().BlockSize*d.Mult)
+	binary.LittleEndian.PutUint16(mbr[blockSize-2:], bootSignature)
+
+	if err := d.write(0, mbr); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Keyring.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := d.Keyring.Conf.VolumeMultiplier; n != 0 {
+		t.Fatalf("volume multiplier %d recorded without a verified KEK", n)
+	}
+
+	// the multiplier is recorded at unlock with a verified KEK
+	unlockTestDrive(t, d, testKEK)
+
+	if err := d.Keyring.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := d.Keyring.Conf.VolumeMultiplier; n != d.Mult {
+		t.Fatalf("unexpected volume multiplier %d", n)
+	}
+
+	// and retained once the configured one changes
+	d.Keyring.Conf.Settings.BlockSizeMultiplier = 4
+
+	if err := d.Validate(d.Keyring.Conf.Settings); err == nil {
+		t.Fatal("volume multiplier change accepted")
+	}
+}
@@ -0,0 +1,112 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ums
+
+import (
+	"encoding/binary"
+
+	"github.com/usbarmory/tamago/soc/nxp/usb"
+)
+
+const (
+	// Management interface endpoints
+	mgmtInEndpoint  = 0x84
+	mgmtOutEndpoint = 0x04
+
+	VENDOR_SPECIFIC_CLASS = 0xff
+
+	// MANAGEMENT_FRAME_MAX represents the maximum management frame size.
+	MANAGEMENT_FRAME_MAX = 16 * 1024
+
+	mgmtHeaderLength = 2
+)
+
+// ManagementHandler represents the management protocol handler, which
+// receives a serialized api.Envelope request and returns the serialized
+// api.Envelope response.
+type ManagementHandler func(req []byte) (res []byte)
+
+// mgmt represents the management interface state.
+type mgmt struct {
+	// received data pending frame completion
+	buf []byte
+	// queue for IN responses
+	send chan []byte
+}
+
+// configureManagement returns the vendor specific management interface, its
+// bulk endpoints carry api.Envelope messages, each preceded by its length as
+// a 16-bit big-endian value.
+func (d *Drive) configureManagement(device *usb.Device) (iface *usb.InterfaceDescriptor) {
+	d.mgmt = &mgmt{
+		send: make(chan []byte, 1),
+	}
+
+	iface = &usb.InterfaceDescriptor{}
+	iface.SetDefaults()
+	iface.NumEndpoints = 2
+	iface.InterfaceClass = VENDOR_SPECIFIC_CLASS
+
+	iInterface, _ := device.AddString(`Armory Drive Management`)
+	iface.Interface = iInterface
+
+	epIN := &usb.EndpointDescriptor{}
+	epIN.SetDefaults()
+	epIN.EndpointAddress = mgmtInEndpoint
+	epIN.Attributes = 2
+	epIN.MaxPacketSize = maxPacketSize
+	epIN.Zero = true
+	epIN.Function = d.mgmtTx
+
+	iface.Endpoints = append(iface.Endpoints, epIN)
+
+	epOUT := &usb.EndpointDescriptor{}
+	epOUT.SetDefaults()
+	epOUT.EndpointAddress = mgmtOutEndpoint
+	epOUT.Attributes = 2
+	epOUT.MaxPacketSize = maxPacketSize
+	epOUT.Zero = false
+	epOUT.Function = d.mgmtRx
+
+	iface.Endpoints = append(iface.Endpoints, epOUT)
+
+	return
+}
+
+func (d *Drive) mgmtRx(buf []byte, lastErr error) (res []byte, err error) {
+	m := d.mgmt
+	m.buf = append(m.buf, buf...)
+
+	for len(m.buf) >= mgmtHeaderLength {
+		size := int(binary.BigEndian.Uint16(m.buf))
+
+		if size > MANAGEMENT_FRAME_MAX {
+			// drop data to resynchronize with the host
+			m.buf = nil
+			return
+		}
+
+		if len(m.buf) < mgmtHeaderLength+size {
+			return
+		}
+
+		req := m.buf[mgmtHeaderLength : mgmtHeaderLength+size]
+		m.buf = m.buf[mgmtHeaderLength+size:]
+
+		out := d.Management(req)
+
+		frame := make([]byte, mgmtHeaderLength, mgmtHeaderLength+len(out))
+		binary.BigEndian.PutUint16(frame, uint16(len(out)))
+
+		m.send <- append(frame, out...)
+	}
+
+	return
+}
+
+func (d *Drive) mgmtTx(_ []byte, lastErr error) (in []byte, err error) {
+	return <-d.mgmt.send, nil
+}
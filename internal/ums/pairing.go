@@ -23,11 +23,15 @@ import (
 const readme = `
 Please download the F-Secure Armory Drive application from the iOS App Store
 and scan file QR.png
+
+Alternatively pair with a host through the armory-drive-ctl tool and file
+PAIRING.BIN.
 `
 
 // pairing disk paths (8.3 format)
 const (
 	codePath       = "QR.PNG"
+	codeDataPath   = "PAIRING.BIN"
 	readmePath     = "README.TXT"
 	versionPath    = "VERSION.TXT"
 	checkpointPath = "LASTCHKP.BIN"
@@ -105,7 +109,7 @@ func (q *PairingDisk) WriteBlocks(lba int, buf []byte) (err error) {
 	return
 }
 
-func Pairing(code []byte, keyring *crypto.Keyring) (card *PairingDisk) {
+func Pairing(code []byte, codeData []byte, keyring *crypto.Keyring) (card *PairingDisk) {
 	img, err := os.OpenFile(pairingDiskPath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0600)
 
 	if err != nil {
@@ -150,6 +154,7 @@ func Pairing(code []byte, keyring *crypto.Keyring) (card *PairingDisk) {
 		}
 
 		_ = addFile(root, readmePath, []byte(readme))
+		_ = addFile(root, codeDataPath, codeData)
 	}
 
 	_ = addFile(root, versionPath, []byte(assets.Revision))
@@ -0,0 +1,26 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build tamago
+
+package ums
+
+import (
+	"github.com/usbarmory/armory-drive/internal/crypto"
+	"github.com/usbarmory/armory-drive/internal/ota"
+
+	"github.com/usbarmory/tamago/soc/nxp/imx6ul"
+)
+
+// uniqueID returns the NXP Unique ID.
+func uniqueID() [8]byte {
+	return imx6ul.UniqueID()
+}
+
+// checkUpdate verifies and applies a firmware update, if present on the
+// pairing disk.
+func checkUpdate(buf []byte, path string, off int, keyring *crypto.Keyring) {
+	ota.Check(buf, path, off, keyring)
+}
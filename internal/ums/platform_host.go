@@ -0,0 +1,21 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ums
+
+import (
+	"github.com/usbarmory/armory-drive/internal/crypto"
+)
+
+// The NXP Unique ID and firmware updates are only available on the USB
+// armory, host builds are meant for test cases.
+
+func uniqueID() (uid [8]byte) {
+	return
+}
+
+func checkUpdate(buf []byte, path string, off int, keyring *crypto.Keyring) {}
@@ -0,0 +1,227 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ums
+
+import (
+	"sync"
+
+	"github.com/usbarmory/armory-drive/internal/pool"
+)
+
+const (
+	// READ_AHEAD_SIZE represents the size of each read-ahead buffer.
+	READ_AHEAD_SIZE = 512 * 1024
+
+	// READ_AHEAD_BUFFERS represents the number of read-ahead buffers,
+	// allowing prefetching of the next range while the current one is
+	// being consumed.
+	READ_AHEAD_BUFFERS = 2
+)
+
+// prefetch represents a range of logical blocks read, and decrypted, ahead
+// of host requests.
+type prefetch struct {
+	lba    int
+	blocks int
+
+	addr uint
+	buf  []byte
+
+	// closed on read completion
+	done chan struct{}
+	err  error
+}
+
+// readAhead represents the sequential read-ahead engine.
+type readAhead struct {
+	sync.Mutex
+
+	// logical block size
+	blockSize int
+
+	// next sequential logical block
+	next int
+
+	// buffers available for prefetching
+	pool []*prefetch
+	// prefetched ranges, in ascending order
+	ranges []*prefetch
+}
+
+func newReadAhead(p *pool.Pool, blockSize int) (r *readAhead) {
+	r = &readAhead{
+		blockSize: blockSize,
+		next:      -1,
+	}
+
+	for i := 0; i < READ_AHEAD_BUFFERS; i++ {
+		pf := &prefetch{}
+		pf.addr, pf.buf = p.Reserve(READ_AHEAD_SIZE, true)
+		r.pool = append(r.pool, pf)
+	}
+
+	return
+}
+
+// fetch returns a pool buffer with the requested logical blocks if entirely
+// prefetched, waiting for any prefetch in progress.
+func (r *readAhead) fetch(p *pool.Pool, lba int, blocks int) (data []byte, ok bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	for _, pf := range r.ranges {
+		if lba < pf.lba || lba+blocks > pf.lba+pf.blocks {
+			continue
+		}
+
+		<-pf.done
+
+		if pf.err != nil {
+			return
+		}
+
+		start := (lba - pf.lba) * r.blockSize
+		end := start + blocks*r.blockSize
+
+		_, data = p.Reserve(end-start, true)
+		copy(data, pf.buf[start:end])
+
+		return data, true
+	}
+
+	return
+}
+
+// advance tracks the last host read, on sequential access the following
+// logical blocks are prefetched within the given disk size.
+func (r *readAhead) advance(d *Drive, lba int, blocks int, size int) {
+	r.Lock()
+	defer r.Unlock()
+
+	sequential := lba == r.next
+	r.next = lba + blocks
+
+	// release ranges already consumed
+	for len(r.ranges) > 0 {
+		p := r.ranges[0]
+
+		if p.lba+p.blocks > r.next && sequential {
+			break
+		}
+
+		r.drop(0)
+	}
+
+	if !sequential {
+		return
+	}
+
+	for len(r.pool) > 0 && d.Ready() {
+		next := r.next
+
+		if n := len(r.ranges); n > 0 {
+			next = r.ranges[n-1].lba + r.ranges[n-1].blocks
+		}
+
+		blocks := min(READ_AHEAD_SIZE/r.blockSize, size-next)
+
+		if blocks <= 0 {
+			return
+		}
+
+		p := r.pool[0]
+		r.pool = r.pool[1:]
+
+		p.lba = next
+		p.blocks = blocks
+		p.err = nil
+		p.done = make(chan struct{})
+
+		r.ranges = append(r.ranges, p)
+
+		go func() {
+			defer close(p.done)
+			p.err = d.readBlocks(p.lba, p.blocks, p.buf[0:p.blocks*r.blockSize])
+		}()
+	}
+}
+
+// invalidate discards prefetched ranges overlapping the given logical blocks.
+func (r *readAhead) invalidate(lba int, blocks int) {
+	r.Lock()
+	defer r.Unlock()
+
+	for i := 0; i < len(r.ranges); {
+		p := r.ranges[i]
+
+		if lba < p.lba+p.blocks && p.lba < lba+blocks {
+			r.drop(i)
+		} else {
+			i++
+		}
+	}
+}
+
+// reset discards, and zeroises, all prefetched ranges.
+func (r *readAhead) reset() {
+	r.Lock()
+	defer r.Unlock()
+
+	for len(r.ranges) > 0 {
+		r.drop(0)
+	}
+
+	for _, p := range r.pool {
+		clear(p.buf)
+	}
+
+	r.next = -1
+}
+
+// drop returns a prefetched range buffer to the pool, once its read is
+// complete.
+func (r *readAhead) drop(i int) {
+	p := r.ranges[i]
+	<-p.done
+
+	r.ranges = append(r.ranges[:i], r.ranges[i+1:]...)
+	r.pool = append(r.pool, p)
+}
+
+// release discards all prefetched ranges and returns the DMA buffers to the
+// pool.
+func (r *readAhead) release(p *pool.Pool) {
+	r.reset()
+
+	for _, pf := range r.pool {
+		p.Release(pf.addr)
+	}
+
+	r.pool = nil
+}
+
+// readAhead returns the read-ahead engine instance, which is only used on
+// encrypted drives.
+func (d *Drive) readAhead() *readAhead {
+	if !d.Cipher {
+		return nil
+	}
+
+	if d.ahead == nil {
+		d.ahead = newReadAhead(d.Pool, d.card.Info().BlockSize*d.Mult)
+	}
+
+	return d.ahead
+}
+
+// invalidate discards read-ahead data overlapping the given logical blocks.
+func (d *Drive) invalidate(lba int, blocks int) {
+	if d.ahead == nil {
+		return
+	}
+
+	d.ahead.invalidate(lba, blocks)
+}
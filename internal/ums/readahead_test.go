@@ -0,0 +1,120 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ums
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/usbarmory/tamago/dma"
+)
+
+// newTestReadAhead returns an unlocked drive with its first logical blocks
+// written, and prefetched after sequential reads.
+func newTestReadAhead(t *testing.T) (d *Drive) {
+	d, _ = newTestDrive(t, true)
+	d.Keyring.Conf.Settings.Scrub = true
+	unlockTestDrive(t, d, testKEK)
+
+	writeTest(t, d, 0, 64)
+	readTest(t, d, 0, 4)
+	readTest(t, d, 4, 4)
+
+	if !prefetched(d, 8) {
+		t.Fatal("sequential read not prefetched")
+	}
+
+	return
+}
+
+// prefetched returns whether a logical block is in a prefetched range.
+func prefetched(d *Drive, lba int) bool {
+	d.ahead.Lock()
+	defer d.ahead.Unlock()
+
+	for _, p := range d.ahead.ranges {
+		if lba >= p.lba && lba < p.lba+p.blocks {
+			return true
+		}
+	}
+
+	return false
+}
+
+// readBlock returns a copy of a logical block.
+func readBlock(t *testing.T, d *Drive, lba int) []byte {
+	t.Helper()
+
+	data, err := d.read(lba, 1)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if reserved, addr := dma.Reserved(data); reserved {
+		defer d.Pool.Release(addr)
+	}
+
+	return append([]byte{}, data...)
+}
+
+func TestReadAheadWrite(t *testing.T) {
+	d := newTestReadAhead(t)
+
+	blockSize := d.card.Info().BlockSize * d.Mult
+	block := bytes.Repeat([]byte{0xee}, blockSize)
+
+	if err := d.write(10, append([]byte{}, block...)); err != nil {
+		t.Fatal(err)
+	}
+
+	if prefetched(d, 10) {
+		t.Fatal("prefetched range not invalidated by overlapping write")
+	}
+
+	if !bytes.Equal(readBlock(t, d, 10), block) {
+		t.Fatal("stale read-ahead data")
+	}
+
+	readTest(t, d, 11, 1)
+}
+
+func TestReadAheadUnmap(t *testing.T) {
+	d := newTestReadAhead(t)
+
+	if err := d.unmapList(unmapParameterList([2]int{12, 1})); err != nil {
+		t.Fatal(err)
+	}
+
+	if prefetched(d, 12) {
+		t.Fatal("prefetched range not invalidated by UNMAP")
+	}
+
+	if bytes.Equal(readBlock(t, d, 12), pattern(d, 12, 1)) {
+		t.Fatal("stale read-ahead data")
+	}
+}
+
+func TestReadAheadLock(t *testing.T) {
+	d := newTestReadAhead(t)
+	buffers := len(d.ahead.pool) + len(d.ahead.ranges)
+
+	if err := d.Lock(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(d.ahead.ranges) != 0 || len(d.ahead.pool) != buffers {
+		t.Fatal("prefetched ranges not discarded on lock")
+	}
+
+	for i, p := range d.ahead.pool {
+		if !bytes.Equal(p.buf, make([]byte, len(p.buf))) {
+			t.Fatalf("read-ahead buffer %d not zeroised on lock", i)
+		}
+	}
+}
@@ -11,9 +11,8 @@ import (
 	"fmt"
 	"sync"
 
-	"github.com/usbarmory/armory-drive/internal/ota"
+	"github.com/usbarmory/armory-drive/api"
 
-	"github.com/usbarmory/tamago/dma"
 	"github.com/usbarmory/tamago/soc/nxp/usb"
 
 	"golang.org/x/sync/errgroup"
@@ -21,16 +20,20 @@ import (
 
 const (
 	// p65, 3. Direct Access Block commands (SPC-5 and SBC-4), SCSI Commands Reference Manual, Rev. J
-	TEST_UNIT_READY  = 0x00
-	REQUEST_SENSE    = 0x03
-	INQUIRY          = 0x12
-	MODE_SENSE_6     = 0x1a
-	START_STOP_UNIT  = 0x1b
-	MODE_SENSE_10    = 0x5a
-	READ_CAPACITY_10 = 0x25
-	READ_10          = 0x28
-	WRITE_10         = 0x2a
-	REPORT_LUNS      = 0xa0
+	TEST_UNIT_READY      = 0x00
+	REQUEST_SENSE        = 0x03
+	INQUIRY              = 0x12
+	MODE_SENSE_6         = 0x1a
+	START_STOP_UNIT      = 0x1b
+	MODE_SENSE_10        = 0x5a
+	READ_CAPACITY_10     = 0x25
+	READ_10              = 0x28
+	WRITE_10             = 0x2a
+	UNMAP                = 0x42
+	WRITE_SAME_16        = 0x93
+	SYNCHRONIZE_CACHE_10 = 0x35
+	SYNCHRONIZE_CACHE_16 = 0x91
+	REPORT_LUNS          = 0xa0
 
 	// service actions
 	SERVICE_ACTION   = 0x9e
@@ -42,6 +45,21 @@ const (
 	// p33, 4.10, USB Mass Storage Class – UFI Command Specification Rev. 1.0
 	READ_FORMAT_CAPACITIES = 0x23
 
+	// Vital Product Data pages
+	SUPPORTED_VPD_PAGES        = 0x00
+	BLOCK_LIMITS_VPD_PAGE      = 0xb0
+	LOGICAL_BLOCK_PROVISIONING = 0xb2
+
+	// mode pages
+	CACHING_MODE_PAGE = 0x08
+	ALL_MODE_PAGES    = 0x3f
+
+	// These parameters are reported in the Block Limits VPD page to bound
+	// the range of a single UNMAP (or WRITE SAME with UNMAP bit) command,
+	// which is scrubbed synchronously before its status is returned.
+	UNMAP_MAX_BLOCKS      = 0x400
+	UNMAP_MAX_DESCRIPTORS = 64
+
 	// To speed up FDE it is beneficial to report a larger block size, to
 	// reduce the number of encryption/decryption iterations caused by
 	// per-block IV computation.
@@ -55,29 +73,52 @@ const (
 	// uSDHC read/write.
 	READ_PIPELINE_SIZE  = 12
 	WRITE_PIPELINE_SIZE = 20
+
+	// These parameters bound the runtime configuration of the block size
+	// multiplier and pipeline sizes.
+	MAX_BLOCK_SIZE_MULTIPLIER = 8
+	MAX_PIPELINE_SIZE         = 64
 )
 
 type writeOp struct {
+	op     byte
 	csw    *usb.CSW
 	lba    int
 	blocks int
 	size   int
 	addr   uint
 	buf    []byte
+
+	// data-out bytes received so far, when discarded
+	received int
+}
+
+// discarded accounts a data-out transfer of an operation whose data is
+// discarded, returning whether more data is expected from the host.
+//
+// The data stage ends once the expected size is received or on a short
+// transfer.
+func (op *writeOp) discarded(n int) bool {
+	if op.csw.Status == usb.CSW_STATUS_COMMAND_PASSED {
+		return false
+	}
+
+	expected := min(op.size-op.received, discardChunkSize)
+	op.received += n
+
+	return op.received < op.size && n == expected
 }
 
 // p94, 3.6.2 Standard INQUIRY data, SCSI Commands Reference Manual, Rev. J
 func (d *Drive) inquiry(length int) (data []byte) {
 	data = make([]byte, 5)
 
-	// device connected, direct access block device
+	// Device connected, direct access block device, also when locked as
+	// the management interface might be used to unlock the drive after
+	// enumeration. The medium is then reported as not present until
+	// unlock (see TEST UNIT READY).
 	data[0] = 0x00
 
-	if !d.Ready {
-		// device not connected
-		data[0] |= (0b001 << 5)
-	}
-
 	// Removable Media
 	data[1] = 0x80
 	// SPC-3 compliant
@@ -90,8 +131,8 @@ func (d *Drive) inquiry(length int) (data []byte) {
 	// unused or obsolete flags
 	data = append(data, make([]byte, 3)...)
 
-	data = append(data, []byte(VendorID)...)
-	data = append(data, []byte(ProductID)...)
+	// space padded vendor and product identification
+	data = append(data, fmt.Sprintf("%-8s%-16s", d.vendor, d.product)...)
 	data = append(data, []byte(ProductRevision)...)
 
 	if length > len(data) {
@@ -104,36 +145,124 @@ func (d *Drive) inquiry(length int) (data []byte) {
 	return
 }
 
-// p56, 2.4.1.2 Fixed format sense data, SCSI Commands Reference Manual, Rev. J
-func (d *Drive) sense(length int) (data []byte, err error) {
-	data = make([]byte, 18)
+// p94, 3.6.1 INQUIRY command, SCSI Commands Reference Manual, Rev. J
+//
+// Vital Product Data pages are returned when the EVPD bit is set, only the
+// pages required to advertise logical block provisioning are supported.
+func (d *Drive) vpd(page byte, length int) (data []byte, err error) {
+	var payload []byte
+
+	switch page {
+	case SUPPORTED_VPD_PAGES:
+		payload = []byte{
+			SUPPORTED_VPD_PAGES,
+			BLOCK_LIMITS_VPD_PAGE,
+		}
+
+		if d.unmapSupported() {
+			payload = append(payload, LOGICAL_BLOCK_PROVISIONING)
+		}
+	case BLOCK_LIMITS_VPD_PAGE:
+		payload = make([]byte, 60)
+
+		// WSNZ: WRITE SAME with zero blocks is not supported
+		payload[0] = 0x01
+
+		if d.unmapSupported() {
+			binary.BigEndian.PutUint32(payload[16:], UNMAP_MAX_BLOCKS)
+			binary.BigEndian.PutUint32(payload[20:], UNMAP_MAX_DESCRIPTORS)
+			// optimal unmap granularity
+			binary.BigEndian.PutUint32(payload[24:], 1)
+			binary.BigEndian.PutUint64(payload[32:], UNMAP_MAX_BLOCKS)
+		}
+	case LOGICAL_BLOCK_PROVISIONING:
+		if !d.unmapSupported() {
+			return nil, fail(ILLEGAL_REQUEST, INVALID_FIELD_IN_CDB, "unsupported VPD page %#x", page)
+		}
+
+		payload = make([]byte, 4)
 
-	if !d.Ready {
-		// sense key: NOT READY
-		data[2] = 0x02
-		// additional sense code: MEDIUM NOT PRESENT
-		data[12] = 0x3a
+		// LBPU: UNMAP supported, LBPWS: WRITE SAME(16) UNMAP supported
+		payload[1] = 0x80 | 0x40
+		// provisioning type: thin provisioned
+		payload[2] = 0b010
+	default:
+		return nil, fail(ILLEGAL_REQUEST, INVALID_FIELD_IN_CDB, "unsupported VPD page %#x", page)
 	}
 
-	// error code
-	data[0] = 0x70
-	// additional sense length
-	data[7] = byte(len(data) - 1 - 7)
+	buf := new(bytes.Buffer)
+
+	// peripheral device type: direct access block device
+	buf.WriteByte(0x00)
+	buf.WriteByte(page)
+	binary.Write(buf, binary.BigEndian, uint16(len(payload)))
+	buf.Write(payload)
+
+	data = buf.Bytes()
 
-	if length < len(data) {
-		return nil, fmt.Errorf("unsupported REQUEST_SENSE transfer length %d > %d", length, len(data))
+	if length < buf.Len() {
+		data = data[0:length]
 	}
 
 	return
 }
 
 // p111, 3.11 MODE SENSE(6) command, SCSI Commands Reference Manual, Rev. J
-func modeSense(length int) (data []byte, err error) {
-	// Unsupported, an empty response is returned on all requests.
-	data = make([]byte, length)
+// 3.12 MODE SENSE(10) command, SCSI Commands Reference Manual, Rev. J
+func (d *Drive) modeSense(cmd [16]byte, length int) (data []byte, err error) {
+	var pages []byte
+
+	// Only the caching mode page is supported, an empty response is
+	// returned for all other pages.
+	switch cmd[2] & 0x3f {
+	case CACHING_MODE_PAGE, ALL_MODE_PAGES:
+		pages = d.cachingModePage()
+	}
+
+	// changeable values, the write cache is configured out-of-band
+	if cmd[2]>>6 == 1 && len(pages) > 2 {
+		clear(pages[2:])
+	}
+
+	buf := new(bytes.Buffer)
+
+	// device-specific parameter, WP: write protected
+	var param byte
+
+	if d.readOnly() {
+		param = 0x80
+	}
 
 	// p378, 5.3.3 Mode parameter header formats, SCSI Commands Reference Manual, Rev. J
-	data[0] = byte(length)
+	if cmd[0] == MODE_SENSE_6 {
+		buf.WriteByte(byte(3 + len(pages)))
+		buf.Write([]byte{0, param, 0})
+	} else {
+		binary.Write(buf, binary.BigEndian, uint16(6+len(pages)))
+		buf.Write([]byte{0, param, 0, 0, 0, 0})
+	}
+
+	buf.Write(pages)
+	data = buf.Bytes()
+
+	if length < buf.Len() {
+		data = data[0:length]
+	}
+
+	return
+}
+
+// Caching mode page, SCSI Commands Reference Manual, Rev. J
+func (d *Drive) cachingModePage() (page []byte) {
+	page = make([]byte, 20)
+
+	page[0] = CACHING_MODE_PAGE
+	page[1] = byte(len(page) - 2)
+
+	// WCE
+	if d.Cipher && d.Keyring.Conf.Settings.GetWriteCache() {
+		page[2] |= 0x04
+	}
 
 	return
 }
@@ -192,9 +321,19 @@ func (d *Drive) readCapacity16(length int) (data []byte, err error) {
 		return nil, fmt.Errorf("invalid block count %d", info.Blocks)
 	}
 
-	binary.Write(buf, binary.BigEndian, uint64(info.Blocks)-1)
-	binary.Write(buf, binary.BigEndian, uint64(info.BlockSize))
-	buf.Grow(32 - buf.Len())
+	blocks := uint64(info.Blocks / d.Mult)
+	blockSize := uint32(info.BlockSize * d.Mult)
+
+	binary.Write(buf, binary.BigEndian, blocks-1)
+	binary.Write(buf, binary.BigEndian, blockSize)
+	buf.Write(make([]byte, 2))
+
+	if d.unmapSupported() {
+		// LBPME: logical block provisioning management enabled
+		buf.WriteByte(0x80)
+	}
+
+	buf.Write(make([]byte, 32-buf.Len()))
 
 	data = buf.Bytes()
 
@@ -212,32 +351,64 @@ func (d *Drive) readFormatCapacities() (data []byte, err error) {
 	blocks := uint32(info.Blocks / d.Mult)
 	blockSize := uint32(info.BlockSize * d.Mult)
 
+	// descriptor code: formatted media
+	code := uint32(0b10)
+
+	if !d.Ready() {
+		// descriptor code: no media present
+		code = 0b11
+	}
+
 	buf := new(bytes.Buffer)
 
 	// capacity list length
 	binary.Write(buf, binary.BigEndian, uint32(8))
 	// number of blocks
 	binary.Write(buf, binary.BigEndian, blocks)
-	// descriptor code: formatted media | block length
-	binary.Write(buf, binary.BigEndian, uint32(0b10<<24|blockSize&0xffffff))
+	// descriptor code | block length
+	binary.Write(buf, binary.BigEndian, uint32(code<<24|blockSize&0xffffff))
 
 	return buf.Bytes(), nil
 }
 
-func (d *Drive) read(lba int, blocks int) (err error) {
-	batch := READ_PIPELINE_SIZE
+func (d *Drive) read(lba int, blocks int) (data []byte, err error) {
 	info := d.card.Info()
-
 	blockSize := info.BlockSize * d.Mult
 
-	if !d.Ready {
-		d.send <- make([]byte, blocks*blockSize)
+	if !d.Ready() {
+		return make([]byte, blocks*blockSize), nil
+	}
+
+	ahead := d.readAhead()
+
+	if ahead != nil {
+		if data, ok := ahead.fetch(d.Pool, lba, blocks); ok {
+			ahead.advance(d, lba, blocks, info.Blocks/d.Mult)
+			return data, nil
+		}
+	}
+
+	addr, buf := d.Pool.Reserve(blocks*blockSize, true)
+
+	if err = d.readBlocks(lba, blocks, buf); err != nil {
+		d.Pool.Release(addr)
 		return
 	}
 
-	addr, buf := dma.Reserve(blocks*blockSize, usb.DTD_PAGE_SIZE)
+	if ahead != nil {
+		ahead.advance(d, lba, blocks, info.Blocks/d.Mult)
+	}
+
+	return buf, nil
+}
+
+// readBlocks reads, and decrypts, logical blocks in the given buffer.
+func (d *Drive) readBlocks(lba int, blocks int, buf []byte) (err error) {
+	batch := d.readPipelineSize()
+	blockSize := d.card.Info().BlockSize * d.Mult
 
 	wg := &sync.WaitGroup{}
+	defer wg.Wait()
 
 	for i := 0; i < blocks; i += batch {
 		if i+batch > blocks {
@@ -248,36 +419,71 @@ func (d *Drive) read(lba int, blocks int) (err error) {
 		end := start + blockSize*batch
 		slice := buf[start:end]
 
-		err = d.card.ReadBlocks((lba+i)*d.Mult, slice)
-
-		if err != nil {
-			dma.Release(addr)
+		if err = d.stats.read(len(slice), d.card.ReadBlocks((lba+i)*d.Mult, slice)); err != nil {
 			return
 		}
 
+		if d.cache != nil {
+			d.cache.overlay(lba+i, slice)
+		}
+
 		if d.Cipher {
 			wg.Add(1)
 			go d.Keyring.Cipher(slice, lba+i, batch, blockSize, false, wg)
 		}
 	}
 
-	wg.Wait()
-	d.send <- buf
-
 	return
 }
 
 func (d *Drive) write(lba int, buf []byte) (err error) {
-	batch := WRITE_PIPELINE_SIZE
+	batch := d.writePipelineSize()
 	info := d.card.Info()
 
 	blockSize := info.BlockSize * d.Mult
 	blocks := len(buf) / blockSize
 
-	if !d.Ready {
+	if !d.Ready() {
+		return
+	}
+
+	d.invalidate(lba, blocks)
+
+	if lba == 0 && d.Cipher && len(buf) >= blockSize {
+		d.track(buf[0:blockSize])
+	}
+
+	cache := d.writeCache()
+
+	if cache != nil && cache.fits(lba, blocks) {
+		for i := 0; i < blocks; i += batch {
+			if i+batch > blocks {
+				batch = blocks - i
+			}
+
+			start := i * blockSize
+			end := start + blockSize*batch
+
+			d.Keyring.Cipher(buf[start:end], lba+i, batch, blockSize, true, nil)
+		}
+
+		return cache.store(lba, buf)
+	}
+
+	// cached blocks might overlap, commit them before writing through
+	if err = d.flush(); err != nil {
 		return
 	}
 
+	return d.writeBlocks(lba, buf)
+}
+
+// writeBlocks encrypts, and writes, logical blocks from the given buffer.
+func (d *Drive) writeBlocks(lba int, buf []byte) (err error) {
+	batch := d.writePipelineSize()
+	blockSize := d.card.Info().BlockSize * d.Mult
+	blocks := len(buf) / blockSize
+
 	eg := &errgroup.Group{}
 
 	for i := 0; i < blocks; i += batch {
@@ -296,14 +502,17 @@ func (d *Drive) write(lba int, buf []byte) (err error) {
 		sliceBlock := (lba + i) * d.Mult
 
 		eg.Go(func() error {
-			return d.card.WriteBlocks(sliceBlock, slice)
+			return d.stats.write(len(slice), d.card.WriteBlocks(sliceBlock, slice))
 		})
 	}
 
 	return eg.Wait()
 }
 
-func (d *Drive) handleCDB(cmd [16]byte, cbw *usb.CBW) (csw *usb.CSW, data []byte, err error) {
+// handleCDB executes a command, commands with a data-out stage are returned
+// as pending write operation, which carries their status, to be completed
+// with handleData().
+func (d *Drive) handleCDB(cmd [16]byte, cbw *usb.CBW) (csw *usb.CSW, data []byte, pending *writeOp, err error) {
 	op := cmd[0]
 	length := int(cbw.DataTransferLength)
 
@@ -314,95 +523,245 @@ func (d *Drive) handleCDB(cmd [16]byte, cbw *usb.CBW) (csw *usb.CSW, data []byte
 	lun := int(cbw.LUN)
 
 	if int(lun+1) > 1 {
-		err = fmt.Errorf("invalid LUN")
+		err = fail(ILLEGAL_REQUEST, LOGICAL_UNIT_NOT_SUPPORTED, "invalid LUN")
 		return
 	}
 
+	// deferred errors are reported at the next command, other than
+	// those retrieving device information
+	switch op {
+	case INQUIRY, REQUEST_SENSE, REPORT_LUNS:
+	default:
+		if err = d.deferredError(); err != nil {
+			return
+		}
+	}
+
 	switch op {
 	case TEST_UNIT_READY:
-		if !d.Ready {
-			csw.Status = usb.CSW_STATUS_COMMAND_FAILED
+		if !d.Ready() {
+			err = errNotReady
 		}
 	case INQUIRY:
-		data = d.inquiry(length)
+		if cmd[1]&1 == 1 {
+			data, err = d.vpd(cmd[2], length)
+		} else {
+			data = d.inquiry(length)
+		}
 	case REQUEST_SENSE:
-		data, err = d.sense(length)
+		data = d.sense(length)
 	case START_STOP_UNIT:
 		start := (cmd[4]&1 == 1)
 
-		if !d.Ready && start {
+		if !start {
+			err = mediumError(WRITE_ERROR, d.flush())
+		}
+
+		if !d.Ready() && start {
 			// locked drive cannot be started
-			csw.Status = usb.CSW_STATUS_COMMAND_FAILED
+			err = errNotReady
 			// lock drive at eject
-		} else if d.Ready && !start && d.Cipher {
+		} else if d.Ready() && !start && d.Cipher {
+			d.LockTrigger = api.LockTrigger_EJECT
 			d.Lock()
 		} else {
-			d.Ready = start
+			d.SetReady(start)
 		}
 
-		if !d.Ready && !d.Cipher {
+		if !d.Ready() && !d.Cipher {
 			d.PairingComplete <- true
 
 			go func() {
 				card := d.card.(*PairingDisk)
-				ota.Check(card.Data, pairingDiskPath, pairingDiskOffset, d.Keyring)
+				checkUpdate(card.Data, pairingDiskPath, pairingDiskOffset, d.Keyring)
 			}()
 		}
 	case MODE_SENSE_6, MODE_SENSE_10:
-		data, err = modeSense(length)
+		data, err = d.modeSense(cmd, length)
+	case SYNCHRONIZE_CACHE_10, SYNCHRONIZE_CACHE_16:
+		// the whole cache is committed regardless of the requested range
+		err = mediumError(WRITE_ERROR, d.flush())
 	case REPORT_LUNS:
 		data, err = reportLUNs(length)
 	case READ_FORMAT_CAPACITIES:
 		data, err = d.readFormatCapacities()
 	case READ_CAPACITY_10:
+		if !d.Ready() {
+			err = errNotReady
+			break
+		}
+
 		data, err = d.readCapacity10()
 	case READ_10, WRITE_10:
-		if !d.Ready {
-			csw.Status = usb.CSW_STATUS_COMMAND_FAILED
+		if !d.Ready() {
+			err = errNotReady
+			break
+		}
+
+		if op == WRITE_10 && d.readOnly() {
+			err = errWriteProtected
+			break
 		}
 
-		lba := int(binary.BigEndian.Uint32(cmd[2:]))
-		blocks := int(binary.BigEndian.Uint16(cmd[7:]))
+		d.activity()
+
+		lba := uint64(binary.BigEndian.Uint32(cmd[2:]))
+		blocks := uint64(binary.BigEndian.Uint16(cmd[7:]))
+
+		if err = d.checkRange(lba, blocks); err != nil {
+			break
+		}
 
 		if op == READ_10 {
-			err = d.read(lba, blocks)
-		} else {
-			blockSize := d.card.Info().BlockSize * d.Mult
-			size := int(cbw.DataTransferLength)
+			data, err = d.read(int(lba), int(blocks))
+			err = mediumError(UNRECOVERED_READ_ERROR, err)
+			break
+		}
 
-			if blockSize*blocks != size {
-				err = fmt.Errorf("unexpected %d blocks write transfer length (%d)", blocks, size)
-			}
+		blockSize := d.card.Info().BlockSize * d.Mult
+		size := int(cbw.DataTransferLength)
 
-			d.dataPending = &writeOp{
-				csw:    csw,
-				lba:    lba,
-				blocks: blocks,
-				size:   size,
-			}
+		// 6.7 The Thirteen Cases, USB Mass Storage Class 1.0
+		// (case 13: Ho <> Do)
+		if blockSize*int(blocks) != size {
+			csw.Status = usb.CSW_STATUS_PHASE_ERROR
+		}
+
+		// zero-length transfers complete without data-out stage
+		if size == 0 {
+			break
+		}
+
+		pending = &writeOp{
+			op:     op,
+			csw:    csw,
+			lba:    int(lba),
+			blocks: int(blocks),
+			size:   size,
+		}
+
+		csw = nil
+	case UNMAP:
+		if !d.unmapSupported() {
+			err = fail(ILLEGAL_REQUEST, INVALID_COMMAND_OPERATION_CODE, "unsupported UNMAP %+v", cbw)
+			break
+		}
+
+		if !d.Ready() {
+			err = errNotReady
+			break
+		}
+
+		if d.readOnly() {
+			err = errWriteProtected
+			break
+		}
+
+		d.activity()
 
-			csw = nil
+		size := int(binary.BigEndian.Uint16(cmd[7:]))
+
+		if size == 0 {
+			// no block descriptors, not an error
+			break
+		}
+
+		if size != length {
+			csw.Status = usb.CSW_STATUS_PHASE_ERROR
+		}
+
+		if length == 0 {
+			break
 		}
+
+		pending = &writeOp{
+			op:   op,
+			csw:  csw,
+			size: length,
+		}
+
+		csw = nil
+	case WRITE_SAME_16:
+		// only WRITE SAME with the UNMAP bit set is supported
+		if cmd[1]&0x08 == 0 || !d.unmapSupported() {
+			err = fail(ILLEGAL_REQUEST, INVALID_FIELD_IN_CDB, "unsupported WRITE SAME %+v", cbw)
+			break
+		}
+
+		if !d.Ready() {
+			err = errNotReady
+			break
+		}
+
+		if d.readOnly() {
+			err = errWriteProtected
+			break
+		}
+
+		d.activity()
+
+		lba := binary.BigEndian.Uint64(cmd[2:])
+		blocks := uint64(binary.BigEndian.Uint32(cmd[10:]))
+
+		if blocks == 0 || blocks > UNMAP_MAX_BLOCKS {
+			err = fail(ILLEGAL_REQUEST, INVALID_FIELD_IN_CDB, "invalid WRITE SAME block count %d", blocks)
+			break
+		}
+
+		if err = d.checkRange(lba, blocks); err != nil {
+			break
+		}
+
+		// NDOB: no data-out buffer
+		if cmd[1]&0x01 == 1 || length == 0 {
+			err = mediumError(WRITE_ERROR, d.unmap(int(lba), int(blocks)))
+			break
+		}
+
+		// the data-out buffer is ignored as blocks are unmapped
+		pending = &writeOp{
+			op:     op,
+			csw:    csw,
+			lba:    int(lba),
+			blocks: int(blocks),
+			size:   length,
+		}
+
+		csw = nil
 	case SERVICE_ACTION:
 		switch cmd[1] {
 		case READ_CAPACITY_16:
+			if !d.Ready() {
+				err = errNotReady
+				break
+			}
+
 			data, err = d.readCapacity16(length)
 		default:
-			err = fmt.Errorf("unsupported service action %#x %+v", op, cbw)
+			err = fail(ILLEGAL_REQUEST, INVALID_FIELD_IN_CDB, "unsupported service action %#x %+v", op, cbw)
 		}
 	case PREVENT_ALLOW_MEDIUM_REMOVAL:
 		// ignored events
 	default:
-		err = fmt.Errorf("unsupported CDB Operation Code %#x %+v", op, cbw)
+		err = fail(ILLEGAL_REQUEST, INVALID_COMMAND_OPERATION_CODE, "unsupported CDB Operation Code %#x %+v", op, cbw)
 	}
 
 	return
 }
 
-func (d *Drive) handleWrite() (err error) {
-	if len(d.dataPending.buf) != d.dataPending.size {
-		return fmt.Errorf("len(buf) != size (%d != %d)", len(d.dataPending.buf), d.dataPending.size)
+func (d *Drive) handleWrite(op *writeOp) (err error) {
+	if len(op.buf) != op.size {
+		return fmt.Errorf("len(buf) != size (%d != %d)", len(op.buf), op.size)
+	}
+
+	switch op.op {
+	case UNMAP:
+		err = d.unmapList(op.buf)
+	case WRITE_SAME_16:
+		err = d.unmap(op.lba, op.blocks)
+	default:
+		err = d.write(op.lba, op.buf)
 	}
 
-	return d.write(d.dataPending.lba, d.dataPending.buf)
+	return mediumError(WRITE_ERROR, err)
 }
@@ -0,0 +1,147 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ums
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	// p58, Table 28 Sense key descriptions, SCSI Commands Reference Manual, Rev. J
+	NO_SENSE        = 0x00
+	NOT_READY       = 0x02
+	MEDIUM_ERROR    = 0x03
+	HARDWARE_ERROR  = 0x04
+	ILLEGAL_REQUEST = 0x05
+	DATA_PROTECT    = 0x07
+
+	// p59, Table 29 ASC and ASCQ assignments, SCSI Commands Reference Manual, Rev. J
+	WRITE_ERROR                     = 0x0c00
+	UNRECOVERED_READ_ERROR          = 0x1100
+	PARAMETER_LIST_LENGTH_ERROR     = 0x1a00
+	INVALID_COMMAND_OPERATION_CODE  = 0x2000
+	LBA_OUT_OF_RANGE                = 0x2100
+	INVALID_FIELD_IN_CDB            = 0x2400
+	LOGICAL_UNIT_NOT_SUPPORTED      = 0x2500
+	INVALID_FIELD_IN_PARAMETER_LIST = 0x2600
+	WRITE_PROTECTED                 = 0x2700
+	MEDIUM_NOT_PRESENT              = 0x3a00
+
+	// p56, 2.4.1.2 Fixed format sense data, SCSI Commands Reference Manual, Rev. J
+	CURRENT_ERROR  = 0x70
+	DEFERRED_ERROR = 0x71
+	senseLength    = 18
+)
+
+// senseData represents the sense key and additional sense code (ASC and
+// ASCQ) of a failed command, or of a deferred error which is reported at the
+// command following it.
+type senseData struct {
+	key      byte
+	code     uint16
+	deferred bool
+}
+
+// Bytes converts the sense data to fixed format.
+func (s senseData) Bytes() (data []byte) {
+	data = make([]byte, senseLength)
+
+	data[0] = CURRENT_ERROR
+
+	if s.deferred {
+		data[0] = DEFERRED_ERROR
+	}
+
+	data[2] = s.key
+	// additional sense length
+	data[7] = byte(len(data) - 1 - 7)
+	data[12] = byte(s.code >> 8)
+	data[13] = byte(s.code)
+
+	return
+}
+
+// checkCondition represents a command failure, reported to the host with its
+// sense data.
+type checkCondition struct {
+	senseData
+	err error
+}
+
+func (e *checkCondition) Error() string {
+	return e.err.Error()
+}
+
+func (e *checkCondition) Unwrap() error {
+	return e.err
+}
+
+// fail returns a command failure with the given sense key and additional
+// sense code.
+func fail(key byte, code uint16, format string, a ...any) error {
+	return &checkCondition{
+		senseData: senseData{key: key, code: code},
+		err:       fmt.Errorf(format, a...),
+	}
+}
+
+// mediumError qualifies card errors, if any, as medium errors.
+func mediumError(code uint16, err error) error {
+	var cc *checkCondition
+
+	if err == nil || errors.As(err, &cc) {
+		return err
+	}
+
+	return &checkCondition{
+		senseData: senseData{key: MEDIUM_ERROR, code: code},
+		err:       err,
+	}
+}
+
+// senseOf returns the sense data for a command failure, errors lacking one
+// are reported as hardware errors.
+func senseOf(err error) senseData {
+	var cc *checkCondition
+
+	if errors.As(err, &cc) {
+		return cc.senseData
+	}
+
+	return senseData{key: HARDWARE_ERROR}
+}
+
+var (
+	errNotReady       = fail(NOT_READY, MEDIUM_NOT_PRESENT, "medium not present")
+	errWriteProtected = fail(DATA_PROTECT, WRITE_PROTECTED, "write protected")
+)
+
+// p56, 2.4.1.2 Fixed format sense data, SCSI Commands Reference Manual, Rev. J
+//
+// The sense data of the last failed command is reported, and cleared, when
+// available, otherwise the logical unit state is.
+func (d *Drive) sense(length int) (data []byte) {
+	var s senseData
+
+	switch {
+	case d.lastSense != nil:
+		s = *d.lastSense
+		d.lastSense = nil
+	case !d.Ready():
+		s = senseOf(errNotReady)
+	default:
+		s = senseData{key: NO_SENSE}
+	}
+
+	data = s.Bytes()
+
+	if length < len(data) {
+		data = data[0:length]
+	}
+
+	return
+}
@@ -0,0 +1,76 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ums
+
+import (
+	"sync/atomic"
+
+	"github.com/usbarmory/tamago/soc/nxp/usdhc"
+)
+
+// Stats represents card transfer counters.
+type Stats struct {
+	// bytes read and written since the last unlock
+	BytesRead    uint64
+	BytesWritten uint64
+	// failed card reads and writes since boot
+	ReadErrors  uint64
+	WriteErrors uint64
+	// failed background commits of the write-back cache since boot
+	CacheErrors uint64
+}
+
+type stats struct {
+	bytesRead    atomic.Uint64
+	bytesWritten atomic.Uint64
+	readErrors   atomic.Uint64
+	writeErrors  atomic.Uint64
+	cacheErrors  atomic.Uint64
+}
+
+// read accounts a card read of the given size.
+func (s *stats) read(size int, err error) error {
+	if err != nil {
+		s.readErrors.Add(1)
+	} else {
+		s.bytesRead.Add(uint64(size))
+	}
+
+	return err
+}
+
+// write accounts a card write of the given size.
+func (s *stats) write(size int, err error) error {
+	if err != nil {
+		s.writeErrors.Add(1)
+	} else {
+		s.bytesWritten.Add(uint64(size))
+	}
+
+	return err
+}
+
+// reset clears transfer counters, error counters are preserved.
+func (s *stats) reset() {
+	s.bytesRead.Store(0)
+	s.bytesWritten.Store(0)
+}
+
+// Stats returns the card transfer counters.
+func (d *Drive) Stats() Stats {
+	return Stats{
+		BytesRead:    d.stats.bytesRead.Load(),
+		BytesWritten: d.stats.bytesWritten.Load(),
+		ReadErrors:   d.stats.readErrors.Load(),
+		WriteErrors:  d.stats.writeErrors.Load(),
+		CacheErrors:  d.stats.cacheErrors.Load(),
+	}
+}
+
+// CardInfo returns the card information.
+func (d *Drive) CardInfo() usdhc.CardInfo {
+	return d.card.Info()
+}
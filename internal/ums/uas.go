@@ -0,0 +1,484 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ums
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+
+	"github.com/usbarmory/tamago/dma"
+	"github.com/usbarmory/tamago/soc/nxp/usb"
+)
+
+// USB Attached SCSI (UAS) support, as specified in:
+//   Universal Serial Bus Mass Storage Class - USB Attached SCSI Protocol (UASP), Rev. 1.0
+//   USB Attached SCSI - 2 (UAS-2), T10/BSR INCITS 520
+//
+// The UAS interface is implemented without USB 3.0 streams, therefore the
+// device announces each data phase with a READ READY or WRITE READY IU on the
+// status pipe before using the data pipes.
+
+const (
+	// UASP 1.0, Table 2-1 Mass Storage Class Protocol Code
+	UAS_PROTOCOL = 0x62
+
+	// UASP 1.0, 5.3.3.2 Pipe Usage Class Specific Descriptor
+	PIPE_USAGE        = 0x24
+	PIPE_USAGE_LENGTH = 4
+
+	// UASP 1.0, Table 5-2 Pipe ID
+	COMMAND_PIPE  = 1
+	STATUS_PIPE   = 2
+	DATA_IN_PIPE  = 3
+	DATA_OUT_PIPE = 4
+
+	// UAS-2, Table 8 IU ID field
+	IU_COMMAND         = 0x01
+	IU_SENSE           = 0x03
+	IU_RESPONSE        = 0x04
+	IU_TASK_MANAGEMENT = 0x05
+	IU_READ_READY      = 0x06
+	IU_WRITE_READY     = 0x07
+
+	// UAS-2, Table 17 RESPONSE CODE field
+	TM_FUNCTION_COMPLETE      = 0x00
+	INVALID_INFORMATION_UNIT  = 0x02
+	TM_FUNCTION_NOT_SUPPORTED = 0x04
+
+	// UAS-2, Table 20 TASK MANAGEMENT FUNCTION field
+	ABORT_TASK_SET     = 0x02
+	CLEAR_TASK_SET     = 0x04
+	LOGICAL_UNIT_RESET = 0x08
+	I_T_NEXUS_RESET    = 0x10
+
+	// SAM-5 status codes
+	STATUS_GOOD            = 0x00
+	STATUS_CHECK_CONDITION = 0x02
+	STATUS_TASK_SET_FULL   = 0x28
+
+	// Command IU length, without additional CDB bytes
+	commandIULength = 32
+
+	// UAS_QUEUE_DEPTH controls how many tagged commands can be queued by
+	// the host before being reported as TASK SET FULL.
+	UAS_QUEUE_DEPTH = 32
+)
+
+// UAS endpoint addresses
+const (
+	uasCommandEndpoint = 0x02
+	uasStatusEndpoint  = 0x82
+	uasDataInEndpoint  = 0x83
+	uasDataOutEndpoint = 0x03
+)
+
+// uasPipes maps UAS endpoint addresses to their pipe usage
+var uasPipes = map[byte]byte{
+	uasCommandEndpoint: COMMAND_PIPE,
+	uasStatusEndpoint:  STATUS_PIPE,
+	uasDataInEndpoint:  DATA_IN_PIPE,
+	uasDataOutEndpoint: DATA_OUT_PIPE,
+}
+
+type uasCommand struct {
+	tag uint16
+	lun uint8
+	cdb [16]byte
+}
+
+type uasWrite struct {
+	op   *writeOp
+	off  int
+	done chan bool
+}
+
+type uas struct {
+	// commands is the queue for tagged commands
+	commands chan *uasCommand
+
+	// status is the queue for IN status pipe IUs
+	status chan []byte
+
+	// send is the queue for IN data pipe responses
+	send chan []byte
+
+	// free is the queue for IN data pipe DMA buffers for later release
+	free chan uint
+
+	// writes is the queue for OUT data pipe transfers
+	writes chan *uasWrite
+
+	// pending is the OUT data pipe transfer in progress
+	pending *uasWrite
+
+	// commit tracks the write being committed to the card, which
+	// overlaps with the data-out stage of the following one
+	commit sync.WaitGroup
+}
+
+func (d *Drive) configureUAS() (iface *usb.InterfaceDescriptor) {
+	d.uas = &uas{
+		commands: make(chan *uasCommand, UAS_QUEUE_DEPTH),
+		status:   make(chan []byte, UAS_QUEUE_DEPTH*2),
+		send:     make(chan []byte, 2),
+		free:     make(chan uint, 1),
+		writes:   make(chan *uasWrite, 1),
+	}
+
+	iface = &usb.InterfaceDescriptor{}
+	iface.SetDefaults()
+	iface.AlternateSetting = 1
+	iface.NumEndpoints = 4
+	iface.InterfaceClass = usb.MASS_STORAGE_CLASS
+	iface.InterfaceSubClass = usb.SCSI_CLASS
+	iface.InterfaceProtocol = UAS_PROTOCOL
+	iface.Interface = 0
+
+	functions := map[byte]usb.EndpointFunction{
+		uasCommandEndpoint: d.uasCommandRx,
+		uasStatusEndpoint:  d.uasStatusTx,
+		uasDataInEndpoint:  d.uasDataTx,
+		uasDataOutEndpoint: d.uasDataRx,
+	}
+
+	for _, addr := range []byte{uasCommandEndpoint, uasStatusEndpoint, uasDataInEndpoint, uasDataOutEndpoint} {
+		ep := &usb.EndpointDescriptor{}
+		ep.SetDefaults()
+		ep.EndpointAddress = addr
+		ep.Attributes = 2
+		ep.MaxPacketSize = maxPacketSize
+		ep.Zero = false
+		ep.Function = functions[addr]
+
+		iface.Endpoints = append(iface.Endpoints, ep)
+	}
+
+	go d.uasExecute()
+
+	return
+}
+
+// configuration returns the configuration descriptor with the UAS Pipe Usage
+// descriptors placed after each UAS endpoint descriptor.
+func (d *Drive) configuration(setup *usb.SetupData) (buf []byte, err error) {
+	conf, err := d.device.Configuration(setup.Value >> 8)
+
+	if err != nil {
+		return
+	}
+
+	for i := 0; i < len(conf) && conf[i] != 0; i += int(conf[i]) {
+		buf = append(buf, conf[i:i+int(conf[i])]...)
+
+		if conf[i+1] != usb.ENDPOINT {
+			continue
+		}
+
+		if pipe, ok := uasPipes[conf[i+2]]; ok {
+			buf = append(buf, PIPE_USAGE_LENGTH, PIPE_USAGE, pipe, 0x00)
+		}
+	}
+
+	buf[1] = byte(setup.Value & 0xff)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(buf)))
+
+	if int(setup.Length) < len(buf) {
+		buf = buf[0:setup.Length]
+	}
+
+	return
+}
+
+// UAS-2, 6.2.3 Sense IU
+func senseIU(tag uint16, status byte, sense []byte) []byte {
+	buf := new(bytes.Buffer)
+
+	buf.WriteByte(IU_SENSE)
+	buf.WriteByte(0x00)
+	binary.Write(buf, binary.BigEndian, tag)
+	// status qualifier
+	buf.Write(make([]byte, 2))
+	buf.WriteByte(status)
+	buf.Write(make([]byte, 7))
+	binary.Write(buf, binary.BigEndian, uint16(len(sense)))
+	buf.Write(sense)
+
+	return buf.Bytes()
+}
+
+// UAS-2, 6.2.4 Response IU
+func responseIU(tag uint16, code byte) []byte {
+	buf := new(bytes.Buffer)
+
+	buf.WriteByte(IU_RESPONSE)
+	buf.WriteByte(0x00)
+	binary.Write(buf, binary.BigEndian, tag)
+	// additional response information
+	buf.Write(make([]byte, 3))
+	buf.WriteByte(code)
+
+	return buf.Bytes()
+}
+
+// UAS-2, 6.2.5 READ READY IU and 6.2.6 WRITE READY IU
+func readyIU(id byte, tag uint16) []byte {
+	buf := []byte{id, 0x00, 0x00, 0x00}
+	binary.BigEndian.PutUint16(buf[2:], tag)
+
+	return buf
+}
+
+// transferLength returns the expected data transfer length for a command, as
+// UAS Command IUs, unlike Bulk-Only Transport CBWs, do not carry it.
+func (d *Drive) transferLength(cmd [16]byte) int {
+	switch cmd[0] {
+	case INQUIRY:
+		return int(binary.BigEndian.Uint16(cmd[3:]))
+	case REQUEST_SENSE, MODE_SENSE_6:
+		return int(cmd[4])
+	case MODE_SENSE_10, READ_FORMAT_CAPACITIES, UNMAP:
+		return int(binary.BigEndian.Uint16(cmd[7:]))
+	case READ_CAPACITY_10:
+		return 8
+	case REPORT_LUNS:
+		return int(binary.BigEndian.Uint32(cmd[6:]))
+	case SERVICE_ACTION:
+		return int(binary.BigEndian.Uint32(cmd[10:]))
+	case READ_10, WRITE_10:
+		return int(binary.BigEndian.Uint16(cmd[7:])) * d.card.Info().BlockSize * d.Mult
+	case WRITE_SAME_16:
+		// NDOB: no data-out buffer
+		if cmd[1]&0x01 == 0 {
+			return d.card.Info().BlockSize * d.Mult
+		}
+	}
+
+	return 0
+}
+
+// uasExecute processes queued commands in order, while the data and status
+// pipes transfer results of previous ones.
+func (d *Drive) uasExecute() {
+	for cmd := range d.uas.commands {
+		d.uasHandleCommand(cmd)
+	}
+}
+
+// uasStatus returns the Sense IU reporting the outcome of a command.
+func uasStatus(tag uint16, csw *usb.CSW, err error) []byte {
+	if err == nil && csw.Status == usb.CSW_STATUS_COMMAND_PASSED {
+		return senseIU(tag, STATUS_GOOD, nil)
+	}
+
+	return senseIU(tag, STATUS_CHECK_CONDITION, senseOf(err).Bytes())
+}
+
+func (d *Drive) uasHandleCommand(cmd *uasCommand) {
+	cbw := &usb.CBW{
+		Tag:                uint32(cmd.tag),
+		DataTransferLength: uint32(d.transferLength(cmd.cdb)),
+		LUN:                cmd.lun,
+	}
+
+	// WRITE(10) commands are only validated before their data-out
+	// stage, which therefore can overlap with the commit of a previous
+	// write, all other commands wait for its completion.
+	if cmd.cdb[0] != WRITE_10 {
+		d.uas.commit.Wait()
+	}
+
+	csw, data, op, err := d.handleCDB(cmd.cdb, cbw)
+
+	if err == nil && op != nil {
+		d.uasWrite(cmd.tag, op)
+		return
+	}
+
+	if err != nil || csw.Status != usb.CSW_STATUS_COMMAND_PASSED {
+		// failed commands do not necessarily return data
+		if len(data) > 0 {
+			if reserved, addr := dma.Reserved(data); reserved {
+				d.Pool.Release(addr)
+			}
+		}
+
+		d.uas.status <- uasStatus(cmd.tag, csw, err)
+
+		return
+	}
+
+	if len(data) > 0 {
+		d.uas.status <- readyIU(IU_READ_READY, cmd.tag)
+		d.uas.send <- data
+	}
+
+	d.uas.status <- uasStatus(cmd.tag, csw, nil)
+}
+
+// uasWrite completes a command with a data-out stage, the data is announced
+// with a WRITE READY IU, received, and then committed while the following
+// commands are processed.
+func (d *Drive) uasWrite(tag uint16, op *writeOp) {
+	// zero-length transfers complete without data-out stage
+	if op.size > 0 {
+		op.addr, op.buf = d.Pool.Reserve(op.size, true)
+
+		w := &uasWrite{
+			op:   op,
+			done: make(chan bool, 1),
+		}
+
+		d.uas.writes <- w
+		d.uas.status <- readyIU(IU_WRITE_READY, tag)
+		<-w.done
+	}
+
+	// writes are committed in order
+	d.uas.commit.Wait()
+	d.uas.commit.Add(1)
+
+	go func() {
+		defer d.uas.commit.Done()
+
+		if op.buf != nil {
+			defer d.Pool.Release(op.addr)
+		}
+
+		csw, err := d.handleData(op)
+		d.uas.status <- uasStatus(tag, csw, err)
+	}()
+}
+
+func (d *Drive) uasCommandRx(buf []byte, lastErr error) (res []byte, err error) {
+	// the UAS endpoints are idle when Bulk-Only Transport is selected
+	if d.alternate.Load() != 1 || len(buf) < 4 {
+		return
+	}
+
+	tag := binary.BigEndian.Uint16(buf[2:])
+
+	switch buf[0] {
+	case IU_COMMAND:
+		if len(buf) < commandIULength {
+			d.uas.status <- responseIU(tag, INVALID_INFORMATION_UNIT)
+			return
+		}
+
+		cmd := &uasCommand{
+			tag: tag,
+			// single level LUN structure
+			lun: buf[9],
+		}
+
+		copy(cmd.cdb[:], buf[16:commandIULength])
+
+		select {
+		case d.uas.commands <- cmd:
+		default:
+			d.uas.status <- senseIU(tag, STATUS_TASK_SET_FULL, nil)
+		}
+	case IU_TASK_MANAGEMENT:
+		if len(buf) < 16 {
+			d.uas.status <- responseIU(tag, INVALID_INFORMATION_UNIT)
+			return
+		}
+
+		switch buf[4] {
+		case ABORT_TASK_SET, CLEAR_TASK_SET, LOGICAL_UNIT_RESET, I_T_NEXUS_RESET:
+			// drop commands not yet being processed
+			for len(d.uas.commands) > 0 {
+				<-d.uas.commands
+			}
+
+			d.uas.status <- responseIU(tag, TM_FUNCTION_COMPLETE)
+		default:
+			d.uas.status <- responseIU(tag, TM_FUNCTION_NOT_SUPPORTED)
+		}
+	default:
+		d.uas.status <- responseIU(tag, INVALID_INFORMATION_UNIT)
+	}
+
+	return
+}
+
+func (d *Drive) uasStatusTx(_ []byte, lastErr error) (in []byte, err error) {
+	return <-d.uas.status, nil
+}
+
+func (d *Drive) uasDataTx(_ []byte, lastErr error) (in []byte, err error) {
+	select {
+	case buf := <-d.uas.free:
+		d.Pool.Release(buf)
+	default:
+	}
+
+	in = <-d.uas.send
+
+	if reserved, addr := dma.Reserved(in); reserved {
+		d.uas.free <- addr
+	}
+
+	return
+}
+
+func (d *Drive) uasDataRx(buf []byte, lastErr error) (res []byte, err error) {
+	if d.alternate.Load() != 1 {
+		return
+	}
+
+	if d.uas.pending == nil {
+		select {
+		case d.uas.pending = <-d.uas.writes:
+		default:
+			// data not announced with a WRITE READY IU
+			return
+		}
+	}
+
+	w := d.uas.pending
+
+	// The first transfer might not have been received directly in the
+	// reserved DMA buffer, as the endpoint is not aware of its size.
+	if w.off < len(w.op.buf) && len(buf) > 0 && &buf[0] != &w.op.buf[w.off] {
+		copy(w.op.buf[w.off:], buf)
+	}
+
+	w.off += len(buf)
+
+	if w.off < len(w.op.buf) {
+		return make([]byte, len(w.op.buf)-w.off), nil
+	}
+
+	d.uas.pending = nil
+	w.done <- true
+
+	// The next write might have been already announced, otherwise it
+	// is picked up once its data is received, as the endpoint must not
+	// block waiting for it.
+	select {
+	case d.uas.pending = <-d.uas.writes:
+		return d.uas.pending.op.buf, nil
+	default:
+	}
+
+	return
+}
+
+// selectTransport handles the selection of the Bulk-Only Transport (0) or UAS
+// (1) alternate setting, the state of the deselected transport is dropped.
+func (d *Drive) selectTransport(alternate uint32) {
+	if d.alternate.Swap(alternate) == alternate {
+		return
+	}
+
+	d.reset()
+
+	// drop commands not yet being processed
+	for len(d.uas.commands) > 0 {
+		<-d.uas.commands
+	}
+}
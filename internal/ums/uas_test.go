@@ -0,0 +1,293 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ums
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// uasHost exchanges information units with the UAS interface endpoints, as
+// the host controller would.
+type uasHost struct {
+	t *testing.T
+	d *Drive
+}
+
+func newUASHost(t *testing.T, d *Drive) *uasHost {
+	d.selectTransport(1)
+	return &uasHost{t: t, d: d}
+}
+
+func (h *uasHost) send(iu []byte) {
+	if _, err := h.d.uasCommandRx(iu, nil); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// command sends a Command IU.
+func (h *uasHost) command(tag uint16, cdb ...byte) {
+	iu := make([]byte, commandIULength)
+	iu[0] = IU_COMMAND
+	binary.BigEndian.PutUint16(iu[2:], tag)
+	copy(iu[16:], cdb)
+
+	h.send(iu)
+}
+
+// task sends a Task Management IU.
+func (h *uasHost) task(tag uint16, function byte) {
+	iu := make([]byte, 16)
+	iu[0] = IU_TASK_MANAGEMENT
+	binary.BigEndian.PutUint16(iu[2:], tag)
+	iu[4] = function
+
+	h.send(iu)
+}
+
+// status returns the next IU from the status pipe.
+func (h *uasHost) status() (iu []byte) {
+	h.t.Helper()
+
+	select {
+	case iu = <-h.d.uas.status:
+	case <-time.After(5 * time.Second):
+		h.t.Fatal("status pipe timeout")
+	}
+
+	if len(iu) < 4 {
+		h.t.Fatalf("invalid IU %x", iu)
+	}
+
+	return
+}
+
+// data returns the next transfer from the data-in pipe, which must have been
+// announced with a READ READY IU.
+func (h *uasHost) data() []byte {
+	buf, err := h.d.uasDataTx(nil, nil)
+
+	if err != nil {
+		h.t.Fatal(err)
+	}
+
+	return append([]byte{}, buf...)
+}
+
+func iuTag(iu []byte) uint16 {
+	return binary.BigEndian.Uint16(iu[2:])
+}
+
+// expectSense checks a Sense IU status and, on CHECK CONDITION, its sense key
+// and additional sense code.
+func (h *uasHost) expectSense(iu []byte, tag uint16, status byte, key byte, code uint16) {
+	h.t.Helper()
+
+	if iu[0] != IU_SENSE || iuTag(iu) != tag || len(iu) < 16 {
+		h.t.Fatalf("unexpected IU %x, expected Sense IU for tag %d", iu, tag)
+	}
+
+	if iu[6] != status {
+		h.t.Fatalf("tag %d: status %#x, expected %#x", tag, iu[6], status)
+	}
+
+	if status != STATUS_CHECK_CONDITION {
+		return
+	}
+
+	sense := iu[16:]
+
+	if len(sense) < senseLength {
+		h.t.Fatalf("tag %d: invalid sense data %x", tag, sense)
+	}
+
+	if sense[2] != key || binary.BigEndian.Uint16(sense[12:]) != code {
+		h.t.Fatalf("tag %d: sense %#x/%#04x, expected %#x/%#04x", tag, sense[2], binary.BigEndian.Uint16(sense[12:]), key, code)
+	}
+}
+
+// expectResponse checks a Response IU.
+func (h *uasHost) expectResponse(iu []byte, tag uint16, code byte) {
+	h.t.Helper()
+
+	if iu[0] != IU_RESPONSE || iuTag(iu) != tag || len(iu) != 8 {
+		h.t.Fatalf("unexpected IU %x, expected Response IU for tag %d", iu, tag)
+	}
+
+	if iu[7] != code {
+		h.t.Fatalf("tag %d: response code %#x, expected %#x", tag, iu[7], code)
+	}
+}
+
+func read10(lba uint32, blocks uint16) []byte {
+	cdb := make([]byte, 10)
+	cdb[0] = READ_10
+	binary.BigEndian.PutUint32(cdb[2:], lba)
+	binary.BigEndian.PutUint16(cdb[7:], blocks)
+
+	return cdb
+}
+
+func TestUASCommandErrors(t *testing.T) {
+	d, _ := newTestDrive(t, true)
+	h := newUASHost(t, d)
+
+	for i, tc := range []struct {
+		name string
+		cdb  []byte
+		key  byte
+		code uint16
+	}{
+		{"TEST UNIT READY locked", []byte{TEST_UNIT_READY}, NOT_READY, MEDIUM_NOT_PRESENT},
+		{"READ(10) locked", read10(0, 1), NOT_READY, MEDIUM_NOT_PRESENT},
+		{"READ CAPACITY(10) locked", []byte{READ_CAPACITY_10}, NOT_READY, MEDIUM_NOT_PRESENT},
+		{"READ CAPACITY(16) locked", []byte{SERVICE_ACTION, READ_CAPACITY_16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 32}, NOT_READY, MEDIUM_NOT_PRESENT},
+		{"unsupported opcode", []byte{0xff}, ILLEGAL_REQUEST, INVALID_COMMAND_OPERATION_CODE},
+		{"unsupported VPD page", []byte{INQUIRY, 0x01, 0x99, 0x00, 0xff}, ILLEGAL_REQUEST, INVALID_FIELD_IN_CDB},
+		{"unsupported service action", []byte{SERVICE_ACTION, 0x1f}, ILLEGAL_REQUEST, INVALID_FIELD_IN_CDB},
+		{"UNMAP without scrubbing", []byte{UNMAP, 0, 0, 0, 0, 0, 0, 0, 24}, ILLEGAL_REQUEST, INVALID_COMMAND_OPERATION_CODE},
+	} {
+		tag := uint16(i + 1)
+
+		t.Run(tc.name, func(t *testing.T) {
+			h.t = t
+			h.command(tag, tc.cdb...)
+			h.expectSense(h.status(), tag, STATUS_CHECK_CONDITION, tc.key, tc.code)
+		})
+	}
+
+	h.t = t
+
+	if n := len(d.uas.send); n != 0 {
+		t.Fatalf("%d unexpected data-in transfers", n)
+	}
+
+	// the drive keeps serving commands after failures
+	h.command(100, INQUIRY, 0x00, 0x00, 0x00, 36)
+
+	if iu := h.status(); iu[0] != IU_READ_READY || iuTag(iu) != 100 {
+		t.Fatalf("unexpected IU %x, expected READ READY", iu)
+	}
+
+	if data := h.data(); len(data) != 36 || data[0] != 0x00 {
+		t.Fatalf("unexpected INQUIRY data %x", data)
+	}
+
+	h.expectSense(h.status(), 100, STATUS_GOOD, 0, 0)
+}
+
+func TestUASInvalidIU(t *testing.T) {
+	d, _ := newTestDrive(t, true)
+	h := newUASHost(t, d)
+
+	// truncated Command IU
+	h.send([]byte{IU_COMMAND, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00})
+	h.expectResponse(h.status(), 1, INVALID_INFORMATION_UNIT)
+
+	// truncated Task Management IU
+	h.send([]byte{IU_TASK_MANAGEMENT, 0x00, 0x00, 0x02, ABORT_TASK_SET, 0x00, 0x00, 0x00})
+	h.expectResponse(h.status(), 2, INVALID_INFORMATION_UNIT)
+
+	// IU not expected on the command pipe
+	h.send([]byte{IU_SENSE, 0x00, 0x00, 0x03, 0x00, 0x00, 0x00, 0x00})
+	h.expectResponse(h.status(), 3, INVALID_INFORMATION_UNIT)
+
+	// IUs are ignored while Bulk-Only Transport is selected
+	d.selectTransport(0)
+	h.send([]byte{IU_SENSE, 0x00, 0x00, 0x04, 0x00, 0x00, 0x00, 0x00})
+
+	if n := len(d.uas.status); n != 0 {
+		t.Fatalf("%d unexpected IUs", n)
+	}
+}
+
+func TestUASTaskManagement(t *testing.T) {
+	d, _ := newTestDrive(t, false)
+	d.SetReady(true)
+
+	h := newUASHost(t, d)
+
+	// ABORT TASK is not supported
+	h.task(1, 0x01)
+	h.expectResponse(h.status(), 1, TM_FUNCTION_NOT_SUPPORTED)
+
+	for _, function := range []byte{ABORT_TASK_SET, CLEAR_TASK_SET, LOGICAL_UNIT_RESET, I_T_NEXUS_RESET} {
+		h.task(2, function)
+		h.expectResponse(h.status(), 2, TM_FUNCTION_COMPLETE)
+	}
+
+	// The data-in pipe queue is filled by the first two reads, the
+	// execution of the third one blocks until the host fetches data.
+	for tag := uint16(10); tag < 13; tag++ {
+		h.command(tag, read10(uint32(tag), 1)...)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for len(d.uas.send) < cap(d.uas.send) || len(d.uas.commands) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("command execution timeout")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	// queued commands
+	for tag := uint16(100); tag < 100+UAS_QUEUE_DEPTH; tag++ {
+		h.command(tag, TEST_UNIT_READY)
+	}
+
+	h.command(200, TEST_UNIT_READY)
+	h.task(300, ABORT_TASK_SET)
+
+	if n := len(d.uas.commands); n != 0 {
+		t.Fatalf("%d commands left in the task set", n)
+	}
+
+	// release the blocked read
+	for i := 0; i < 3; i++ {
+		if data := h.data(); len(data) != testBlockSize*d.Mult {
+			t.Fatalf("unexpected data-in transfer size %d", len(data))
+		}
+	}
+
+	// completion of a subsequent command ensures all previous ones have
+	// been either processed or dropped
+	h.command(400, TEST_UNIT_READY)
+
+	status := make(map[uint16][]byte)
+
+	for {
+		iu := h.status()
+
+		if iu[0] == IU_READ_READY {
+			continue
+		}
+
+		status[iuTag(iu)] = iu
+
+		if iuTag(iu) == 400 {
+			break
+		}
+	}
+
+	for tag := uint16(10); tag < 13; tag++ {
+		h.expectSense(status[tag], tag, STATUS_GOOD, 0, 0)
+	}
+
+	h.expectSense(status[200], 200, STATUS_TASK_SET_FULL, 0, 0)
+	h.expectResponse(status[300], 300, TM_FUNCTION_COMPLETE)
+	h.expectSense(status[400], 400, STATUS_GOOD, 0, 0)
+
+	for tag := uint16(100); tag < 100+UAS_QUEUE_DEPTH; tag++ {
+		if iu, ok := status[tag]; ok {
+			t.Fatalf("unexpected IU %x for aborted command", iu)
+		}
+	}
+}
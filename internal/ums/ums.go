@@ -6,10 +6,15 @@
 package ums
 
 import (
+	"sync/atomic"
+	"time"
+
 	"github.com/usbarmory/armory-drive/api"
 	"github.com/usbarmory/armory-drive/internal/crypto"
+	"github.com/usbarmory/armory-drive/internal/led"
+	"github.com/usbarmory/armory-drive/internal/pool"
 
-	usbarmory "github.com/usbarmory/tamago/board/usbarmory/mk2"
+	"github.com/usbarmory/tamago/soc/nxp/usb"
 	"github.com/usbarmory/tamago/soc/nxp/usdhc"
 )
 
@@ -37,27 +42,81 @@ type Drive struct {
 	// Keyring instance
 	Keyring *crypto.Keyring
 
-	// Ready represents the logical device status
-	Ready bool
-
 	// PairingComplete signals pairing completion
 	PairingComplete chan bool
 
+	// LockTrigger represents the event which triggered the last lock
+	LockTrigger api.LockTrigger
+
 	// Mult is the block multiplier
 	Mult int
 
+	// Pool is the DMA buffer pool for data transfers
+	Pool *pool.Pool
+
+	// Management is the handler for the USB management interface, which
+	// is exposed only when set
+	Management ManagementHandler
+
 	// Card represents the underlying storage instance
 	card Card
 
+	// ready represents the logical device status, shared by the USB
+	// endpoint handlers, the BLE API and asynchronous locks (see AutoLock())
+	ready atomic.Bool
+
+	// device is the USB device instance
+	device *usb.Device
+
 	// send is the queue for IN device responses
 	send chan []byte
 
 	// free is the queue for IN device DMA buffers for later release
 	free chan uint
 
-	// dataPending is the buffer for write commands which spawn across
-	// multiple USB transfers
+	// alternate is the selected mass storage interface alternate setting,
+	// either Bulk-Only Transport (0) or UAS (1), which owns the transport
+	// state
+	alternate atomic.Uint32
+
+	// dataPending is the Bulk-Only Transport buffer for write commands
+	// which spawn across multiple USB transfers
 	dataPending *writeOp
+
+	// lastSense is the Bulk-Only Transport sense data of the last failed
+	// command
+	lastSense *senseData
+
+	// resetPending signals a Bulk-Only Mass Storage Reset request
+	resetPending atomic.Bool
+
+	// uas represents the USB Attached SCSI transport state
+	uas *uas
+
+	// mgmt represents the management interface state
+	mgmt *mgmt
+
+	// stats represents card transfer counters
+	stats stats
+
+	// cache is the write-back cache, allocated when first enabled
+	cache *writeCache
+
+	// ahead is the read-ahead engine, allocated when first used
+	ahead *readAhead
+
+	// lastActivity is the time (ns) of the last data transfer
+	lastActivity atomic.Int64
+
+	// idleTimer triggers the idle lock policy
+	idleTimer *time.Timer
+
+	// configured signals that the host selected a configuration
+	configured atomic.Bool
+
+	// vendor and product identification, set at USB configuration
+	vendor  string
+	product string
 }
 
 func (d *Drive) Init(card Card) (err error) {
@@ -73,6 +132,17 @@ func (d *Drive) Init(card Card) (err error) {
 	return
 }
 
+// Ready returns the logical device status, the medium is present only when
+// unlocked.
+func (d *Drive) Ready() bool {
+	return d.ready.Load()
+}
+
+// SetReady sets the logical device status.
+func (d *Drive) SetReady(ready bool) {
+	d.ready.Store(ready)
+}
+
 func (d *Drive) Capacity() uint64 {
 	info := d.card.Info()
 	return uint64(info.Blocks) * uint64(info.BlockSize)
@@ -80,14 +150,26 @@ func (d *Drive) Capacity() uint64 {
 
 func (d *Drive) Lock() (err error) {
 	// invalidate the drive
-	d.Ready = false
+	if d.ready.Swap(false) && d.Cipher {
+		d.Keyring.Audit(api.LogEvent_LOCKED, d.LockTrigger.String())
+	}
+
+	d.disarmIdleLock()
+
+	// commit cached writes before clearing the FDE key
+	flushErr := d.flush()
+
+	// discard, and zeroise, plaintext read ahead
+	if d.ahead != nil {
+		d.ahead.reset()
+	}
 
 	// clear FDE key
 	if err = d.Keyring.SetCipher(api.Cipher_NONE, nil); err != nil {
 		return
 	}
 
-	usbarmory.LED("white", false)
+	led.Set("white", false)
 
-	return
+	return flushErr
 }
@@ -0,0 +1,125 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ums
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/usbarmory/armory-drive/internal/crypto"
+	"github.com/usbarmory/armory-drive/internal/emulator"
+	"github.com/usbarmory/armory-drive/internal/pool"
+)
+
+const (
+	testBlockSize = 512
+	// internal card, covering the persistent configuration and audit log
+	testMMCBlocks = crypto.MMC_LOG_BLOCK + crypto.LOG_ENTRIES
+	// microSD card, covering the benchmark scratch region
+	testSDBlocks = 1 << 16
+	// DMA region, covering the buffer pool, write-back cache and
+	// read-ahead buffers
+	testDMASize = 64 * 1024 * 1024
+)
+
+var (
+	testPoolOnce sync.Once
+	testPool     *pool.Pool
+
+	testKEK = bytes.Repeat([]byte{0x4b}, 32)
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// newTestDrive returns a locked drive, with its USB interfaces configured,
+// backed by emulated internal card, DCP and microSD card.
+func newTestDrive(t testing.TB, cipher bool) (d *Drive, card *emulator.Card) {
+	crypto.SetPlatform(emulator.NewCard(testBlockSize, testMMCBlocks), emulator.NewDCP())
+
+	if err := emulator.InitDMA(testDMASize); err != nil {
+		t.Fatal(err)
+	}
+
+	// buffers are retained across instances, as never released
+	testPoolOnce.Do(func() {
+		testPool = pool.New(pool.DefaultClasses, 4096)
+	})
+
+	keyring := &crypto.Keyring{
+		Pool: testPool,
+	}
+
+	if err := keyring.Init(false); err != nil {
+		t.Fatal(err)
+	}
+
+	d = &Drive{
+		Cipher:  cipher,
+		Keyring: keyring,
+		Mult:    BLOCK_SIZE_MULTIPLIER,
+		Pool:    testPool,
+	}
+
+	card = emulator.NewCard(testBlockSize, testSDBlocks)
+
+	if err := d.Init(card); err != nil {
+		t.Fatal(err)
+	}
+
+	d.ConfigureUSB()
+
+	// Prefetching must complete before the next test replaces the
+	// platform DCP, buffers are released as the DMA region is shared by
+	// all tests.
+	t.Cleanup(func() {
+		if d.ahead != nil {
+			d.ahead.release(d.Pool)
+		}
+
+		if d.cache != nil {
+			d.cache.release()
+		}
+	})
+
+	return
+}
+
+// unlockTestDrive verifies the KEK, enrolling it at the first unlock, sets the
+// FDE key and readies the drive, as done on unlock requests.
+func unlockTestDrive(t testing.TB, d *Drive, kek []byte) {
+	if !d.Keyring.KEKEnrolled() {
+		verifier, err := d.Keyring.KEKVerifier(kek)
+
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d.Keyring.EnrollKEK(verifier)
+	}
+
+	if err := d.Keyring.VerifyKEK(kek); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Keyring.SetCipher(d.Keyring.Conf.Settings.Cipher, kek); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.Configure(); err != nil {
+		t.Fatal(err)
+	}
+
+	d.SetReady(true)
+}
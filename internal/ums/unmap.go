@@ -0,0 +1,148 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package ums
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+)
+
+const (
+	// UNMAP parameter list header and block descriptor sizes
+	unmapHeaderLength     = 8
+	unmapDescriptorLength = 16
+)
+
+// UNMAP command, SCSI Commands Reference Manual, Rev. J
+func (d *Drive) unmapList(buf []byte) (err error) {
+	if len(buf) < unmapHeaderLength {
+		return fail(ILLEGAL_REQUEST, PARAMETER_LIST_LENGTH_ERROR, "invalid UNMAP parameter list length %d", len(buf))
+	}
+
+	var total uint64
+
+	size := int(binary.BigEndian.Uint16(buf[2:]))
+	descriptors := buf[unmapHeaderLength:]
+
+	if size > len(descriptors) || size%unmapDescriptorLength != 0 {
+		return fail(ILLEGAL_REQUEST, INVALID_FIELD_IN_PARAMETER_LIST, "invalid UNMAP block descriptor data length %d", size)
+	}
+
+	if size/unmapDescriptorLength > UNMAP_MAX_DESCRIPTORS {
+		return fail(ILLEGAL_REQUEST, INVALID_FIELD_IN_PARAMETER_LIST, "too many UNMAP block descriptors (%d)", size/unmapDescriptorLength)
+	}
+
+	// the whole list is validated before any block is unmapped
+	for off := 0; off < size; off += unmapDescriptorLength {
+		desc := descriptors[off:]
+
+		lba := binary.BigEndian.Uint64(desc[0:])
+		blocks := uint64(binary.BigEndian.Uint32(desc[8:]))
+
+		// the limit applies to the sum of all descriptors
+		if total += blocks; total > UNMAP_MAX_BLOCKS {
+			return fail(ILLEGAL_REQUEST, INVALID_FIELD_IN_PARAMETER_LIST, "invalid UNMAP block count %d", total)
+		}
+
+		if err = d.checkRange(lba, blocks); err != nil {
+			return
+		}
+	}
+
+	for off := 0; off < size; off += unmapDescriptorLength {
+		desc := descriptors[off:]
+
+		lba := binary.BigEndian.Uint64(desc[0:])
+		blocks := binary.BigEndian.Uint32(desc[8:])
+
+		if err = d.unmap(int(lba), int(blocks)); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// checkRange validates a range of logical blocks, as received from the host,
+// against the disk size before its conversion to int, which is only 32-bit
+// wide on the target.
+func (d *Drive) checkRange(lba uint64, blocks uint64) error {
+	max := uint64(d.card.Info().Blocks / d.Mult)
+
+	if lba > max || blocks > max-lba {
+		return fail(ILLEGAL_REQUEST, LBA_OUT_OF_RANGE, "operation exceeds disk size (%d+%d)", lba, blocks)
+	}
+
+	return nil
+}
+
+// unmapSupported returns whether logical block provisioning can be honoured,
+// by scrubbing unmapped blocks.
+//
+// Erasing unmapped blocks on the card is out of scope, as the uSDHC driver
+// does not expose erase commands, therefore logical block provisioning is
+// only advertised when scrubbing is enabled.
+func (d *Drive) unmapSupported() bool {
+	return d.Cipher && d.Keyring.Conf.Settings.GetScrub()
+}
+
+// unmap releases a range of logical blocks, previously validated with
+// checkRange(), the range is overwritten with fresh ciphertext when scrubbing
+// is enabled.
+//
+// Logical block provisioning is advertised without LBPRZ, therefore hosts do
+// not expect any specific data to be read back from unmapped blocks.
+func (d *Drive) unmap(lba int, blocks int) (err error) {
+	if !d.Ready() || blocks == 0 {
+		return
+	}
+
+	d.invalidate(lba, blocks)
+
+	if !d.unmapSupported() {
+		return
+	}
+
+	return d.scrub(lba, blocks)
+}
+
+// scrub overwrites a range of logical blocks with random data, which is
+// indistinguishable from fresh ciphertext, leaving no trace of the previously
+// stored one.
+//
+// Encrypting a fixed pattern is avoided as, with the FDE IV being derived
+// from the block address, it would yield the same ciphertext at each scrub
+// and reveal which blocks have been unmapped.
+func (d *Drive) scrub(lba int, blocks int) (err error) {
+	batch := d.writePipelineSize()
+	blockSize := d.card.Info().BlockSize * d.Mult
+
+	// cached blocks must not be written back over scrubbed ones
+	if err = d.flush(); err != nil {
+		return
+	}
+
+	addr, buf := d.Pool.Reserve(batch*blockSize, false)
+	defer d.Pool.Release(addr)
+
+	for i := 0; i < blocks; i += batch {
+		if i+batch > blocks {
+			batch = blocks - i
+		}
+
+		slice := buf[0 : batch*blockSize]
+
+		if _, err = rand.Read(slice); err != nil {
+			return
+		}
+
+		if err = d.stats.write(len(slice), d.card.WriteBlocks((lba+i)*d.Mult, slice)); err != nil {
+			return
+		}
+	}
+
+	return
+}
@@ -0,0 +1,88 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ums
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// unmapParameterList returns an UNMAP parameter list with a block descriptor
+// for each pair of LBA and block count.
+func unmapParameterList(ranges ...[2]int) []byte {
+	buf := make([]byte, unmapHeaderLength+len(ranges)*unmapDescriptorLength)
+	binary.BigEndian.PutUint16(buf[2:], uint16(len(ranges)*unmapDescriptorLength))
+
+	for i, r := range ranges {
+		desc := buf[unmapHeaderLength+i*unmapDescriptorLength:]
+		binary.BigEndian.PutUint64(desc[0:], uint64(r[0]))
+		binary.BigEndian.PutUint32(desc[8:], uint32(r[1]))
+	}
+
+	return buf
+}
+
+func TestUnmapScrub(t *testing.T) {
+	d, card := newTestDrive(t, true)
+
+	if d.unmapSupported() {
+		t.Fatal("UNMAP supported without scrubbing")
+	}
+
+	d.Keyring.Conf.Settings.Scrub = true
+	unlockTestDrive(t, d, testKEK)
+
+	data, err := d.vpd(BLOCK_LIMITS_VPD_PAGE, 64)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// maximum unmap LBA count, the scrubbing work bound for each command
+	if n := binary.BigEndian.Uint32(data[4+16:]); n != UNMAP_MAX_BLOCKS {
+		t.Fatalf("unexpected maximum unmap LBA count %d", n)
+	}
+
+	inUse := d.Pool.Stats().InUse
+	written := func(lba int) bool {
+		return card.Block(lba*d.Mult) != nil
+	}
+
+	// the whole list is rejected when exceeding the limit
+	half := UNMAP_MAX_BLOCKS / 2
+
+	if err = d.unmapList(unmapParameterList([2]int{0, half}, [2]int{half, half + 1})); senseOf(err).code != INVALID_FIELD_IN_PARAMETER_LIST {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if written(0) {
+		t.Fatal("blocks scrubbed by rejected UNMAP")
+	}
+
+	if err = d.unmapList(unmapParameterList([2]int{10, 4}, [2]int{100, half})); err != nil {
+		t.Fatal(err)
+	}
+
+	for lba, scrubbed := range map[int]bool{
+		9:              false,
+		10:             true,
+		13:             true,
+		14:             false,
+		100:            true,
+		100 + half - 1: true,
+		100 + half:     false,
+	} {
+		if written(lba) != scrubbed {
+			t.Fatalf("LBA %d: unexpected scrubbing state", lba)
+		}
+	}
+
+	if n := d.Pool.Stats().InUse; n != inUse {
+		t.Fatalf("%d DMA buffers leaked", n-inUse)
+	}
+}
@@ -13,11 +13,19 @@ import (
 	"strings"
 
 	"github.com/usbarmory/tamago/dma"
-	"github.com/usbarmory/tamago/soc/nxp/imx6ul"
 	"github.com/usbarmory/tamago/soc/nxp/usb"
 )
 
-const maxPacketSize = 512
+const (
+	maxPacketSize = 512
+
+	// Maximum CBW data transfer length, matching the largest READ(10)
+	// and WRITE(10) transfer.
+	maxTransferLength = 0xffff * 512 * MAX_BLOCK_SIZE_MULTIPLIER
+
+	// Discarded data stages are transferred in chunks of this size.
+	discardChunkSize = usb.DTD_PAGE_SIZE
+)
 
 func (d *Drive) ConfigureUSB() (device *usb.Device) {
 	device = &usb.Device{
@@ -37,17 +45,20 @@ func (d *Drive) ConfigureUSB() (device *usb.Device) {
 
 	device.Descriptor.Device = 0x0001
 
-	iManufacturer, _ := device.AddString(VendorID)
+	// identification changes are applied at the next boot
+	d.vendor, d.product = identity(d.Keyring.Conf.Settings)
+
+	iManufacturer, _ := device.AddString(d.vendor)
 	device.Descriptor.Manufacturer = iManufacturer
 
-	iProduct, _ := device.AddString(ProductID)
+	iProduct, _ := device.AddString(d.product)
 	device.Descriptor.Product = iProduct
 
 	// p9, 4.1.1 Serial Number, USB Mass Storage Class 1.0
 	//
 	// The serial number format is [0-9A-F]{12,}, the NXP Unique
 	// ID is converted accordingly.
-	uid := imx6ul.UniqueID()
+	uid := uniqueID()
 	serial := strings.ToUpper(hex.EncodeToString(uid[:]))
 
 	iSerial, _ := device.AddString(serial)
@@ -96,6 +107,16 @@ func (d *Drive) ConfigureUSB() (device *usb.Device) {
 
 	device.Configurations[0].AddInterface(iface)
 
+	// USB Attached SCSI is offered as alternate setting, hosts lacking
+	// support for it use the default Bulk-Only Transport one.
+	device.Configurations[0].AddInterface(d.configureUAS())
+
+	if d.Management != nil {
+		device.Configurations[0].AddInterface(d.configureManagement(device))
+	}
+
+	d.device = device
+
 	return
 }
 
@@ -103,10 +124,28 @@ func (d *Drive) ConfigureUSB() (device *usb.Device) {
 // p7, 3.1 - 3.2, USB Mass Storage Class 1.0
 func (d *Drive) setup(setup *usb.SetupData) (in []byte, ack bool, done bool, err error) {
 	switch setup.Request {
+	case usb.GET_DESCRIPTOR:
+		switch setup.Value & 0xff {
+		case usb.CONFIGURATION, usb.OTHER_SPEED_CONFIGURATION:
+			in, err = d.configuration(setup)
+			done = true
+		}
+	case usb.SET_CONFIGURATION:
+		// standard request, inspected only to qualify bus resets
+		d.configured.Store(setup.Value>>8 != 0)
+		d.selectTransport(0)
+	case usb.SET_INTERFACE:
+		// standard request, inspected only to select the transport
+		if setup.Index&0xff == 0 {
+			d.selectTransport(uint32(setup.Value >> 8))
+		}
 	case usb.BULK_ONLY_MASS_STORAGE_RESET:
-		// For we ack this request without resetting.
+		d.reset()
+		ack = true
+		done = true
 	case usb.GET_MAX_LUN:
 		in = []byte{0x00}
+		done = true
 	}
 
 	return
@@ -136,37 +175,61 @@ func parseCBW(buf []byte) (cbw *usb.CBW, err error) {
 		return nil, fmt.Errorf("invalid CBW signature %x", cbw.Signature)
 	}
 
+	if cbw.DataTransferLength > maxTransferLength {
+		return nil, fmt.Errorf("invalid data transfer length %d", cbw.DataTransferLength)
+	}
+
 	return
 }
 
 func (d *Drive) rx(buf []byte, lastErr error) (res []byte, err error) {
 	var cbw *usb.CBW
 
-	if d.dataPending != nil {
-		defer dma.Release(d.dataPending.addr)
-		err = d.handleWrite()
+	// the Bulk-Only Transport endpoints are idle when UAS is selected
+	if d.alternate.Load() != 0 {
+		return
+	}
 
-		if err != nil {
-			return
+	if d.resetPending.Swap(false) && d.dataPending != nil {
+		// The received buffer might be a slice of the pending DMA
+		// buffer, therefore it can only be released once processed.
+		defer d.Pool.Release(d.dataPending.addr)
+		d.dataPending = nil
+	}
+
+	if op := d.dataPending; op != nil {
+		if op.discarded(len(buf)) {
+			return op.buf[:min(op.size-op.received, discardChunkSize)], nil
 		}
 
-		csw := d.dataPending.csw
-		csw.DataResidue = 0
+		defer d.Pool.Release(op.addr)
+		d.dataPending = nil
 
-		d.send <- d.dataPending.csw.Bytes()
+		op.buf = buf
 
-		d.dataPending = nil
+		csw, opErr := d.handleData(op)
+
+		if opErr != nil {
+			d.setSense(opErr)
+		}
+
+		d.send <- csw.Bytes()
 
 		return
 	}
 
 	cbw, err = parseCBW(buf)
 
-	if err != nil {
+	if err != nil || cbw == nil {
 		return
 	}
 
-	csw, data, err := d.handleCDB(cbw.CommandBlock, cbw)
+	// sense data is only retained for the command following a failure
+	if cbw.CommandBlock[0] != REQUEST_SENSE {
+		d.lastSense = nil
+	}
+
+	csw, data, pending, err := d.handleCDB(cbw.CommandBlock, cbw)
 
 	defer func() {
 		if csw != nil {
@@ -175,27 +238,126 @@ func (d *Drive) rx(buf []byte, lastErr error) (res []byte, err error) {
 	}()
 
 	if err != nil {
+		d.setSense(err)
+
 		csw.DataResidue = cbw.DataTransferLength
 		csw.Status = usb.CSW_STATUS_COMMAND_FAILED
-		return
-	}
 
-	if len(data) > 0 {
+		// 6.7 The Thirteen Cases, USB Mass Storage Class 1.0
+		//
+		// The data stage expected by the host is completed, by padding
+		// or discarding data, before the CSW to keep the host in sync.
+		switch {
+		case cbw.DataTransferLength == 0:
+		case cbw.Flags&0x80 != 0:
+			d.pad(int(cbw.DataTransferLength))
+		default:
+			pending = &writeOp{
+				csw:  csw,
+				size: int(cbw.DataTransferLength),
+			}
+
+			csw = nil
+		}
+
+		// the failure is reported in the CSW, no need to stall
+		err = nil
+	} else if len(data) > 0 {
 		d.send <- data
 	}
 
-	if d.dataPending != nil {
-		d.dataPending.addr, d.dataPending.buf = dma.Reserve(d.dataPending.size, usb.DTD_PAGE_SIZE)
-		res = d.dataPending.buf
+	if pending != nil {
+		size := pending.size
+
+		// data to be discarded is drained in bounded chunks
+		if pending.csw.Status != usb.CSW_STATUS_COMMAND_PASSED {
+			size = min(size, discardChunkSize)
+		}
+
+		pending.addr, pending.buf = d.Pool.Reserve(size, true)
+		d.dataPending = pending
+		res = pending.buf
 	}
 
 	return
 }
 
+// pad completes the data-in stage of a failed command with zero bytes, sent
+// in bounded chunks.
+func (d *Drive) pad(size int) {
+	zero := make([]byte, discardChunkSize)
+
+	for size > 0 && !d.resetPending.Load() {
+		n := min(size, discardChunkSize)
+		d.send <- zero[:n]
+		size -= n
+	}
+}
+
+// handleData completes a pending command with its data-out stage, returning
+// the command status and its failure, if any.
+func (d *Drive) handleData(op *writeOp) (csw *usb.CSW, err error) {
+	csw = op.csw
+
+	switch {
+	case csw.Status != usb.CSW_STATUS_COMMAND_PASSED:
+		// data is discarded
+	case len(op.buf) != op.size:
+		// 6.7 The Thirteen Cases, USB Mass Storage Class 1.0
+		// (case 13: Ho < Do)
+		csw.Status = usb.CSW_STATUS_PHASE_ERROR
+	default:
+		if err = d.handleWrite(op); err != nil {
+			csw.Status = usb.CSW_STATUS_COMMAND_FAILED
+		}
+	}
+
+	if csw.Status == usb.CSW_STATUS_COMMAND_PASSED {
+		csw.DataResidue = 0
+	} else {
+		csw.DataResidue = uint32(op.size)
+	}
+
+	return
+}
+
+// setSense records the sense data of a failed Bulk-Only Transport command,
+// reported at the following REQUEST SENSE command.
+func (d *Drive) setSense(err error) {
+	s := senseOf(err)
+	d.lastSense = &s
+}
+
+// reset drops pending operations and queued responses, as required by the
+// Bulk-Only Mass Storage Reset request, to ready the device for the next CBW.
+//
+// This is invoked by the control endpoint handler, therefore the pending
+// write operation, owned by the OUT endpoint handler, is dropped by the
+// latter at its next invocation.
+//
+// The buffer of the last IN transfer, whose data stage is aborted by the
+// reset, is released as well, leaving the free queue empty for the next one.
+func (d *Drive) reset() {
+	d.resetPending.Store(true)
+
+	for {
+		select {
+		case buf := <-d.send:
+			if reserved, addr := dma.Reserved(buf); reserved {
+				d.Pool.Release(addr)
+			}
+		case addr := <-d.free:
+			d.Pool.Release(addr)
+		default:
+			return
+		}
+	}
+}
+
 func (d *Drive) tx(_ []byte, lastErr error) (in []byte, err error) {
 	select {
 	case buf := <-d.free:
-		dma.Release(buf)
+		d.Pool.Release(buf)
 	default:
 	}
 
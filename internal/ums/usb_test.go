@@ -0,0 +1,189 @@
+// Copyright (c) The armory-drive authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+//go:build !tamago
+
+package ums
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/usbarmory/tamago/soc/nxp/usb"
+)
+
+func cbw(tag uint32, length uint32, in bool, cdb ...byte) []byte {
+	c := &usb.CBW{
+		Tag:                tag,
+		DataTransferLength: length,
+		Length:             uint8(len(cdb)),
+	}
+
+	c.SetDefaults()
+	copy(c.CommandBlock[:], cdb)
+
+	if in {
+		c.Flags = 0x80
+	}
+
+	buf := new(bytes.Buffer)
+	binary.Write(buf, binary.LittleEndian, c)
+
+	return buf.Bytes()
+}
+
+// csw returns the next Bulk-Only Transport IN transfer as CSW.
+func csw(t *testing.T, d *Drive) (c *usb.CSW) {
+	t.Helper()
+
+	var buf []byte
+
+	select {
+	case buf = <-d.send:
+	case <-time.After(5 * time.Second):
+		t.Fatal("CSW timeout")
+	}
+
+	if len(buf) != 13 {
+		t.Fatalf("unexpected IN transfer %x, expected CSW", buf)
+	}
+
+	c = &usb.CSW{}
+
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, c); err != nil {
+		t.Fatal(err)
+	}
+
+	return
+}
+
+func write10(lba uint32, blocks uint16) []byte {
+	cdb := read10(lba, blocks)
+	cdb[0] = WRITE_10
+
+	return cdb
+}
+
+func TestBOTInvalidTransferLength(t *testing.T) {
+	d, _ := newTestDrive(t, true)
+
+	if _, err := d.rx(cbw(1, maxTransferLength+1, false, write10(0, 1)...), nil); err == nil {
+		t.Fatal("oversized data transfer length accepted")
+	}
+
+	if _, err := d.rx(cbw(2, 0xffffffff, true, read10(0, 1)...), nil); err == nil {
+		t.Fatal("oversized data transfer length accepted")
+	}
+
+	if n := len(d.send); n != 0 {
+		t.Fatalf("%d unexpected IN transfers", n)
+	}
+}
+
+func TestBOTDiscardDataOut(t *testing.T) {
+	d, _ := newTestDrive(t, true)
+	inUse := d.Pool.Stats().InUse
+
+	for _, tc := range []struct {
+		name   string
+		size   int
+		chunks []int
+	}{
+		{"complete", 3*discardChunkSize + 100, []int{discardChunkSize, discardChunkSize, discardChunkSize, 100}},
+		{"aligned", 2 * discardChunkSize, []int{discardChunkSize, discardChunkSize}},
+		{"short transfer", 3 * discardChunkSize, []int{discardChunkSize, 10}},
+		{"maximum", maxTransferLength, nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			// WRITE(10) fails, as the drive is locked
+			buf, err := d.rx(cbw(1, uint32(tc.size), false, write10(0, 1)...), nil)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			chunks := tc.chunks
+
+			if chunks == nil {
+				for n := tc.size; n > 0; n -= discardChunkSize {
+					chunks = append(chunks, min(n, discardChunkSize))
+				}
+			}
+
+			for i, n := range chunks {
+				if len(buf) != min(tc.size-i*discardChunkSize, discardChunkSize) {
+					t.Fatalf("chunk %d: unexpected receive buffer size %d", i, len(buf))
+				}
+
+				if len(d.send) != 0 {
+					t.Fatalf("chunk %d: CSW sent before the data stage completion", i)
+				}
+
+				if buf, err = d.rx(buf[:n], nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if buf != nil {
+				t.Fatalf("unexpected receive buffer after data stage completion")
+			}
+
+			c := csw(t, d)
+
+			if c.Tag != 1 || c.Status != usb.CSW_STATUS_COMMAND_FAILED || c.DataResidue != uint32(tc.size) {
+				t.Fatalf("unexpected CSW %+v", c)
+			}
+
+			if n := d.Pool.Stats().InUse; n != inUse {
+				t.Fatalf("%d DMA buffers leaked", n-inUse)
+			}
+		})
+	}
+
+	// the drive keeps serving commands after draining
+	if _, err := d.rx(cbw(2, 0, false, TEST_UNIT_READY, 0, 0, 0, 0, 0), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := csw(t, d); c.Tag != 2 || c.Status != usb.CSW_STATUS_COMMAND_FAILED {
+		t.Fatalf("unexpected CSW %+v", c)
+	}
+}
+
+func TestBOTPadDataIn(t *testing.T) {
+	d, _ := newTestDrive(t, true)
+	size := 5*discardChunkSize + 1
+
+	res := make(chan error)
+
+	// READ(10) fails, as the drive is locked
+	go func() {
+		_, err := d.rx(cbw(1, uint32(size), true, read10(0, 1)...), nil)
+		res <- err
+	}()
+
+	for n := 0; n < size; {
+		select {
+		case buf := <-d.send:
+			if len(buf) > discardChunkSize || !bytes.Equal(buf, make([]byte, len(buf))) {
+				t.Fatalf("unexpected padding transfer %x", buf)
+			}
+
+			n += len(buf)
+		case <-time.After(5 * time.Second):
+			t.Fatal("padding timeout")
+		}
+	}
+
+	if c := csw(t, d); c.Tag != 1 || c.Status != usb.CSW_STATUS_COMMAND_FAILED || c.DataResidue != uint32(size) {
+		t.Fatalf("unexpected CSW %+v", c)
+	}
+
+	if err := <-res; err != nil {
+		t.Fatal(err)
+	}
+}
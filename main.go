@@ -9,14 +9,21 @@ import (
 	"fmt"
 	"log"
 	"runtime"
+	"sync/atomic"
 	"time"
+	"unsafe"
 
+	"github.com/usbarmory/armory-drive/api"
+	"github.com/usbarmory/armory-drive/assets"
 	"github.com/usbarmory/armory-drive/internal/ble"
 	"github.com/usbarmory/armory-drive/internal/crypto"
 	"github.com/usbarmory/armory-drive/internal/hab"
+	"github.com/usbarmory/armory-drive/internal/led"
+	"github.com/usbarmory/armory-drive/internal/pool"
 	"github.com/usbarmory/armory-drive/internal/ums"
 
 	"github.com/usbarmory/tamago/arm"
+	"github.com/usbarmory/tamago/bits"
 	"github.com/usbarmory/tamago/soc/nxp/imx6ul"
 	"github.com/usbarmory/tamago/soc/nxp/usb"
 
@@ -34,7 +41,20 @@ func init() {
 	log.SetFlags(0)
 }
 
-func startInterruptHandler(port *usb.USB) {
+// readReg reads a hardware register, as tamago internal/reg which cannot be
+// imported.
+func readReg(addr uint32) uint32 {
+	return atomic.LoadUint32((*uint32)(unsafe.Add(nil, addr)))
+}
+
+// usbStatus returns the USB controller interrupt status register, pending
+// suspend and bus reset events must be checked before it is cleared.
+func usbStatus(port *usb.USB) uint32 {
+	// p3848, 56.6.19 Interrupt Status Register (USB_nUSBSTS), IMX6ULLRM
+	return readReg(port.Base + usb.USB_UOGx_USBSTS)
+}
+
+func startInterruptHandler(port *usb.USB, drive *ums.Drive) {
 	irq := imx6ul.GIC.GetInterrupt(true)
 
 	imx6ul.GIC.EnableInterrupt(port.IRQ, true)
@@ -43,6 +63,16 @@ func startInterruptHandler(port *usb.USB) {
 	isr := func() {
 		switch irq {
 		case port.IRQ:
+			sts := usbStatus(port)
+
+			if bits.Get(&sts, usb.IRQ_SLI) {
+				drive.Suspend()
+			}
+
+			if bits.Get(&sts, usb.USBSTS_URI) {
+				drive.BusReset()
+			}
+
 			port.ServiceInterrupts()
 		case imx6ul.DCP.IRQ:
 			imx6ul.DCP.ServiceInterrupt()
@@ -55,33 +85,49 @@ func startInterruptHandler(port *usb.USB) {
 }
 
 func main() {
-	usbarmory.LED("blue", false)
-	usbarmory.LED("white", false)
+	led.Set("blue", false)
+	led.Set("white", false)
 
 	if err := usbarmory.MMC.Detect(); err != nil {
 		log.Fatal(err)
 	}
 
-	keyring := &crypto.Keyring{}
+	dmaPool := pool.New(pool.DefaultClasses, usb.DTD_PAGE_SIZE)
+
+	keyring := &crypto.Keyring{
+		Pool: dmaPool,
+	}
 
 	if err := keyring.Init(false); err != nil {
 		log.Fatal(err)
 	}
 
+	led.SetPolicy(keyring.Conf.Settings.GetLEDPolicy())
+
+	keyring.Audit(api.LogEvent_BOOT, assets.Revision)
+
 	drive := &ums.Drive{
 		Cipher:  true,
 		Keyring: keyring,
 		Mult:    ums.BLOCK_SIZE_MULTIPLIER,
+		Pool:    dmaPool,
 	}
 
 	ble := &ble.BLE{
 		Drive:   drive,
 		Keyring: keyring,
 	}
-	ble.Init()
+
+	if err := ble.Init(); err != nil {
+		log.Printf("BLE initialization error, %v", err)
+	}
+
+	// expose the BLE API also over USB, for headless hosts
+	drive.Management = ble.HandleEnvelope
 
 	if drive.Init(usbarmory.SD) != nil {
 		var code []byte
+		var data []byte
 		var err error
 
 		// provision Secure Boot as required
@@ -92,7 +138,7 @@ func main() {
 		// Secure Boot has been just activated, rather offer pairing
 		// only by firmware booted internally.
 		if !imx6ul.SDP {
-			code, err = ble.PairingMode()
+			code, data, err = ble.PairingMode()
 
 			if err != nil {
 				log.Fatal(err)
@@ -101,9 +147,9 @@ func main() {
 
 		drive.Cipher = false
 		drive.Mult = 1
-		drive.Ready = true
+		drive.SetReady(true)
 
-		drive.Init(ums.Pairing(code, keyring))
+		drive.Init(ums.Pairing(code, data, keyring))
 
 		go pairingFeedback(drive.PairingComplete)
 	}
@@ -114,8 +160,10 @@ func main() {
 	port.Init()
 
 	// To further reduce the attack surface, start the USB stack only when
-	// the card is unlocked (or in pairing mode).
-	for !drive.Ready {
+	// the card is unlocked (or in pairing mode), unless the management
+	// interface is exposed as it must then be available for unlocking,
+	// meanwhile the mass storage medium is reported as not present.
+	for drive.Management == nil && !drive.Ready() {
 		runtime.Gosched()
 		time.Sleep(10 * time.Millisecond)
 	}
@@ -125,8 +173,9 @@ func main() {
 	port.EnableInterrupt(usb.IRQ_URI) // reset
 	port.EnableInterrupt(usb.IRQ_PCI) // port change detect
 	port.EnableInterrupt(usb.IRQ_UI)  // transfer completion
+	port.EnableInterrupt(usb.IRQ_SLI) // suspend
 
-	startInterruptHandler(port)
+	startInterruptHandler(port, drive)
 }
 
 func pairingFeedback(done chan bool) {
@@ -135,13 +184,13 @@ func pairingFeedback(done chan bool) {
 	for {
 		select {
 		case <-done:
-			usbarmory.LED("blue", false)
+			led.Override("blue", false)
 			return
 		default:
 		}
 
 		on = !on
-		usbarmory.LED("blue", on)
+		led.Override("blue", on)
 
 		runtime.Gosched()
 		time.Sleep(1 * time.Second)